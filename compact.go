@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/spf13/pflag"
+
+	"github.com/fengxsong/sls2oss/internal/compact"
+	"github.com/fengxsong/sls2oss/internal/manifest"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+func init() {
+	commands["compact"] = compactObjects
+}
+
+// compactObjects merge small objects of partitions with manifest under prefix
+func compactObjects(args []string) error {
+	fs := pflag.NewFlagSet("compact", pflag.ExitOnError)
+	addCommonFlags(fs)
+	prefix := fs.String("prefix", "", "compact partitions under this prefix, default is compaction.prefix")
+	date := fs.String("date", "", "only compact partitions starting on this date, yyyy-MM-dd in partition timezone")
+	minSize := fs.Int("min-size", 0, "MB, objects smaller than it are merged, default is compaction.min_object_size")
+	targetSize := fs.Int("target-size", 0, "MB, max size of merged objects, default is compaction.target_size")
+	dryRun := fs.Bool("dry-run", false, "only print objects to be merged")
+	fs.Parse(args)
+
+	cfg, logger, err := setup(fs)
+	if err != nil {
+		return err
+	}
+	if fs.Lookup("prefix").Changed {
+		cfg.Compaction.Prefix = *prefix
+	}
+	if *minSize > 0 {
+		cfg.Compaction.MinObjectSize = *minSize
+	}
+	if *targetSize > 0 {
+		cfg.Compaction.TargetSize = *targetSize
+	}
+	layout, err := partition.New(cfg.Partition)
+	if err != nil {
+		return fmt.Errorf("invalid partition config: %v", err)
+	}
+	var match func(*manifest.Manifest) bool
+	if *date != "" {
+		day, err := time.ParseInLocation("2006-01-02", *date, layout.Location())
+		if err != nil {
+			return fmt.Errorf("invalid date: %v", err)
+		}
+		next := day.AddDate(0, 0, 1)
+		match = func(m *manifest.Manifest) bool {
+			return !m.Start.Before(day) && m.Start.Before(next)
+		}
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create oss writer: %v", err)
+	}
+	c := compact.New(cfg.Compaction, cfg.Manifest, cfg.Output.Oss, ossWriter.Bucket(), ossWriter.Cipher(), logger)
+	stats, err := c.CompactPrefix(cfg.Compaction.Prefix, time.Time{}, match, *dryRun)
+	level.Info(logger).Log("msg", "compaction done", "partitions", stats.Partitions, "merged", stats.Merged, "created", stats.Created, "dry_run", *dryRun)
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/spf13/pflag"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/archive"
+	"github.com/fengxsong/sls2oss/internal/deadletter"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+)
+
+const (
+	replayingSuffix = ".replaying"
+	replayedSuffix  = ".replayed"
+)
+
+func init() {
+	commands["replay-dead-letter"] = replayDeadLetter
+}
+
+// replayDeadLetter send dead letters through the pipeline again, records
+// still failing are dead lettered again.
+func replayDeadLetter(args []string) error {
+	fs := pflag.NewFlagSet("replay-dead-letter", pflag.ExitOnError)
+	addCommonFlags(fs)
+	keep := fs.Bool("keep", false, "keep dead letters after replaying")
+	stage := fs.String("stage", "", "only replay dead letters of this stage, validate/encode/write")
+	fs.Parse(args)
+
+	cfg, logger, err := setup(fs)
+	if err != nil {
+		return err
+	}
+	if cfg.DeadLetter == nil || (cfg.DeadLetter.Dir == "" && cfg.DeadLetter.OssPrefix == "") {
+		return errors.New("dead letter is not configured")
+	}
+	quit := make(chan struct{})
+	// one worker, so every batch is written before returning
+	ossWriter, h, err := newPipeline(cfg, logger, 1, quit)
+	if err != nil {
+		return err
+	}
+	replay := func(e *deadletter.Entry) error {
+		if *stage != "" && e.Stage != *stage {
+			return nil
+		}
+		r, err := e.ToRecord()
+		if err != nil {
+			level.Warn(logger).Log("msg", "skip invalid dead letter", "err", err)
+			return nil
+		}
+		b := internal.NewBatch(e.Source())
+		b.Records = append(b.Records, *r)
+		// records failed again are already sent to dead letter by handler
+		if err = h.Consume(b); err != nil {
+			level.Warn(logger).Log("msg", "replay dead letter", "err", err)
+		}
+		return nil
+	}
+	// replayed dead letters are removed once their records are uploaded
+	var finish func() error
+	if cfg.DeadLetter.Dir != "" {
+		finish, err = replayLocalDeadLetters(cfg.DeadLetter.Dir, *keep, logger, replay)
+	} else {
+		finish, err = replayOssDeadLetters(ossWriter.Bucket(), ossWriter.Cipher(), cfg.DeadLetter.OssPrefix, *keep, logger, replay)
+	}
+	pending, werr := drain(context.Background(), h, ossWriter, logger)
+	if werr == nil && len(pending) == 0 {
+		// failed uploads are left in temp dir as well
+		pending = ossWriter.Pending()
+	}
+	close(quit)
+	if werr != nil {
+		return werr
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d files are not uploaded, dead letters are kept for replaying again", len(pending))
+	}
+	if ferr := finish(); ferr != nil && err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// replayLocalDeadLetters replay dead letter files in dir, the returned finish
+// removes replayed files or renames them if keep is set.
+func replayLocalDeadLetters(dir string, keep bool, logger log.Logger, replay func(*deadletter.Entry) error) (finish func() error, err error) {
+	var files, replayed []string
+	finish = func() error {
+		for _, fn := range replayed {
+			var err error
+			if keep {
+				err = os.Rename(fn, strings.TrimSuffix(fn, replayingSuffix)+replayedSuffix)
+			} else {
+				err = os.Remove(fn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !strings.HasSuffix(path, replayedSuffix) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return finish, err
+	}
+	for _, fn := range files {
+		// rename first, records failed again are appended to a new file
+		replaying := fn
+		if !strings.HasSuffix(fn, replayingSuffix) {
+			replaying = fn + replayingSuffix
+			if err = os.Rename(fn, replaying); err != nil {
+				return finish, err
+			}
+		}
+		level.Info(logger).Log("msg", "replay dead letters", "file", fn)
+		f, err := os.Open(replaying)
+		if err != nil {
+			return finish, err
+		}
+		err = deadletter.Decode(f, replay)
+		f.Close()
+		if err != nil {
+			return finish, err
+		}
+		replayed = append(replayed, replaying)
+	}
+	return finish, nil
+}
+
+// replayOssDeadLetters replay dead letter objects under prefix, the returned
+// finish deletes replayed objects unless keep is set.
+func replayOssDeadLetters(bucket *oss.Bucket, cipher *envelope.Cipher, prefix string, keep bool, logger log.Logger, replay func(*deadletter.Entry) error) (finish func() error, err error) {
+	prefix = strings.Trim(prefix, "/") + "/"
+	var keys, replayed []string
+	finish = func() error {
+		if keep {
+			return nil
+		}
+		for _, key := range replayed {
+			if err := bucket.DeleteObject(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	marker := oss.Marker("")
+	for {
+		result, err := bucket.ListObjects(oss.Prefix(prefix), marker)
+		if err != nil {
+			return finish, err
+		}
+		for _, obj := range result.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = oss.Marker(result.NextMarker)
+	}
+	for _, key := range keys {
+		level.Info(logger).Log("msg", "replay dead letters", "object", key)
+		body, err := bucket.GetObject(key, archive.Identity)
+		if err != nil {
+			return finish, err
+		}
+		// dead letters are uploaded by oss writer, so they're encrypted the same way
+		r, err := envelope.Open(cipher, body)
+		if err == nil {
+			err = deadletter.Decode(r, replay)
+		}
+		body.Close()
+		if err != nil {
+			return finish, err
+		}
+		replayed = append(replayed, key)
+	}
+	return finish, nil
+}
@@ -7,11 +7,20 @@ require (
 	github.com/aliyun/aliyun-oss-go-sdk v2.1.8+incompatible
 	github.com/baiyubin/aliyun-sts-go-sdk v0.0.0-20180326062324-cfa1a18b161f // indirect
 	github.com/go-kit/kit v0.10.0
+	github.com/gogo/protobuf v1.3.1
 	github.com/prometheus/client_golang v1.10.0
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b // indirect
 	github.com/spf13/pflag v1.0.5
 	github.com/vjeantet/jodaTime v1.0.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	go.uber.org/automaxprocs v1.4.0
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	sigs.k8s.io/yaml v1.2.0
 )
+
+// consumer.workerClient digs the client out of unexported fields of the
+// consumer library, keep it at the version TestWorkerClient verifies
+replace github.com/aliyun/aliyun-log-go-sdk => github.com/aliyun/aliyun-log-go-sdk v0.1.20
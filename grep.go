@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/spf13/pflag"
+
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/query"
+	"github.com/fengxsong/sls2oss/internal/search"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+func init() {
+	commands["grep"] = grepArchives
+}
+
+// grepArchives print archived records of logstore in time range matching expression
+func grepArchives(args []string) error {
+	fs := pflag.NewFlagSet("grep", pflag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sls2oss grep --logstore X --from T1 --to T2 [flags] 'expr'")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs)
+	logstore := fs.String("logstore", "", "logstore of records, rendered as {topic} and {logstore} of key template")
+	from := fs.String("from", "1h", "start of time range, RFC3339, `2006-01-02 15:04:05` in partition timezone, or duration before now")
+	to := fs.String("to", "", "end of time range, same format as --from, default is now")
+	parallel := fs.Int("parallel", 8, "objects searched at the same time")
+	limit := fs.Int("limit", 0, "stop after printing this many records, 0 means unlimited")
+	includeLate := fs.Bool("include-late", false, "also search late records under watermark.late_prefix")
+	fs.Parse(args)
+
+	if *logstore == "" {
+		return errors.New("--logstore is required")
+	}
+	expr, err := query.Parse(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid expression: %v", err)
+	}
+	cfg, logger, err := setup(fs)
+	if err != nil {
+		return err
+	}
+	layout, err := partition.New(cfg.Partition)
+	if err != nil {
+		return fmt.Errorf("invalid partition config: %v", err)
+	}
+	now := time.Now()
+	start, err := parseTimeFlag(*from, layout.Location(), now)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %v", err)
+	}
+	end := now
+	if *to != "" {
+		if end, err = parseTimeFlag(*to, layout.Location(), now); err != nil {
+			return fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+	prefixes := search.Prefixes(cfg.Output.Oss.KeyTemplate, layout, cfg.Input.Sls.Project, *logstore, start, end)
+	if *includeLate {
+		for _, p := range prefixes {
+			prefixes = append(prefixes, path.Join(cfg.Watermark.LatePrefix, p)+"/")
+		}
+	}
+	level.Debug(logger).Log("msg", "search prefixes", "prefixes", fmt.Sprint(prefixes))
+
+	quit := make(chan struct{})
+	defer close(quit)
+	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create oss writer: %v", err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	stats, err := search.Search(ossWriter.Bucket(), prefixes, search.Options{
+		From:     start,
+		To:       end,
+		Expr:     expr,
+		Parallel: *parallel,
+		Limit:    *limit,
+		Cipher:   ossWriter.Cipher(),
+	}, out, logger)
+	if ferr := out.Flush(); ferr != nil && err == nil {
+		err = ferr
+	}
+	level.Info(logger).Log("msg", "search done", "objects", stats.Objects, "records", stats.Records, "matched", stats.Matched)
+	return err
+}
+
+// parseTimeFlag parse RFC3339, local time in loc, or duration before now
+func parseTimeFlag(s string, loc *time.Location, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format %q", s)
+}
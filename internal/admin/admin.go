@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/consumer"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+const (
+	prefix   = "/admin/"
+	redacted = "******"
+)
+
+// Server serve admin api for runtime control, it shares port with metrics
+type Server struct {
+	cfg       *config.Config
+	token     string
+	w         *writer.OssWriter
+	consumers map[string]consumer.Consumer
+	logger    log.Logger
+	syncing   int32
+}
+
+func New(cfg *config.Config, w *writer.OssWriter, consumers map[string]consumer.Consumer, logger log.Logger) *Server {
+	return &Server{
+		cfg:       cfg,
+		token:     cfg.Admin.Token,
+		w:         w,
+		consumers: consumers,
+		logger:    logger,
+	}
+}
+
+// Register admin handlers to mux
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.Handle(prefix+"writers", s.auth(http.MethodGet, s.listWriters))
+	mux.Handle(prefix+"flush", s.auth(http.MethodPost, s.flush))
+	mux.Handle(prefix+"consumers", s.auth(http.MethodGet, s.listConsumers))
+	mux.Handle(prefix+"consumers/pause", s.auth(http.MethodPost, s.pause))
+	mux.Handle(prefix+"consumers/resume", s.auth(http.MethodPost, s.resume))
+	mux.Handle(prefix+"sync-orphans", s.auth(http.MethodPost, s.syncOrphans))
+	mux.Handle(prefix+"config", s.auth(http.MethodGet, s.showConfig))
+}
+
+func (s *Server) auth(method string, fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(rw, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		// empty token is rejected by config, never treat it as no auth
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(rw, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		level.Info(s.logger).Log("msg", "admin request", "method", r.Method, "uri", r.RequestURI, "remote", r.RemoteAddr)
+		fn(rw, r)
+	})
+}
+
+func (s *Server) listWriters(rw http.ResponseWriter, r *http.Request) {
+	infos := s.w.Writers()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Pattern < infos[j].Pattern })
+	writeJSON(rw, http.StatusOK, infos)
+}
+
+// flush close file of writer with `pattern` query, or all writers
+func (s *Server) flush(rw http.ResponseWriter, r *http.Request) {
+	if err := s.w.Flush(r.URL.Query().Get("pattern")); err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]string{"status": "flushed"})
+}
+
+func (s *Server) listConsumers(rw http.ResponseWriter, r *http.Request) {
+	states := make(map[string]string, len(s.consumers))
+	for ls, c := range s.consumers {
+		states[ls] = "running"
+		if c.Paused() {
+			states[ls] = "paused"
+		}
+	}
+	writeJSON(rw, http.StatusOK, states)
+}
+
+func (s *Server) pause(rw http.ResponseWriter, r *http.Request) {
+	c, ok := s.consumer(rw, r)
+	if !ok {
+		return
+	}
+	c.Pause()
+	writeJSON(rw, http.StatusOK, map[string]string{"status": "paused"})
+}
+
+func (s *Server) resume(rw http.ResponseWriter, r *http.Request) {
+	c, ok := s.consumer(rw, r)
+	if !ok {
+		return
+	}
+	c.Resume()
+	writeJSON(rw, http.StatusOK, map[string]string{"status": "running"})
+}
+
+func (s *Server) consumer(rw http.ResponseWriter, r *http.Request) (consumer.Consumer, bool) {
+	ls := r.URL.Query().Get("logstore")
+	c, ok := s.consumers[ls]
+	if !ok {
+		writeError(rw, http.StatusNotFound, "logstore "+ls+" not found")
+	}
+	return c, ok
+}
+
+// syncOrphans send orphaned files in background, only one sync runs at a time
+func (s *Server) syncOrphans(rw http.ResponseWriter, r *http.Request) {
+	if !atomic.CompareAndSwapInt32(&s.syncing, 0, 1) {
+		writeError(rw, http.StatusConflict, "orphan sync is running")
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.syncing, 0)
+		if err := s.w.SyncOrphanedFiles(); err != nil {
+			level.Error(s.logger).Log("msg", "sync orphaned files", "err", err)
+		}
+	}()
+	writeJSON(rw, http.StatusAccepted, map[string]string{"status": "syncing"})
+}
+
+func (s *Server) showConfig(rw http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(s.cfg)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(rw, http.StatusOK, redact(v))
+}
+
+// redact replace values of sensitive keys
+func redact(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			if isSensitive(k) {
+				if s, ok := child.(string); ok && s != "" {
+					value[k] = redacted
+				}
+				continue
+			}
+			value[k] = redact(child)
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redact(value[i])
+		}
+	}
+	return v
+}
+
+// settings named like keys which are not secrets
+var plainKeys = map[string]bool{
+	"kms_key_id": true,
+	"worker_key": true,
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	if plainKeys[key] {
+		return false
+	}
+	return strings.HasSuffix(key, "_key") || key == "key" || strings.Contains(key, "secret") || strings.Contains(key, "token") ||
+		strings.Contains(key, "password") || strings.Contains(key, "authorization") || strings.Contains(key, "api-key")
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeError(rw http.ResponseWriter, code int, msg string) {
+	writeJSON(rw, code, map[string]string{"error": msg})
+}
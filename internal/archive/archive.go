@@ -0,0 +1,174 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+)
+
+const gzExtension = ".gz"
+
+// Identity ask for objects as stored, otherwise objects uploaded with
+// Content-Encoding gzip are decompressed by http transport on the fly
+var Identity = oss.AcceptEncoding("identity")
+
+// List return data objects under prefix, manifests and markers whose names
+// start with `_` are skipped.
+func List(bucket *oss.Bucket, prefix string) ([]oss.ObjectProperties, error) {
+	var objects []oss.ObjectProperties
+	marker := oss.Marker("")
+	for {
+		result, err := bucket.ListObjects(oss.Prefix(prefix), marker)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Objects {
+			if strings.HasPrefix(path.Base(obj.Key), "_") || strings.HasSuffix(obj.Key, "/") {
+				continue
+			}
+			objects = append(objects, obj)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = oss.Marker(result.NextMarker)
+	}
+	return objects, nil
+}
+
+// Open return decoded content of archived object, encrypted objects are
+// decrypted by c and gzip objects are decompressed
+func Open(bucket *oss.Bucket, key string, c *envelope.Cipher) (io.ReadCloser, error) {
+	body, err := bucket.GetObject(key, Identity)
+	if err != nil {
+		return nil, err
+	}
+	r, err := envelope.Open(c, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return decompress(&readCloser{Reader: r, closers: []io.Closer{body}}, strings.HasSuffix(key, gzExtension))
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	var err error
+	for _, c := range rc.closers {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// decompress wrap body with gzip reader if it's gzipped, by name or magic number
+func decompress(body io.ReadCloser, gz bool) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	if !gz {
+		magic, _ := br.Peek(2)
+		gz = bytes.Equal(magic, []byte{0x1f, 0x8b})
+	}
+	if !gz {
+		return &readCloser{Reader: br, closers: []io.Closer{body}}, nil
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: gr, closers: []io.Closer{gr, body}}, nil
+}
+
+// Decode call fn with records of r in order, r is ndjson or a json array of
+// records. Numbers are kept as json.Number.
+func Decode(r io.Reader, fn func(i int, rec map[string]interface{}) error) error {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+	array := false
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		array = b[0] == '['
+		break
+	}
+	if array {
+		// consume [
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for i := 0; ; i++ {
+		if array && !dec.More() {
+			return nil
+		}
+		rec := make(map[string]interface{})
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF && !array {
+				return nil
+			}
+			return err
+		}
+		if err := fn(i, rec); err != nil {
+			return err
+		}
+	}
+}
+
+// RecordTime return event time of record, which is RFC3339 string or unix seconds
+func RecordTime(rec map[string]interface{}) (time.Time, bool) {
+	switch v := rec[internal.TimeKey].(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// String return value of field as string, values not string are json encoded
+func String(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
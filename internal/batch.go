@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+)
+
+// Record is a single log of a log group, tags and contents are referenced
+// from the fetched log group list instead of being copied.
+type Record struct {
+	Topic    string
+	Time     time.Time
+	Tags     []*sls.LogTag
+	Contents []*sls.LogContent
+}
+
+// Get return value of a content key without building the whole record
+func (r *Record) Get(key string) (string, bool) {
+	// the last one wins, same as Fields
+	for i := len(r.Contents) - 1; i >= 0; i-- {
+		if r.Contents[i].GetKey() == key {
+			return r.Contents[i].GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// Fields clear m and fill it with all fields of record
+func (r *Record) Fields(m map[string]interface{}) {
+	for k := range m {
+		delete(m, k)
+	}
+	m[TopicKey] = r.Topic
+	m[TimeKey] = r.Time
+	for _, tag := range r.Tags {
+		m[tag.GetKey()] = tag.GetValue()
+	}
+	for _, content := range r.Contents {
+		m[content.GetKey()] = content.GetValue()
+	}
+}
+
+// Batch is records fetched from a shard at once, it's owned by whoever holds
+// it and must be released after being consumed.
+type Batch struct {
+	Source  *Source
+	Records []Record
+	// Ctx carries span of the fetched log group list
+	Ctx context.Context
+	// Done is called once records are written, nil if nobody waits for it
+	Done func()
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} { return &Batch{Records: make([]Record, 0, 256)} },
+}
+
+// NewBatch get a batch from pool
+func NewBatch(src *Source) *Batch {
+	b := batchPool.Get().(*Batch)
+	b.Source = src
+	b.Ctx = context.Background()
+	return b
+}
+
+// Release reset batch and put it back to pool
+func (b *Batch) Release() {
+	for i := range b.Records {
+		b.Records[i] = Record{}
+	}
+	b.Records = b.Records[:0]
+	b.Source = nil
+	b.Ctx = nil
+	b.Done = nil
+	batchPool.Put(b)
+}
@@ -0,0 +1,481 @@
+package compact
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal/archive"
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+	"github.com/fengxsong/sls2oss/internal/manifest"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+const (
+	// CompactedPrefix is name prefix of merged objects
+	CompactedPrefix = "compacted-"
+	// TempDir is where merged objects are built, relative to temp dir of oss output
+	TempDir = ".compact"
+
+	gzExtension = ".gz"
+	megabyte    = 1024 * 1024
+)
+
+// Stats summarize a compaction
+type Stats struct {
+	Partitions int
+	Merged     int // objects merged
+	Created    int // objects created
+}
+
+// Compactor merge small objects of partitions into larger ones. Only
+// partitions with manifest are compacted, manifest is the commit point:
+// merged object is uploaded first, then manifest is swapped to list it
+// instead of originals, and originals are deleted at last. Originals left by
+// a crash are recorded as replaced in manifest and deleted by the next run.
+type Compactor struct {
+	cfg      *config.Compaction
+	manifest *config.Manifest
+	oss      *config.OssConfig
+	bucket   *oss.Bucket
+	cipher   *envelope.Cipher
+	logger   log.Logger
+}
+
+// New create compactor, cipher decrypts objects and encrypts merged objects
+// if client side encryption is enabled.
+func New(cfg *config.Compaction, manifestCfg *config.Manifest, ossCfg *config.OssConfig, bucket *oss.Bucket, cipher *envelope.Cipher, logger log.Logger) *Compactor {
+	return &Compactor{
+		cfg:      cfg,
+		manifest: manifestCfg,
+		oss:      ossCfg,
+		bucket:   bucket,
+		cipher:   cipher,
+		logger:   logger,
+	}
+}
+
+// Run compact partitions updated within lookback periodically until quit
+func (c *Compactor) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(c.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			since := time.Now().Add(-time.Duration(c.cfg.Lookback))
+			stats, err := c.CompactPrefix(c.cfg.Prefix, since, nil, false)
+			if err != nil {
+				level.Error(c.logger).Log("msg", "compact partitions", "prefix", c.cfg.Prefix, "err", err)
+				continue
+			}
+			level.Info(c.logger).Log("msg", "compaction done", "partitions", stats.Partitions, "merged", stats.Merged, "created", stats.Created)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// CompactPrefix compact partitions under prefix whose manifests are updated
+// after since and match, zero since and nil match select all of them.
+func (c *Compactor) CompactPrefix(prefix string, since time.Time, match func(*manifest.Manifest) bool, dryRun bool) (Stats, error) {
+	var stats Stats
+	dirs, err := c.partitions(prefix, since)
+	if err != nil {
+		return stats, err
+	}
+	for _, dir := range dirs {
+		key := path.Join(dir, c.manifest.Name)
+		m, err := manifest.Get(c.bucket, key)
+		if err != nil {
+			return stats, err
+		}
+		if m == nil || (match != nil && !match(m)) {
+			continue
+		}
+		stats.Partitions++
+		merged, created, err := c.Compact(dir, m, dryRun)
+		stats.Merged += merged
+		stats.Created += created
+		if err != nil {
+			return stats, fmt.Errorf("compact %s: %v", dir, err)
+		}
+	}
+	return stats, nil
+}
+
+// partitions return directories under prefix having manifest modified after since
+func (c *Compactor) partitions(prefix string, since time.Time) ([]string, error) {
+	var dirs []string
+	marker := oss.Marker("")
+	for {
+		result, err := c.bucket.ListObjects(oss.Prefix(prefix), marker)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Objects {
+			if path.Base(obj.Key) == c.manifest.Name && obj.LastModified.After(since) {
+				dirs = append(dirs, path.Dir(obj.Key))
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = oss.Marker(result.NextMarker)
+	}
+	return dirs, nil
+}
+
+// Compact merge small objects listed in manifest of dir, return number of
+// objects merged and created.
+func (c *Compactor) Compact(dir string, m *manifest.Manifest, dryRun bool) (merged, created int, err error) {
+	manifestKey := path.Join(dir, c.manifest.Name)
+	if !dryRun {
+		if err = c.cleanup(dir, manifestKey); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, group := range c.plan(m) {
+		keys := make([]string, len(group))
+		for i, e := range group {
+			keys[i] = e.Key
+		}
+		if dryRun {
+			level.Info(c.logger).Log("msg", "would merge objects", "partition", dir, "objects", strings.Join(keys, ","))
+			merged += len(group)
+			created++
+			continue
+		}
+		begin := time.Now()
+		e, err := c.merge(dir, group)
+		if err != nil {
+			return merged, created, err
+		}
+		swapped, err := c.swap(manifestKey, keys, e, begin)
+		if err != nil {
+			return merged, created, err
+		}
+		if !swapped {
+			// never listed, so nobody else refers to it
+			level.Warn(c.logger).Log("msg", "objects changed or grace passed while merging, drop merged object", "partition", dir, "object", e.Key)
+			if err = c.bucket.DeleteObject(e.Key); err != nil {
+				return merged, created, err
+			}
+			continue
+		}
+		level.Info(c.logger).Log("msg", "objects merged", "partition", dir, "object", e.Key, "merged", len(group), "records", e.Records)
+		merged += len(group)
+		created++
+	}
+	return merged, created, nil
+}
+
+// swap list merged object instead of originals in the latest manifest, and
+// delete originals. False is returned if any of originals is no longer
+// listed, or if merged object is as old as orphan grace since begin, when
+// cleanup of another process may have deleted it already.
+func (c *Compactor) swap(manifestKey string, keys []string, e manifest.Entry, begin time.Time) (bool, error) {
+	m, err := manifest.Update(c.bucket, manifestKey, func(m *manifest.Manifest) (*manifest.Manifest, error) {
+		if m == nil || !m.Lists(keys...) || time.Since(begin) >= time.Duration(c.cfg.OrphanGrace) {
+			return nil, nil
+		}
+		// readers of manifest see either originals or merged object
+		m.Remove(keys...)
+		m.Merge(e)
+		m.Replaced = append(m.Replaced, keys...)
+		return m, nil
+	})
+	if err != nil || m == nil {
+		return false, err
+	}
+	return true, c.deleteReplaced(manifestKey, m.Replaced)
+}
+
+// cleanup finish swaps interrupted by crash, and delete merged objects not
+// listed in manifest. They're only deleted after orphan grace, as manifest
+// may be swapped by another process right after they're uploaded, and
+// manifest is read again right before deleting, so objects swapped in while
+// listing are kept.
+func (c *Compactor) cleanup(dir, manifestKey string) error {
+	m, err := manifest.Get(c.bucket, manifestKey)
+	if err != nil || m == nil {
+		return err
+	}
+	if len(m.Replaced) > 0 {
+		if err = c.deleteReplaced(manifestKey, m.Replaced); err != nil {
+			return err
+		}
+	}
+	var orphans []oss.ObjectProperties
+	cutoff := time.Now().Add(-time.Duration(c.cfg.OrphanGrace))
+	marker := oss.Marker("")
+	for {
+		result, err := c.bucket.ListObjects(oss.Prefix(path.Join(dir, CompactedPrefix)), marker)
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Objects {
+			if path.Dir(obj.Key) == dir && !obj.LastModified.After(cutoff) {
+				orphans = append(orphans, obj)
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = oss.Marker(result.NextMarker)
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	if m, err = manifest.Get(c.bucket, manifestKey); err != nil || m == nil {
+		return err
+	}
+	for _, obj := range orphans {
+		if m.Lists(obj.Key) {
+			continue
+		}
+		level.Warn(c.logger).Log("msg", "delete merged object not listed in manifest", "object", obj.Key, "last_modified", obj.LastModified)
+		if err = c.bucket.DeleteObject(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteReplaced delete replaced objects and drop them from replaced of manifest
+func (c *Compactor) deleteReplaced(manifestKey string, keys []string) error {
+	deleted := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if err := c.bucket.DeleteObject(key); err != nil {
+			if serr, ok := err.(oss.ServiceError); !ok || serr.StatusCode != http.StatusNotFound {
+				return err
+			}
+		}
+		deleted[key] = struct{}{}
+	}
+	_, err := manifest.Update(c.bucket, manifestKey, func(m *manifest.Manifest) (*manifest.Manifest, error) {
+		if m == nil {
+			return nil, nil
+		}
+		replaced := m.Replaced[:0]
+		for _, key := range m.Replaced {
+			if _, ok := deleted[key]; !ok {
+				replaced = append(replaced, key)
+			}
+		}
+		if len(replaced) == len(m.Replaced) {
+			return nil, nil
+		}
+		m.Replaced = replaced
+		return m, nil
+	})
+	return err
+}
+
+// plan group small objects by codec, each group is merged into one object
+func (c *Compactor) plan(m *manifest.Manifest) [][]manifest.Entry {
+	minSize := int64(c.cfg.MinObjectSize) * megabyte
+	targetSize := int64(c.cfg.TargetSize) * megabyte
+	byCodec := make(map[bool][]manifest.Entry)
+	for _, e := range m.Objects {
+		if e.Size < minSize {
+			gz := strings.HasSuffix(e.Key, gzExtension)
+			byCodec[gz] = append(byCodec[gz], e)
+		}
+	}
+	var groups [][]manifest.Entry
+	for _, gz := range []bool{false, true} {
+		entries := byCodec[gz]
+		sort.Slice(entries, func(i, j int) bool { return entries[i].MinTime.Before(entries[j].MinTime) })
+		var (
+			group []manifest.Entry
+			size  int64
+		)
+		for _, e := range entries {
+			if len(group) > 0 && size+e.Size > targetSize {
+				groups = appendGroup(groups, group)
+				group, size = nil, 0
+			}
+			group = append(group, e)
+			size += e.Size
+		}
+		groups = appendGroup(groups, group)
+	}
+	return groups
+}
+
+// appendGroup skip groups of a single object, nothing to merge
+func appendGroup(groups [][]manifest.Entry, group []manifest.Entry) [][]manifest.Entry {
+	if len(group) < 2 {
+		return groups
+	}
+	return append(groups, group)
+}
+
+// merge concatenate records of objects into a new object with the same codec,
+// record count is verified against manifest and uploaded object.
+func (c *Compactor) merge(dir string, group []manifest.Entry) (manifest.Entry, error) {
+	gz := strings.HasSuffix(group[0].Key, gzExtension)
+	name := CompactedPrefix + strconv.FormatInt(time.Now().Unix(), 10) + "-" + writer.RandStringRunes(5)
+	if gz {
+		name += gzExtension
+	}
+	e := manifest.Entry{Key: path.Join(dir, name)}
+
+	tempDir := filepath.Join(c.oss.TempDir, TempDir)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return e, err
+	}
+	f, err := ioutil.TempFile(tempDir, "merge-")
+	if err != nil {
+		return e, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := crc64.New(crc64.MakeTable(crc64.ECMA))
+	md5sum := md5.New()
+	var (
+		out io.Writer = io.MultiWriter(f, sum, md5sum)
+		ew  io.WriteCloser
+		gw  *gzip.Writer
+	)
+	if c.cipher != nil {
+		if ew, err = c.cipher.NewWriter(out); err != nil {
+			return e, err
+		}
+		out = ew
+	}
+	if gz {
+		if gw, err = gzip.NewWriterLevel(out, c.oss.CompressLevel); err != nil {
+			return e, err
+		}
+		out = gw
+	}
+	lw := &lineWriter{w: out}
+	var stat writer.FileStat
+	for _, o := range group {
+		before := lw.lines
+		if err = c.copyObject(lw, o.Key, gz); err != nil {
+			return e, err
+		}
+		if err = lw.terminate(); err != nil {
+			return e, err
+		}
+		if n := lw.lines - before; o.Records > 0 && n != o.Records {
+			return e, fmt.Errorf("object %s has %d records, %d in manifest", o.Key, n, o.Records)
+		}
+		stat.Add(writer.FileStat{MinTime: o.MinTime, MaxTime: o.MaxTime, Logstores: o.Logstores, Shards: o.Shards})
+	}
+	if gw != nil {
+		if err = gw.Close(); err != nil {
+			return e, err
+		}
+	}
+	if ew != nil {
+		if err = ew.Close(); err != nil {
+			return e, err
+		}
+	}
+	if err = f.Close(); err != nil {
+		return e, err
+	}
+	e.Records = lw.lines
+	e.MinTime, e.MaxTime = stat.MinTime, stat.MaxTime
+	e.Logstores, e.Shards = stat.Logstores, stat.Shards
+	stat.Records = e.Records
+	e.CRC64 = strconv.FormatUint(sum.Sum64(), 10)
+	e.MD5 = hex.EncodeToString(md5sum.Sum(nil))
+	if info, err := os.Stat(f.Name()); err == nil {
+		e.Size = info.Size()
+	}
+
+	var header http.Header
+	options := append(writer.UploadOptions(c.oss, e.Key, stat),
+		oss.ContentMD5(base64.StdEncoding.EncodeToString(md5sum.Sum(nil))), oss.GetResponseHeader(&header))
+	if err = c.bucket.PutObjectFromFile(e.Key, f.Name(), options...); err != nil {
+		return e, err
+	}
+	if remote := header.Get(oss.HTTPHeaderOssCRC64); remote != "" && remote != e.CRC64 {
+		return e, fmt.Errorf("crc64 of merged object %s is %s, expected %s", e.Key, remote, e.CRC64)
+	}
+	e.UploadedAt = time.Now()
+	// verify what's uploaded before swapping manifest
+	counter := &lineWriter{w: ioutil.Discard}
+	if err = c.copyObject(counter, e.Key, gz); err != nil {
+		return e, err
+	}
+	if counter.terminate(); counter.lines != e.Records {
+		return e, fmt.Errorf("merged object %s has %d records, expected %d", e.Key, counter.lines, e.Records)
+	}
+	return e, nil
+}
+
+// copyObject copy decoded content of object to w
+func (c *Compactor) copyObject(w io.Writer, key string, gz bool) error {
+	body, err := c.bucket.GetObject(key, archive.Identity)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	r, err := envelope.Open(c.cipher, body)
+	if err != nil {
+		return err
+	}
+	if gz {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// lineWriter count lines written through it
+type lineWriter struct {
+	w     io.Writer
+	lines int
+	last  byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n, err := lw.w.Write(p)
+	for _, b := range p[:n] {
+		if b == '\n' {
+			lw.lines++
+		}
+	}
+	if n > 0 {
+		lw.last = p[n-1]
+	}
+	return n, err
+}
+
+// terminate end the last line if it's not ended, so records of objects are not joined
+func (lw *lineWriter) terminate() error {
+	if lw.last == 0 || lw.last == '\n' {
+		return nil
+	}
+	_, err := lw.Write([]byte{'\n'})
+	return err
+}
@@ -3,41 +3,190 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"runtime"
+	"strings"
 	"time"
 
 	"sigs.k8s.io/yaml"
 )
 
 type Config struct {
-	Input   *Input   `json:"input"`
-	Filter  *Filter  `json:"filter,omitempty"`
-	Output  *Output  `json:"output"`
-	Metric  *Metric  `json:"metric,omitempty"`
-	Logging *Logging `json:"logging,omitempty"`
-	Worker  int      `json:"worker,omitempty"`
+	Input      *Input      `json:"input"`
+	Filter     *Filter     `json:"filter,omitempty"`
+	Output     *Output     `json:"output"`
+	Partition  *Partition  `json:"partition,omitempty"`
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+	Metric     *Metric     `json:"metric,omitempty"`
+	Admin      *Admin      `json:"admin,omitempty"`
+	Health     *Health     `json:"health,omitempty"`
+	Tracing    *Tracing    `json:"tracing,omitempty"`
+	Manifest   *Manifest   `json:"manifest,omitempty"`
+	Watermark  *Watermark  `json:"watermark,omitempty"`
+	Compaction *Compaction `json:"compaction,omitempty"`
+	Retention  *Retention  `json:"retention,omitempty"`
+	Logging    *Logging    `json:"logging,omitempty"`
+	Worker     int         `json:"worker,omitempty"`
+	// WorkerKey dispatch records to workers by shard/none/field.<name>,
+	// default is shard if input.sls.in_order is set, otherwise none.
+	WorkerKey string `json:"worker_key,omitempty"`
+	// ShutdownTimeout bound draining on exit, files not uploaded in time are
+	// left for orphan sync
+	ShutdownTimeout Duration `json:"shutdown_timeout,omitempty"`
 }
 
 type Input struct {
 	Sls *SlsConfig `json:"sls"`
 }
 
+// Filter chain runs in the order of fields below
 type Filter struct {
-	//
+	JSON      []*JSONFilter    `json:"json,omitempty"`
+	Convert   *ConvertFilter   `json:"convert,omitempty"`
+	Timestamp *TimestampFilter `json:"timestamp,omitempty"`
+}
+
+// JSONFilter expand a json string field into nested objects
+type JSONFilter struct {
+	Field        string `json:"field"`
+	Target       string `json:"target,omitempty"`    // prefix of expanded keys, default is the field itself
+	Flatten      bool   `json:"flatten,omitempty"`   // flatten nested objects into top level keys
+	Separator    string `json:"separator,omitempty"` // default is "."
+	MaxDepth     int    `json:"max_depth,omitempty"` // levels of objects parsed, deeper ones are kept as json strings, 0 means unlimited
+	KeepOriginal bool   `json:"keep_original,omitempty"`
+}
+
+// ConvertFilter coerce string values into typed values
+type ConvertFilter struct {
+	Fields    []*FieldConversion `json:"fields,omitempty"`
+	Infer     bool               `json:"infer,omitempty"`      // infer int/float/bool for fields not listed
+	OnFailure string             `json:"on_failure,omitempty"` // keep/null/drop, default is keep
+}
+
+type FieldConversion struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`               // string/int/float/bool/timestamp/duration
+	Layout   string `json:"layout,omitempty"`   // go time layout or unix/unix_ms/unix_us/unix_ns, only for timestamp
+	Timezone string `json:"timezone,omitempty"` // used when layout contains no zone, default is partition timezone or UTC
+}
+
+// TimestampFilter extract event time from a log field, fallback to the sls time
+type TimestampFilter struct {
+	Field     string   `json:"field"`
+	Layouts   []string `json:"layouts,omitempty"`  // tried in order, default is RFC3339Nano
+	Timezone  string   `json:"timezone,omitempty"` // used when layout contains no zone, default is local
+	KeepField bool     `json:"keep_field,omitempty"`
 }
 
 type Output struct {
 	Oss *OssConfig `json:"oss"`
 }
 
+// Partition define how event time maps to object paths
+type Partition struct {
+	Style      string       `json:"style,omitempty"`    // joda/hive, default is joda
+	Format     string       `json:"format,omitempty"`   // joda format, only for joda style
+	Timezone   string       `json:"timezone,omitempty"` // IANA name like UTC or Asia/Shanghai, default is local
+	HiveFields []*HiveField `json:"hive_fields,omitempty"`
+}
+
+// HiveField render as `name=<joda formatted time>`
+type HiveField struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+}
+
+// DeadLetter store records failed to be processed into local dir or under
+// prefix of the output bucket
+type DeadLetter struct {
+	Dir       string `json:"dir,omitempty"`
+	OssPrefix string `json:"oss_prefix,omitempty"`
+}
+
 type Logging struct {
 	Level  string `json:"level"`
 	File   string `json:"file"`
 	Format string `json:"format"`
 }
 
+// Admin api for runtime control, served with metrics
+type Admin struct {
+	Enabled bool   `json:"enabled"`
+	Token   string `json:"token,omitempty"` // bearer token, required if it's enabled
+}
+
+// Health thresholds of liveness probe, /healthz and /readyz are served with metrics
+type Health struct {
+	HeartbeatTimeout     Duration `json:"heartbeat_timeout,omitempty"`      // max time without consumer progress, default is 1m
+	UploadFailureTimeout Duration `json:"upload_failure_timeout,omitempty"` // default is 10m
+	MinFreeDisk          int      `json:"min_free_disk,omitempty"`          // MB of temp dir, default is 100, -1 disables it
+}
+
+// Manifest record uploaded objects of each partition, and mark partitions
+// complete once event-time watermark of consumed shards passes them. Only an
+// instance holding every shard of its logstores knows the watermark, so
+// success markers are never written if consumers of the group are spread
+// over multiple instances.
+type Manifest struct {
+	Enabled       bool     `json:"enabled"`
+	Grace         Duration `json:"grace,omitempty"`          // wait after end of partition, default is 5m
+	Name          string   `json:"name,omitempty"`           // default is _manifest.json
+	SuccessMarker string   `json:"success_marker,omitempty"` // default is _SUCCESS
+}
+
+// Watermark close files of partitions once event-time watermark of consumed
+// shards passes their end plus allowed lateness, records arriving after that
+// are late and written under late prefix instead of reopening the partition.
+type Watermark struct {
+	Enabled         bool     `json:"enabled"`
+	AllowedLateness Duration `json:"allowed_lateness,omitempty"` // default is 5m
+	LatePrefix      string   `json:"late_prefix,omitempty"`      // prefix of object keys of late records, default is _late
+}
+
+// Compaction merge small objects of partitions having manifests, background
+// compaction should be enabled on only one instance.
+type Compaction struct {
+	Enabled       bool     `json:"enabled"`                   // run in background
+	Prefix        string   `json:"prefix,omitempty"`          // compact partitions under it
+	Interval      Duration `json:"interval,omitempty"`        // default is 1h
+	Lookback      Duration `json:"lookback,omitempty"`        // compact partitions whose manifests are updated within it in background, default is 48h
+	MinObjectSize int      `json:"min_object_size,omitempty"` // MB, objects smaller than it are merged, default is 16
+	TargetSize    int      `json:"target_size,omitempty"`     // MB, max size of merged objects, default is 256
+	// merged objects not listed in manifest are deleted once they're older
+	// than it, as manifest may be swapped by another process, default is 24h
+	OrphanGrace Duration `json:"orphan_grace,omitempty"`
+}
+
+// Retention delete partitions whose end is older than retention of their
+// logstore, background sweeping should be enabled on only one instance.
+type Retention struct {
+	Enabled  bool             `json:"enabled"`             // run sweeper in background
+	Interval Duration         `json:"interval,omitempty"`  // default is 1h
+	DryRun   bool             `json:"dry_run,omitempty"`   // only audit partitions to be deleted
+	AuditLog string           `json:"audit_log,omitempty"` // file of deletions in json lines, default is the log
+	Rules    []*RetentionRule `json:"rules,omitempty"`
+}
+
+type RetentionRule struct {
+	Logstore string `json:"logstore"`
+	Prefix   string `json:"prefix,omitempty"` // object key prefix followed by partition path, default is `<logstore>/`
+	Days     int    `json:"days"`
+}
+
+// Tracing export spans of pipeline with otlp over http
+type Tracing struct {
+	Enabled     bool              `json:"enabled"`
+	Endpoint    string            `json:"endpoint"` // host:port of collector, default is localhost:4318
+	URLPath     string            `json:"url_path,omitempty"`
+	Insecure    bool              `json:"insecure,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	SampleRatio float64           `json:"sample_ratio,omitempty"` // ratio of sampled batches and files, default is 1
+	ServiceName string            `json:"service_name,omitempty"` // default is sls2oss
+}
+
 type Metric struct {
 	Port int    `json:"port"`
 	Path string `json:"path"`
@@ -57,10 +206,106 @@ type SlsConfig struct {
 	MaxFetchLogGroupCount int      `json:"max_fetch_count"`   // max is 1000
 	InOrder               bool     `json:"in_order"`
 	IncludeMeta           bool     `json:"include_meta"`
+	LagInterval           Duration `json:"lag_interval,omitempty"` // interval of measuring shard lags, default is 30s, negative disables it
+	// Credentials default to static access keys above
+	Credentials *Credentials `json:"credentials,omitempty"`
 }
 
 // todo: validate and set defaults
 func (c *SlsConfig) ValidateAndSetDefaults() error {
+	if c.LagInterval == 0 {
+		c.LagInterval = Duration(30 * time.Second)
+	}
+	return setCredentialsDefaults(&c.Credentials, c.AccessKeyID, c.AccessKeySecret)
+}
+
+const (
+	CredentialsStatic     = "static"
+	CredentialsSTS        = "sts"
+	CredentialsECSRAMRole = "ecs_ram_role"
+	CredentialsOIDC       = "oidc"
+	CredentialsFile       = "file"
+)
+
+// Credentials of sls or oss, temporary credentials are refreshed before
+// they expire, and files are reloaded once changed.
+type Credentials struct {
+	Type string `json:"type,omitempty"` // static/sts/ecs_ram_role/oidc/file, default is static
+	// static keys, also used to sign AssumeRole requests of sts
+	AccessKeyID     string `json:"access_key,omitempty"`
+	AccessKeySecret string `json:"access_key_secret,omitempty"`
+	SecurityToken   string `json:"security_token,omitempty"`
+	// sts and oidc
+	RoleArn         string `json:"role_arn,omitempty"`
+	RoleSessionName string `json:"role_session_name,omitempty"` // default is sls2oss
+	DurationSeconds int    `json:"duration_seconds,omitempty"`  // default is 3600
+	Policy          string `json:"policy,omitempty"`
+	StsEndpoint     string `json:"sts_endpoint,omitempty"` // default is sts.aliyuncs.com
+	// oidc, default to env injected by RRSA of ACK
+	OIDCProviderArn string `json:"oidc_provider_arn,omitempty"` // ALIBABA_CLOUD_OIDC_PROVIDER_ARN
+	OIDCTokenFile   string `json:"oidc_token_file,omitempty"`   // ALIBABA_CLOUD_OIDC_TOKEN_FILE
+	// ecs_ram_role, role name is read from metadata if it's empty
+	RoleName         string `json:"role_name,omitempty"`
+	MetadataEndpoint string `json:"metadata_endpoint,omitempty"` // default is http://100.100.100.200
+	// file of json/yaml with AccessKeyId, AccessKeySecret, SecurityToken and Expiration
+	File string `json:"file,omitempty"`
+	// interval of checking expiration and changes of file, default is 1m
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+// setCredentialsDefaults fill credentials with static keys if it's not set
+func setCredentialsDefaults(c **Credentials, accessKeyID, accessKeySecret string) error {
+	if *c == nil {
+		*c = &Credentials{}
+	}
+	cred := *c
+	if cred.Type == "" {
+		cred.Type = CredentialsStatic
+	}
+	if (cred.Type == CredentialsStatic || cred.Type == CredentialsSTS) && cred.AccessKeyID == "" {
+		cred.AccessKeyID, cred.AccessKeySecret = accessKeyID, accessKeySecret
+	}
+	if cred.RoleSessionName == "" {
+		cred.RoleSessionName = "sls2oss"
+	}
+	if cred.DurationSeconds == 0 {
+		cred.DurationSeconds = 3600
+	}
+	if cred.StsEndpoint == "" {
+		cred.StsEndpoint = "sts.aliyuncs.com"
+	}
+	if cred.MetadataEndpoint == "" {
+		cred.MetadataEndpoint = "http://100.100.100.200"
+	}
+	if cred.RefreshInterval <= 0 {
+		cred.RefreshInterval = Duration(time.Minute)
+	}
+	switch cred.Type {
+	case CredentialsStatic, CredentialsECSRAMRole:
+	case CredentialsSTS:
+		if cred.RoleArn == "" || cred.AccessKeyID == "" {
+			return errors.New("role_arn and access keys are required by sts credentials")
+		}
+	case CredentialsOIDC:
+		if cred.RoleArn == "" {
+			cred.RoleArn = os.Getenv("ALIBABA_CLOUD_ROLE_ARN")
+		}
+		if cred.OIDCProviderArn == "" {
+			cred.OIDCProviderArn = os.Getenv("ALIBABA_CLOUD_OIDC_PROVIDER_ARN")
+		}
+		if cred.OIDCTokenFile == "" {
+			cred.OIDCTokenFile = os.Getenv("ALIBABA_CLOUD_OIDC_TOKEN_FILE")
+		}
+		if cred.RoleArn == "" || cred.OIDCProviderArn == "" || cred.OIDCTokenFile == "" {
+			return errors.New("role_arn, oidc_provider_arn and oidc_token_file are required by oidc credentials")
+		}
+	case CredentialsFile:
+		if cred.File == "" {
+			return errors.New("file is required by file credentials")
+		}
+	default:
+		return fmt.Errorf("unknown credentials type %q", cred.Type)
+	}
 	return nil
 }
 
@@ -78,8 +323,76 @@ type OssConfig struct {
 	ScanInterval      Duration `json:"scan_interval"`
 	TempDir           string   `json:"temp_dir"`
 	SyncOrphanedFiles bool     `json:"sync_orphaned_files"`
+	KeyTemplate       string   `json:"key_template,omitempty"`
+	MaxCardinality    int      `json:"max_cardinality,omitempty"` // max distinct values of each data variable in key template per hour
+	MaxOpenFiles      int      `json:"max_open_files,omitempty"`  // 0 means unlimited
+	Naming            string   `json:"naming,omitempty"`          // random/content_hash/cursor, only affects default key template
+	SkipExisting      bool     `json:"skip_existing,omitempty"`   // skip uploading if object exists with same checksum
+	// Credentials default to static access keys above
+	Credentials *Credentials `json:"credentials,omitempty"`
+	Encryption  *Encryption  `json:"encryption,omitempty"`
+	// Metadata and Tagging of uploaded objects, values are templates of
+	// object variables, eg. {logstore}, {shard}, {records}, {min_time}
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tagging  map[string]string `json:"tagging,omitempty"`
+}
+
+const (
+	EncryptionLocal = "local"
+	EncryptionKMS   = "kms"
+)
+
+// Encryption of uploaded objects. Client side encryption encrypts every
+// object with a random data key by AES-256-GCM, the data key is wrapped by a
+// local master key or KMS and stored in the object header.
+type Encryption struct {
+	ServerSide    string `json:"server_side,omitempty"`     // AES256/KMS, empty disables it
+	KMSKeyID      string `json:"kms_key_id,omitempty"`      // cmk of KMS server side encryption and kms wrapped data keys
+	ClientSide    string `json:"client_side,omitempty"`     // local/kms, empty disables it
+	MasterKey     string `json:"master_key,omitempty"`      // base64 of 32 bytes, for local
+	MasterKeyFile string `json:"master_key_file,omitempty"` // file of base64 master key, for local
+	KMSEndpoint   string `json:"kms_endpoint,omitempty"`    // eg. kms.cn-shenzhen.aliyuncs.com, for kms
 }
 
+func (c *Encryption) ValidateAndSetDefaults() error {
+	switch c.ServerSide {
+	case "", "AES256", "KMS":
+	default:
+		return fmt.Errorf("unknown server side encryption %q", c.ServerSide)
+	}
+	switch c.ClientSide {
+	case "":
+	case EncryptionLocal:
+		if c.MasterKey == "" && c.MasterKeyFile == "" {
+			return errors.New("master_key or master_key_file is required by local client side encryption")
+		}
+	case EncryptionKMS:
+		if c.KMSKeyID == "" || c.KMSEndpoint == "" {
+			return errors.New("kms_key_id and kms_endpoint are required by kms client side encryption")
+		}
+	default:
+		return fmt.Errorf("unknown client side encryption %q", c.ClientSide)
+	}
+	return nil
+}
+
+const (
+	NamingRandom      = "random"
+	NamingContentHash = "content_hash"
+	NamingCursor      = "cursor"
+
+	// DefaultKeyTemplate keep object keys as `topic/<date>/<random>-<unix>`
+	DefaultKeyTemplate = "{topic}/{partition}/{rand}-{unix}"
+	// ContentHashKeyTemplate name objects with content hash, so uploading the
+	// same file twice overwrites the same object. Files are cut by size and
+	// age, replayed records are only deduplicated if they're cut the same way.
+	ContentHashKeyTemplate = "{topic}/{partition}/{logstore}-{shard}-{hash}"
+	// CursorKeyTemplate name objects with the range of sls cursors of their
+	// records, files are only rotated between batches, so replaying the same
+	// batches overwrites the same object.
+	CursorKeyTemplate = "{topic}/{partition}/{logstore}-{shard}-{cursor_begin}-{cursor_end}"
+)
+
 type Duration time.Duration
 
 func (d Duration) MarshalJSON() ([]byte, error) {
@@ -111,6 +424,63 @@ func (c *OssConfig) ValidateAndSetDefaults() error {
 	if c.TempDir == "" {
 		c.TempDir = os.TempDir()
 	}
+	switch c.Naming {
+	case "":
+		c.Naming = NamingRandom
+	case NamingRandom, NamingContentHash, NamingCursor:
+	default:
+		return fmt.Errorf("unknown naming mode %q", c.Naming)
+	}
+	if c.KeyTemplate == "" {
+		c.KeyTemplate = DefaultKeyTemplate
+		switch c.Naming {
+		case NamingContentHash:
+			c.KeyTemplate = ContentHashKeyTemplate
+		case NamingCursor:
+			c.KeyTemplate = CursorKeyTemplate
+		}
+	}
+	if c.MaxCardinality == 0 {
+		c.MaxCardinality = 1000
+	}
+	if c.Encryption == nil {
+		c.Encryption = &Encryption{}
+	}
+	if err := c.Encryption.ValidateAndSetDefaults(); err != nil {
+		return err
+	}
+	if err := validateObjectTags(c.Metadata, c.Tagging); err != nil {
+		return err
+	}
+	return setCredentialsDefaults(&c.Credentials, c.AccessKeyID, c.AccessKeySecret)
+}
+
+// limits of object tagging
+const (
+	maxTags         = 10
+	maxTagKeyLength = 128
+)
+
+func validateObjectTags(metadata, tagging map[string]string) error {
+	for k, v := range metadata {
+		if k == "" || strings.Trim(strings.ToLower(k), "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return fmt.Errorf("invalid metadata key %q, only letters, digits and '-' are allowed", k)
+		}
+		if v == "" {
+			return fmt.Errorf("empty value of metadata %q", k)
+		}
+	}
+	if len(tagging) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed, got %d", maxTags, len(tagging))
+	}
+	for k, v := range tagging {
+		if k == "" || len(k) > maxTagKeyLength {
+			return fmt.Errorf("tag key %q must have 1 to %d characters", k, maxTagKeyLength)
+		}
+		if v == "" {
+			return fmt.Errorf("empty value of tag %q", k)
+		}
+	}
 	return nil
 }
 
@@ -148,8 +518,136 @@ func (c *Config) ValidateAndSetDefaults() error {
 	if c.Logging == nil {
 		c.Logging = &Logging{}
 	}
+	if c.Partition == nil {
+		c.Partition = &Partition{}
+	}
+	if c.Metric == nil {
+		c.Metric = &Metric{}
+	}
+	if c.Admin == nil {
+		c.Admin = &Admin{}
+	}
+	if c.Admin.Enabled && c.Admin.Token == "" {
+		// an unset env var expands to empty token, which must not disable auth
+		return errors.New("admin.token is required if admin api is enabled")
+	}
+	if c.Tracing == nil {
+		c.Tracing = &Tracing{}
+	}
+	if c.Tracing.Endpoint == "" {
+		c.Tracing.Endpoint = "localhost:4318"
+	}
+	if c.Tracing.SampleRatio == 0 {
+		c.Tracing.SampleRatio = 1
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = "sls2oss"
+	}
+	if c.Manifest == nil {
+		c.Manifest = &Manifest{}
+	}
+	if c.Manifest.Grace == 0 {
+		c.Manifest.Grace = Duration(5 * time.Minute)
+	}
+	if c.Manifest.Name == "" {
+		c.Manifest.Name = "_manifest.json"
+	}
+	if c.Manifest.SuccessMarker == "" {
+		c.Manifest.SuccessMarker = "_SUCCESS"
+	}
+	if c.Watermark == nil {
+		c.Watermark = &Watermark{}
+	}
+	if c.Watermark.AllowedLateness == 0 {
+		c.Watermark.AllowedLateness = Duration(5 * time.Minute)
+	}
+	if c.Watermark.LatePrefix == "" {
+		c.Watermark.LatePrefix = "_late"
+	}
+	c.Watermark.LatePrefix = strings.Trim(c.Watermark.LatePrefix, "/")
+	// partitions are directories of objects
+	if c.Manifest.Enabled && !strings.Contains(path.Dir(c.Output.Oss.KeyTemplate), "{partition}") {
+		return errors.New("manifest requires {partition} in directory of output.oss.key_template")
+	}
+	if c.Manifest.Enabled && c.Input.Sls.LagInterval < 0 {
+		// watermarks of caught up shards and shards of the group are checked with lags
+		return errors.New("manifest requires input.sls.lag_interval")
+	}
+	if c.Compaction == nil {
+		c.Compaction = &Compaction{}
+	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = Duration(time.Hour)
+	}
+	if c.Compaction.Lookback == 0 {
+		c.Compaction.Lookback = Duration(48 * time.Hour)
+	}
+	if c.Compaction.MinObjectSize == 0 {
+		c.Compaction.MinObjectSize = 16
+	}
+	if c.Compaction.TargetSize == 0 {
+		c.Compaction.TargetSize = 256
+	}
+	if c.Compaction.OrphanGrace == 0 {
+		c.Compaction.OrphanGrace = Duration(24 * time.Hour)
+	}
+	if c.Compaction.Enabled && !c.Manifest.Enabled {
+		return errors.New("compaction requires manifest")
+	}
+	if c.Retention == nil {
+		c.Retention = &Retention{}
+	}
+	if c.Retention.Interval == 0 {
+		c.Retention.Interval = Duration(time.Hour)
+	}
+	for _, rule := range c.Retention.Rules {
+		if rule.Prefix == "" {
+			if rule.Logstore == "" {
+				return errors.New("retention rule requires logstore or prefix")
+			}
+			rule.Prefix = rule.Logstore + "/"
+		}
+		if rule.Days <= 0 {
+			return fmt.Errorf("retention days of %s must be positive", rule.Prefix)
+		}
+	}
+	if c.Health == nil {
+		c.Health = &Health{}
+	}
+	if c.Health.HeartbeatTimeout == 0 {
+		c.Health.HeartbeatTimeout = Duration(time.Minute)
+	}
+	// idle consumers report progress only when their shards are checked with lags
+	if c.Input.Sls.LagInterval > 0 && c.Health.HeartbeatTimeout <= c.Input.Sls.LagInterval {
+		return errors.New("health.heartbeat_timeout must be longer than input.sls.lag_interval")
+	}
+	if c.Health.UploadFailureTimeout == 0 {
+		c.Health.UploadFailureTimeout = Duration(10 * time.Minute)
+	}
+	if c.Health.MinFreeDisk == 0 {
+		c.Health.MinFreeDisk = 100
+	}
+	if c.DeadLetter != nil && c.DeadLetter.Dir != "" && c.DeadLetter.OssPrefix != "" {
+		return errors.New("only one of dead_letter.dir and dead_letter.oss_prefix can be set")
+	}
 	if c.Worker == 0 {
 		c.Worker = runtime.NumCPU()
 	}
+	switch {
+	case c.WorkerKey == "":
+		c.WorkerKey = "none"
+		if c.Input.Sls.InOrder {
+			c.WorkerKey = "shard"
+		}
+	case c.WorkerKey == "none", c.WorkerKey == "shard", strings.HasPrefix(c.WorkerKey, "field.") && len(c.WorkerKey) > len("field."):
+	default:
+		return fmt.Errorf("invalid worker_key %q", c.WorkerKey)
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = Duration(time.Minute)
+	}
 	return nil
 }
@@ -1,44 +1,188 @@
 package consumer
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
 	"time"
+	"unsafe"
 
 	sls "github.com/aliyun/aliyun-log-go-sdk"
 	consumerLibrary "github.com/aliyun/aliyun-log-go-sdk/consumer"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
 	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/credentials"
+	"github.com/fengxsong/sls2oss/internal/tracing"
+	"github.com/fengxsong/sls2oss/internal/watermark"
 )
 
 type Consumer interface {
 	Run(<-chan struct{}) error
+	// Pause block processing of fetched data until Resume is called,
+	// shards are still held by heartbeats while paused.
+	Pause()
+	Resume()
+	Paused() bool
 }
 
 type slsConsumer struct {
 	config      *consumerLibrary.LogHubConfig
 	logger      log.Logger
 	cw          *consumerLibrary.ConsumerWorker
-	consumeOne  func(map[string]interface{}) error
+	consume     func(*internal.Batch) error
 	includeMeta bool
+	quit        <-chan struct{}
+	// closed when resumed, nil if not paused
+	resumed chan struct{}
+	mu      sync.Mutex
+
+	lagInterval time.Duration
+	lastEvents  map[int]time.Time // latest event time of shards
+	eventMu     sync.Mutex
+	watermarks  *watermark.Tracker
+	credentials *credentials.Provider
+	client      *sls.Client
+	progress    func()
+
+	cursors  map[int]*shardCursor
+	cursorMu sync.Mutex
+}
+
+type Option func(*slsConsumer)
+
+// WithLagInterval set interval of measuring shard lags, 0 disables it
+func WithLagInterval(d time.Duration) Option {
+	return func(c *slsConsumer) {
+		c.lagInterval = d
+	}
+}
+
+// WithWatermark report event-time watermarks of shards to tracker
+func WithWatermark(t *watermark.Tracker) Option {
+	return func(c *slsConsumer) {
+		c.watermarks = t
+	}
+}
+
+// WithCredentials sign requests with credentials of provider instead of
+// static keys of config, refreshed credentials take effect without restarts
+func WithCredentials(p *credentials.Provider) Option {
+	return func(c *slsConsumer) {
+		c.credentials = p
+	}
+}
+
+// WithProgress call fn whenever consumer is seen alive, see reportProgress
+func WithProgress(fn func()) Option {
+	return func(c *slsConsumer) {
+		c.progress = fn
+	}
 }
 
-func New(cfg *consumerLibrary.LogHubConfig, logger log.Logger, includeMeta bool, fn func(map[string]interface{}) error) Consumer {
-	return &slsConsumer{
+func New(cfg *consumerLibrary.LogHubConfig, logger log.Logger, includeMeta bool, fn func(*internal.Batch) error, opts ...Option) Consumer {
+	c := &slsConsumer{
 		config:      cfg,
 		logger:      logger,
-		consumeOne:  fn,
+		consume:     fn,
 		includeMeta: includeMeta,
+		lastEvents:  make(map[int]time.Time),
+		cursors:     make(map[int]*shardCursor),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *slsConsumer) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+		level.Info(c.logger).Log("msg", "paused")
+	}
+}
+
+func (c *slsConsumer) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+		level.Info(c.logger).Log("msg", "resumed")
+	}
+}
+
+func (c *slsConsumer) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed != nil
+}
+
+// waitResumed block until consumer is resumed or quit
+func (c *slsConsumer) waitResumed() {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-c.quit:
 	}
 }
 
 func (c *slsConsumer) Run(quit <-chan struct{}) error {
-	c.cw = consumerLibrary.InitConsumerWorker(*c.config, c.process)
+	c.quit = quit
+	cfg := *c.config
+	// client of our own requests, eg. lags and cursors
+	c.client = &sls.Client{
+		Endpoint:        cfg.Endpoint,
+		AccessKeyID:     cfg.AccessKeyID,
+		AccessKeySecret: cfg.AccessKeySecret,
+		UserAgent:       cfg.ConsumerGroupName + "_" + cfg.ConsumerName,
+	}
+	if c.credentials != nil {
+		// static keys of config are empty for temporary credentials, and
+		// consumer library creates the consumer group without security token
+		cred := c.credentials.Get()
+		cfg.AccessKeyID, cfg.AccessKeySecret = cred.AccessKeyID, cred.AccessKeySecret
+		c.client.ResetAccessKeyToken(cred.AccessKeyID, cred.AccessKeySecret, cred.SecurityToken)
+		if err := createConsumerGroup(c.client, &cfg); err != nil {
+			return err
+		}
+	}
+	c.cw = consumerLibrary.InitConsumerWorker(cfg, c.process)
 	// todo: set inner logger
 	if c.logger != nil {
 		c.cw.Logger = c.logger
 	}
+	if c.credentials != nil {
+		client := workerClient(c.cw)
+		if client == nil {
+			return errors.New("unable to set credentials of consumer worker")
+		}
+		reset := func(cred *credentials.Credentials) {
+			client.ResetAccessKeyToken(cred.AccessKeyID, cred.AccessKeySecret, cred.SecurityToken)
+			c.client.ResetAccessKeyToken(cred.AccessKeyID, cred.AccessKeySecret, cred.SecurityToken)
+		}
+		reset(c.credentials.Get())
+		c.credentials.OnChange(reset)
+	}
 	c.cw.Start()
+	if c.lagInterval > 0 {
+		go c.collectLag(quit)
+	} else if c.progress != nil {
+		// shards are checked with lags, or on their own if lags are disabled
+		go c.watchShards(quit)
+	}
 	<-quit
 	level.Info(c.cw.Logger).Log("msg", "quiting")
 	c.cw.StopAndWait()
@@ -46,27 +190,105 @@ func (c *slsConsumer) Run(quit <-chan struct{}) error {
 }
 
 func (c *slsConsumer) process(shardId int, logGroupList *sls.LogGroupList) string {
+	// shards are fetched only while they're held by heartbeats
+	c.reportProgress()
+	c.waitResumed()
+	ctx, span := tracing.Tracer().Start(context.Background(), "consumer.process")
+	defer span.End()
+	cursor, next := c.batchCursor(shardId, len(logGroupList.LogGroups))
+	b, latest := ToBatch(&internal.Source{
+		Project:    c.config.Project,
+		Logstore:   c.config.Logstore,
+		Shard:      shardId,
+		Cursor:     cursor,
+		NextCursor: next,
+	}, logGroupList, c.includeMeta)
+	b.Ctx = ctx
+	if !latest.IsZero() {
+		c.recordEventTime(shardId, latest)
+	}
+	if c.watermarks != nil {
+		// watermark moves once records are written, not when they're queued
+		b.Done = c.watermarks.Begin(c.config.Logstore, shardId, latest)
+	}
+	span.SetAttributes(
+		attribute.String("sls.logstore", c.config.Logstore),
+		attribute.Int("sls.shard", shardId),
+		attribute.Int("sls.log_groups", len(logGroupList.LogGroups)),
+		attribute.Int("sls.records", len(b.Records)),
+	)
+	// batch is released by consume
+	if err := c.consume(b); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		level.Error(c.cw.Logger).Log("msg", "consume batch", "err", err)
+	}
+	return ""
+}
+
+// ToBatch convert log groups fetched from source into a batch, latest event
+// time of records is returned as well.
+func ToBatch(source *internal.Source, logGroupList *sls.LogGroupList, includeMeta bool) (*internal.Batch, time.Time) {
+	b := internal.NewBatch(source)
+	var latest time.Time
 	for _, lg := range logGroupList.LogGroups {
+		topic := lg.GetCategory()
+		if topic == "" {
+			topic = source.Logstore
+		}
+		var tags []*sls.LogTag
+		if includeMeta {
+			tags = lg.LogTags
+		}
 		for _, log := range lg.Logs {
-			m := make(map[string]interface{})
-			topic := lg.GetCategory()
-			if topic == "" {
-				topic = c.config.Logstore
-			}
-			m[internal.TopicKey] = topic
-			m[internal.TimeKey] = time.Unix(int64(log.GetTime()), 0)
-			if c.includeMeta {
-				for i := range lg.LogTags {
-					m[lg.LogTags[i].GetKey()] = lg.LogTags[i].GetValue()
-				}
-			}
-			for _, content := range log.Contents {
-				m[content.GetKey()] = content.GetValue()
-			}
-			if err := c.consumeOne(m); err != nil {
-				level.Error(c.cw.Logger).Log("msg", "consume msg", "err", err)
+			t := time.Unix(int64(log.GetTime()), int64(getTimeNs(log)))
+			if t.After(latest) {
+				latest = t
 			}
+			b.Records = append(b.Records, internal.Record{
+				Topic:    topic,
+				Time:     t,
+				Tags:     tags,
+				Contents: log.Contents,
+			})
 		}
 	}
-	return ""
+	return b, latest
+}
+
+// createConsumerGroup create consumer group of cfg, it's fine if the group exists
+func createConsumerGroup(client *sls.Client, cfg *consumerLibrary.LogHubConfig) error {
+	heartbeatInterval := cfg.HeartbeatIntervalInSecond
+	if heartbeatInterval == 0 {
+		// default of consumer library
+		heartbeatInterval = 20
+	}
+	err := client.CreateConsumerGroup(cfg.Project, cfg.Logstore, sls.ConsumerGroup{
+		ConsumerGroupName: cfg.ConsumerGroupName,
+		Timeout:           heartbeatInterval * 3,
+		InOrder:           cfg.InOrder,
+	})
+	if serr, ok := err.(*sls.Error); ok && serr.Code == "ConsumerGroupAlreadyExist" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("create consumer group %s: %v", cfg.ConsumerGroupName, err)
+	}
+	return nil
+}
+
+// workerClient return sls client shared by heartbeats and shard workers of
+// cw. Consumer library neither accepts security tokens nor exposes its
+// client, so it's dug out to reset credentials, nil if the layout changes.
+// The library is pinned in go.mod to the version TestWorkerClient verifies.
+func workerClient(cw *consumerLibrary.ConsumerWorker) *sls.Client {
+	v := reflect.ValueOf(cw).Elem().FieldByName("client")
+	if !v.IsValid() || v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil
+	}
+	v = v.Elem().FieldByName("client")
+	if !v.IsValid() || v.Type() != reflect.TypeOf(&sls.Client{}) || v.IsNil() {
+		return nil
+	}
+	return (*sls.Client)(unsafe.Pointer(v.Pointer()))
 }
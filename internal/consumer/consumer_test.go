@@ -0,0 +1,222 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	consumerLibrary "github.com/aliyun/aliyun-log-go-sdk/consumer"
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/credentials"
+	"github.com/fengxsong/sls2oss/internal/tracing"
+)
+
+// fakeSLS answer every request with an empty list and record them
+type fakeSLS struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (f *fakeSLS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("[]"))
+}
+
+func (f *fakeSLS) find(method, path string) *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if r.Method == method && r.URL.Path == path {
+			return r
+		}
+	}
+	return nil
+}
+
+// newFakeSLS serve fake sls, requests to `<project>.<endpoint>` are routed to
+// it as sdk clients use http.DefaultTransport
+func newFakeSLS(t *testing.T) *fakeSLS {
+	f := &fakeSLS{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	addr := srv.Listener.Addr().String()
+	transport := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	return f
+}
+
+func testLogHubConfig() *consumerLibrary.LogHubConfig {
+	return &consumerLibrary.LogHubConfig{
+		Endpoint:          "sls.example.com",
+		AccessKeyID:       "static-id",
+		AccessKeySecret:   "static-secret",
+		Project:           "project",
+		Logstore:          "logstore",
+		ConsumerGroupName: "group",
+		ConsumerName:      "consumer",
+		CursorPosition:    consumerLibrary.BEGIN_CURSOR,
+	}
+}
+
+// TestWorkerClient fails once consumer library changes the layout of its
+// client, which is dug out by reflection to reset credentials.
+// version of consumer library whose layout workerClient is verified against,
+// which is pinned by replace of go.mod
+const consumerLibraryVersion = "v0.1.20"
+
+func TestWorkerClient(t *testing.T) {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path != "github.com/aliyun/aliyun-log-go-sdk" {
+				continue
+			}
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			if dep.Version != consumerLibraryVersion {
+				t.Fatalf("aliyun-log-go-sdk is %s, verify workerClient against it and update consumerLibraryVersion", dep.Version)
+			}
+		}
+	}
+	newFakeSLS(t)
+	cfg := testLogHubConfig()
+	cw := consumerLibrary.InitConsumerWorker(*cfg, func(int, *sls.LogGroupList) string { return "" })
+	client := workerClient(cw)
+	if client == nil {
+		t.Fatal("client of consumer worker not found, layout of consumer library changed")
+	}
+	if client.Endpoint != cfg.Endpoint || client.AccessKeyID != cfg.AccessKeyID || client.AccessKeySecret != cfg.AccessKeySecret {
+		t.Fatalf("unexpected client %s/%s", client.Endpoint, client.AccessKeyID)
+	}
+	client.ResetAccessKeyToken("id", "secret", "token")
+	if again := workerClient(cw); again != client || again.SecurityToken != "token" {
+		t.Fatal("credentials are not reset on the client of consumer worker")
+	}
+}
+
+func TestRunWithCredentials(t *testing.T) {
+	f := newFakeSLS(t)
+	provider, err := credentials.New(&config.Credentials{
+		Type:            config.CredentialsStatic,
+		AccessKeyID:     "sts-id",
+		AccessKeySecret: "sts-secret",
+		SecurityToken:   "sts-token",
+		RefreshInterval: config.Duration(time.Minute),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testLogHubConfig()
+	cfg.AccessKeyID, cfg.AccessKeySecret = "", ""
+	c := New(cfg, log.NewNopLogger(), false, func(*internal.Batch) error { return nil }, WithCredentials(provider))
+	quit := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.Run(quit) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	var r *http.Request
+	for r == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		r = f.find(http.MethodPost, "/logstores/logstore/consumergroups")
+	}
+	close(quit)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		t.Fatal("consumer group is not created")
+	}
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "SLS sts-id:") {
+		t.Errorf("consumer group created with %q, expected keys of provider", auth)
+	}
+	if token := r.Header.Get("x-acs-security-token"); token != "sts-token" {
+		t.Errorf("consumer group created with token %q, expected sts-token", token)
+	}
+}
+
+// spanExporter keep spans after shutdown, which exports spans queued in
+// batcher, while ForceFlush does not
+type spanExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (e spanExporter) Shutdown(context.Context) error { return nil }
+
+func TestProcessSpan(t *testing.T) {
+	logGroups := &sls.LogGroupList{LogGroups: []*sls.LogGroup{{
+		Logs: []*sls.Log{
+			{Time: proto.Uint32(1), Contents: []*sls.LogContent{{Key: proto.String("k"), Value: proto.String("v")}}},
+			{Time: proto.Uint32(2), Contents: []*sls.LogContent{{Key: proto.String("k"), Value: proto.String("v")}}},
+		},
+	}}}
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode codes.Code
+	}{
+		{name: "consumed", expectedCode: codes.Unset},
+		{name: "consume error", err: errors.New("disk full"), expectedCode: codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := spanExporter{tracetest.NewInMemoryExporter()}
+			tp := tracing.NewProvider(exporter, "test", 1)
+			otel.SetTracerProvider(tp)
+
+			var consumed trace.SpanContext
+			c := New(testLogHubConfig(), log.NewNopLogger(), false, func(b *internal.Batch) error {
+				consumed = trace.SpanContextFromContext(b.Ctx)
+				return tt.err
+			})
+			sc := c.(*slsConsumer)
+			sc.cw = &consumerLibrary.ConsumerWorker{Logger: log.NewNopLogger()}
+			sc.process(3, logGroups)
+			if err := tp.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 || spans[0].Name != "consumer.process" {
+				t.Fatalf("unexpected spans %v", spans)
+			}
+			span := spans[0]
+			if !consumed.IsValid() || consumed.SpanID() != span.SpanContext.SpanID() {
+				t.Error("batch is not consumed in context of consumer.process")
+			}
+			if span.Status.Code != tt.expectedCode {
+				t.Errorf("status is %v, expected %v", span.Status.Code, tt.expectedCode)
+			}
+			attrs := make(map[string]int64)
+			for _, kv := range span.Attributes {
+				attrs[string(kv.Key)] = kv.Value.AsInt64()
+			}
+			if attrs["sls.shard"] != 3 || attrs["sls.log_groups"] != 1 || attrs["sls.records"] != 2 {
+				t.Errorf("unexpected attributes %v", span.Attributes)
+			}
+		})
+	}
+}
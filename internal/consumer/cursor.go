@@ -0,0 +1,93 @@
+package consumer
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	consumerLibrary "github.com/aliyun/aliyun-log-go-sdk/consumer"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal"
+)
+
+// shardCursor derive cursors of batches of a shard. Consumer library does not
+// expose cursors, but batches of a shard are processed one by one, and sls
+// cursors are sequence numbers of log groups, so the cursor of a batch is the
+// one of the previous batch plus its log groups.
+type shardCursor struct {
+	next int64     // sequence number of the next log group
+	last time.Time // when the last batch was processed
+}
+
+// batchCursor return cursor of the batch of shard with logGroups and the one
+// following it, empty if they're unknown
+func (c *slsConsumer) batchCursor(shardId, logGroups int) (cursor, next string) {
+	if c.client == nil {
+		return "", ""
+	}
+	c.cursorMu.Lock()
+	sc, ok := c.cursors[shardId]
+	c.cursorMu.Unlock()
+	// a shard idle longer than heartbeat timeout may have been held by other
+	// consumers, and checkpoint of an idle shard is flushed by consumer library
+	if !ok || time.Since(sc.last) >= c.heartbeatTimeout() {
+		seq, err := c.startSequence(shardId)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "get cursor of batch", "shard", shardId, "err", err)
+			c.cursorMu.Lock()
+			delete(c.cursors, shardId)
+			c.cursorMu.Unlock()
+			return "", ""
+		}
+		sc = &shardCursor{next: seq}
+	}
+	c.cursorMu.Lock()
+	defer c.cursorMu.Unlock()
+	cursor = internal.EncodeCursor(sc.next)
+	sc.next += int64(logGroups)
+	sc.last = time.Now()
+	c.cursors[shardId] = sc
+	return cursor, internal.EncodeCursor(sc.next)
+}
+
+// startSequence return sequence number consumer library starts fetching
+// shard from, which is the checkpoint or the configured cursor position
+func (c *slsConsumer) startSequence(shardId int) (int64, error) {
+	checkpoints, err := c.client.GetCheckpoint(c.config.Project, c.config.Logstore, c.config.ConsumerGroupName)
+	if err != nil {
+		return 0, err
+	}
+	cursor := ""
+	for _, cp := range checkpoints {
+		if cp.ShardID == shardId {
+			cursor = cp.CheckPoint
+		}
+	}
+	if cursor == "" {
+		from := "begin"
+		switch c.config.CursorPosition {
+		case consumerLibrary.END_CURSOR:
+			from = "end"
+		case consumerLibrary.SPECIAL_TIMER_CURSOR:
+			from = strconv.FormatInt(c.config.CursorStartTime, 10)
+		}
+		if cursor, err = c.client.GetCursor(c.config.Project, c.config.Logstore, shardId, from); err != nil {
+			return 0, err
+		}
+	}
+	seq, ok := internal.DecodeCursor(cursor)
+	if !ok {
+		return 0, errors.New("invalid cursor " + cursor)
+	}
+	return seq, nil
+}
+
+func (c *slsConsumer) heartbeatTimeout() time.Duration {
+	interval := c.config.HeartbeatIntervalInSecond
+	if interval == 0 {
+		// default of consumer library
+		interval = 20
+	}
+	return time.Duration(interval*3) * time.Second
+}
@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"strconv"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/metrics"
+)
+
+// recordEventTime keep the latest event time consumed from shard
+func (c *slsConsumer) recordEventTime(shard int, t time.Time) {
+	c.eventMu.Lock()
+	defer c.eventMu.Unlock()
+	if t.After(c.lastEvents[shard]) {
+		c.lastEvents[shard] = t
+	}
+}
+
+// collectLag measure lags of shards periodically until quit
+func (c *slsConsumer) collectLag(quit <-chan struct{}) {
+	ticker := time.NewTicker(c.lagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.measureLag(c.client)
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (c *slsConsumer) measureLag(client *sls.Client) {
+	c.eventMu.Lock()
+	for shard, t := range c.lastEvents {
+		metrics.ConsumerLastEventAgeSeconds.WithLabelValues(c.config.Logstore, strconv.Itoa(shard)).Set(time.Since(t).Seconds())
+	}
+	c.eventMu.Unlock()
+
+	// taken before checkpoints, logs received later are not counted in lags
+	now := time.Now()
+	checkpoints, err := client.GetCheckpoint(c.config.Project, c.config.Logstore, c.config.ConsumerGroupName)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "get checkpoints", "err", err)
+		return
+	}
+	c.checkShards(checkpoints)
+	var foreign []int
+	for _, cp := range checkpoints {
+		if cp.Consumer != "" && cp.Consumer != c.config.ConsumerName {
+			foreign = append(foreign, cp.ShardID)
+		}
+		if cp.CheckPoint == "" {
+			continue
+		}
+		end, err := client.GetCursor(c.config.Project, c.config.Logstore, cp.ShardID, "end")
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "get end cursor", "shard", cp.ShardID, "err", err)
+			continue
+		}
+		lag, ok := cursorDelta(cp.CheckPoint, end)
+		if !ok {
+			continue
+		}
+		metrics.ConsumerLagLogGroups.WithLabelValues(c.config.Logstore, strconv.Itoa(cp.ShardID)).Set(float64(lag))
+		// nothing left in a caught up shard, so its watermark moves on with wall clock
+		if lag == 0 && c.watermarks != nil {
+			c.watermarks.Advance(c.config.Logstore, cp.ShardID, now)
+		}
+	}
+	if c.watermarks != nil {
+		c.watermarks.SetForeign(c.config.Logstore, foreign)
+	}
+}
+
+// cursorDelta return number of log groups between two cursors of a shard,
+// sls cursors are base64 encoded sequence numbers.
+func cursorDelta(from, to string) (int64, bool) {
+	f, ok := internal.DecodeCursor(from)
+	if !ok {
+		return 0, false
+	}
+	t, ok := internal.DecodeCursor(to)
+	if !ok {
+		return 0, false
+	}
+	if t < f {
+		return 0, true
+	}
+	return t - f, true
+}
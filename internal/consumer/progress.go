@@ -0,0 +1,56 @@
+package consumer
+
+import (
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/go-kit/kit/log/level"
+)
+
+// reportProgress tell the consumer is alive. Consumer library neither exposes
+// results of heartbeats nor calls process for idle shards, so besides batches,
+// progress is reported by checkShards from checkpoints of the consumer group.
+func (c *slsConsumer) reportProgress() {
+	if c.progress != nil {
+		c.progress()
+	}
+}
+
+// checkShards report progress if checkpoints show the consumer is holding
+// shards, which are assigned by heartbeats and taken away once they stop. A
+// consumer holding nothing while every shard is held by others is a standby,
+// so it's alive as well, a shard held by nobody is left behind otherwise.
+func (c *slsConsumer) checkShards(checkpoints []*sls.ConsumerGroupCheckPoint) {
+	held, free := 0, 0
+	for _, cp := range checkpoints {
+		switch cp.Consumer {
+		case c.config.ConsumerName:
+			held++
+		case "":
+			free++
+		}
+	}
+	if held > 0 || (len(checkpoints) > 0 && free == 0) {
+		c.reportProgress()
+	}
+}
+
+// watchShards check shards every heartbeat interval until quit, it's only
+// needed if lags, which check shards as well, are not measured.
+func (c *slsConsumer) watchShards(quit <-chan struct{}) {
+	ticker := time.NewTicker(c.heartbeatTimeout() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			checkpoints, err := c.client.GetCheckpoint(c.config.Project, c.config.Logstore, c.config.ConsumerGroupName)
+			if err != nil {
+				level.Warn(c.logger).Log("msg", "get checkpoints", "err", err)
+				continue
+			}
+			c.checkShards(checkpoints)
+		case <-quit:
+			return
+		}
+	}
+}
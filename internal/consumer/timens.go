@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"encoding/binary"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+)
+
+// field number of `optional fixed32 Time_ns = 4` in newer sls log.proto
+const timeNsFieldNum = 4
+
+// getTimeNs read the nanosecond part of log time. the vendored sdk has no
+// Time_ns field, so it ends up in XXX_unrecognized when server sends it.
+func getTimeNs(log *sls.Log) uint32 {
+	b := log.XXX_unrecognized
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0
+		}
+		b = b[n:]
+		fieldNum, wireType := tag>>3, tag&0x7
+		switch wireType {
+		case 0: // varint
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return 0
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return 0
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return 0
+			}
+			b = b[n+int(l):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return 0
+			}
+			if fieldNum == timeNsFieldNum {
+				ns := binary.LittleEndian.Uint32(b)
+				if ns >= 1e9 {
+					return 0
+				}
+				return ns
+			}
+			b = b[4:]
+		default:
+			return 0
+		}
+	}
+	return 0
+}
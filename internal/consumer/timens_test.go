@@ -0,0 +1,105 @@
+package consumer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/gogo/protobuf/proto"
+)
+
+func protoUvarint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
+
+func protoTag(field, wireType uint64) []byte {
+	return protoUvarint(field<<3 | wireType)
+}
+
+func protoVarint(field, v uint64) []byte {
+	return append(protoTag(field, 0), protoUvarint(v)...)
+}
+
+func protoFixed32(field uint64, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return append(protoTag(field, 5), b...)
+}
+
+func protoFixed64(field, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return append(protoTag(field, 1), b...)
+}
+
+func protoBytes(field uint64, b []byte) []byte {
+	return append(append(protoTag(field, 2), protoUvarint(uint64(len(b)))...), b...)
+}
+
+func protoJoin(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestGetTimeNs(t *testing.T) {
+	// logs sent by server, unknown fields are kept in XXX_unrecognized
+	tests := []struct {
+		name     string
+		fields   []byte
+		expected uint32
+	}{
+		{name: "without time_ns"},
+		{name: "time_ns", fields: protoFixed32(timeNsFieldNum, 123456789), expected: 123456789},
+		{
+			name: "after other unknown fields",
+			fields: protoJoin(
+				protoVarint(5, 1<<40),
+				protoFixed64(6, 1),
+				protoBytes(7, []byte("abc")),
+				protoFixed32(8, 1),
+				protoFixed32(timeNsFieldNum, 999999999),
+			),
+			expected: 999999999,
+		},
+		{name: "out of range", fields: protoFixed32(timeNsFieldNum, 1e9)},
+		{name: "field 4 of another wire type", fields: protoVarint(timeNsFieldNum, 123)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := proto.Marshal(&sls.Log{
+				Time:     proto.Uint32(1622505600),
+				Contents: []*sls.LogContent{{Key: proto.String("k"), Value: proto.String("v")}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var l sls.Log
+			if err = proto.Unmarshal(append(data, tt.fields...), &l); err != nil {
+				t.Fatal(err)
+			}
+			if got := getTimeNs(&l); got != tt.expected {
+				t.Errorf("got %d, expected %d", got, tt.expected)
+			}
+		})
+	}
+
+	// malformed fields never read out of range
+	malformed := [][]byte{
+		{0x80},
+		protoTag(timeNsFieldNum, 5),
+		append(protoTag(timeNsFieldNum, 5), 1, 2, 3),
+		append(protoTag(6, 1), 1, 2, 3),
+		append(protoTag(7, 2), 10, 'a'),
+		append(protoTag(5, 0), 0x80),
+		protoJoin(protoTag(3, 3), protoFixed32(timeNsFieldNum, 1)),
+	}
+	for _, b := range malformed {
+		if got := getTimeNs(&sls.Log{XXX_unrecognized: b}); got != 0 {
+			t.Errorf("got %d of malformed %x", got, b)
+		}
+	}
+}
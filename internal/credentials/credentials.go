@@ -0,0 +1,197 @@
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const (
+	// temporary credentials are refreshed this long before they expire
+	expiryWindow = 5 * time.Minute
+	// min interval between refreshing attempts triggered by Get
+	retryInterval = 10 * time.Second
+	httpTimeout   = 10 * time.Second
+)
+
+// Credentials is an access key pair with optional security token, which
+// expires at Expiration if it's not zero.
+type Credentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	AccessKeySecret string    `json:"AccessKeySecret"`
+	SecurityToken   string    `json:"SecurityToken,omitempty"`
+	Expiration      time.Time `json:"Expiration,omitempty"`
+}
+
+func (c *Credentials) GetAccessKeyID() string     { return c.AccessKeyID }
+func (c *Credentials) GetAccessKeySecret() string { return c.AccessKeySecret }
+func (c *Credentials) GetSecurityToken() string   { return c.SecurityToken }
+
+func (c *Credentials) equal(o *Credentials) bool {
+	return c.AccessKeyID == o.AccessKeyID && c.AccessKeySecret == o.AccessKeySecret && c.SecurityToken == o.SecurityToken
+}
+
+// expiring report whether c expires within d
+func (c *Credentials) expiring(d time.Duration) bool {
+	return !c.Expiration.IsZero() && time.Now().Add(d).After(c.Expiration)
+}
+
+// fetcher get credentials from source, returning the same pointer means
+// nothing changed
+type fetcher func() (*Credentials, error)
+
+// Provider hold credentials of a source, temporary credentials are refreshed
+// before expiration by Run or lazily by Get.
+type Provider struct {
+	fetch    fetcher
+	client   *http.Client
+	poll     bool // fetch on every tick, for sources changing without expiration
+	interval time.Duration
+	logger   log.Logger
+
+	mu          sync.Mutex
+	current     *Credentials
+	lastAttempt time.Time
+	listeners   []func(*Credentials)
+}
+
+// New create provider of cfg and fetch the initial credentials
+func New(cfg *config.Credentials, logger log.Logger) (*Provider, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	client := &http.Client{Timeout: httpTimeout}
+	p := &Provider{
+		client:   client,
+		interval: time.Duration(cfg.RefreshInterval),
+		logger:   log.With(logger, "credentials", cfg.Type),
+	}
+	switch cfg.Type {
+	case config.CredentialsStatic:
+		c := &Credentials{AccessKeyID: cfg.AccessKeyID, AccessKeySecret: cfg.AccessKeySecret, SecurityToken: cfg.SecurityToken}
+		p.fetch = func() (*Credentials, error) { return c, nil }
+	case config.CredentialsSTS:
+		p.fetch = assumeRole(client, cfg)
+	case config.CredentialsOIDC:
+		p.fetch = assumeRoleWithOIDC(client, cfg)
+	case config.CredentialsECSRAMRole:
+		p.fetch = ecsRAMRole(client, cfg)
+	case config.CredentialsFile:
+		p.fetch = watchFile(cfg.File)
+		p.poll = true
+	default:
+		return nil, fmt.Errorf("unknown credentials type %q", cfg.Type)
+	}
+	c, err := p.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s credentials: %v", cfg.Type, err)
+	}
+	p.current = c
+	return p, nil
+}
+
+// Get return current credentials, refreshing them if they're about to expire
+func (p *Provider) Get() *Credentials {
+	p.mu.Lock()
+	c := p.current
+	due := c.expiring(expiryWindow) && time.Since(p.lastAttempt) >= retryInterval
+	if due {
+		// only one of concurrent callers refreshes
+		p.lastAttempt = time.Now()
+	}
+	p.mu.Unlock()
+	if due {
+		if err := p.refresh(); err != nil {
+			level.Warn(p.logger).Log("msg", "refresh credentials", "err", err)
+		}
+		p.mu.Lock()
+		c = p.current
+		p.mu.Unlock()
+	}
+	return c
+}
+
+// GetCredentials implement oss.CredentialsProvider
+func (p *Provider) GetCredentials() oss.Credentials {
+	return p.Get()
+}
+
+// UpdateToken implement sls.UpdateTokenFunction
+func (p *Provider) UpdateToken() (string, string, string, time.Time, error) {
+	c := p.Get()
+	return c.AccessKeyID, c.AccessKeySecret, c.SecurityToken, c.Expiration, nil
+}
+
+// OnChange call fn with new credentials whenever they change
+func (p *Provider) OnChange(fn func(*Credentials)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listeners = append(p.listeners, fn)
+}
+
+// Run refresh credentials before they expire until quit
+func (p *Provider) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			// refresh once interval ahead of expiry window, so it's done before Get has to
+			due := p.poll || p.current.expiring(expiryWindow+p.interval)
+			p.mu.Unlock()
+			if !due {
+				continue
+			}
+			if err := p.refresh(); err != nil {
+				level.Warn(p.logger).Log("msg", "refresh credentials", "err", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (p *Provider) refresh() error {
+	p.mu.Lock()
+	p.lastAttempt = time.Now()
+	p.mu.Unlock()
+	c, err := p.fetch()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	old := p.current
+	p.current = c
+	listeners := append(([]func(*Credentials))(nil), p.listeners...)
+	p.mu.Unlock()
+	if c == old || c.equal(old) {
+		return nil
+	}
+	level.Info(p.logger).Log("msg", "credentials refreshed", "access_key", c.AccessKeyID, "expiration", c.Expiration)
+	for _, fn := range listeners {
+		fn(c)
+	}
+	return nil
+}
+
+// decode credentials of sts, ecs metadata and files, which share the same fields
+func decode(data []byte) (*Credentials, error) {
+	var c Credentials
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.AccessKeyID == "" || c.AccessKeySecret == "" {
+		return nil, errors.New("missing AccessKeyId or AccessKeySecret")
+	}
+	return &c, nil
+}
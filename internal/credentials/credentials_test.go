@@ -0,0 +1,95 @@
+package credentials
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeFetcher return credentials in order, the last one repeatedly
+type fakeFetcher struct {
+	results []*Credentials
+	err     error
+	calls   int
+}
+
+func (f *fakeFetcher) fetch() (*Credentials, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	c := f.results[0]
+	if len(f.results) > 1 {
+		f.results = f.results[1:]
+	}
+	return c, nil
+}
+
+func newTestProvider(f *fakeFetcher, current *Credentials) *Provider {
+	return &Provider{fetch: f.fetch, interval: time.Minute, logger: log.NewNopLogger(), current: current}
+}
+
+func TestProviderRefresh(t *testing.T) {
+	old := &Credentials{AccessKeyID: "id1", AccessKeySecret: "secret1"}
+	tests := []struct {
+		name            string
+		fetched         *Credentials
+		err             error
+		expectedCurrent string
+		expectedChanges int
+	}{
+		{name: "same pointer", fetched: old, expectedCurrent: "id1"},
+		{name: "equal credentials", fetched: &Credentials{AccessKeyID: "id1", AccessKeySecret: "secret1"}, expectedCurrent: "id1"},
+		{name: "new token", fetched: &Credentials{AccessKeyID: "id1", AccessKeySecret: "secret1", SecurityToken: "token"}, expectedCurrent: "id1", expectedChanges: 1},
+		{name: "new keys", fetched: &Credentials{AccessKeyID: "id2", AccessKeySecret: "secret2"}, expectedCurrent: "id2", expectedChanges: 1},
+		{name: "fetch error", err: errors.New("unavailable"), expectedCurrent: "id1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(&fakeFetcher{results: []*Credentials{tt.fetched}, err: tt.err}, old)
+			var changes []*Credentials
+			p.OnChange(func(c *Credentials) { changes = append(changes, c) })
+			if err := p.refresh(); (err != nil) != (tt.err != nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got := p.Get().AccessKeyID; got != tt.expectedCurrent {
+				t.Errorf("current is %s, expected %s", got, tt.expectedCurrent)
+			}
+			if len(changes) != tt.expectedChanges {
+				t.Errorf("listeners called %d times, expected %d", len(changes), tt.expectedChanges)
+			}
+			if tt.expectedChanges > 0 && changes[0] != tt.fetched {
+				t.Error("listeners called with stale credentials")
+			}
+		})
+	}
+}
+
+func TestProviderGet(t *testing.T) {
+	expiring := &Credentials{AccessKeyID: "id1", AccessKeySecret: "secret1", Expiration: time.Now().Add(time.Minute)}
+	fresh := &Credentials{AccessKeyID: "id2", AccessKeySecret: "secret2", Expiration: time.Now().Add(time.Hour)}
+
+	f := &fakeFetcher{results: []*Credentials{fresh}}
+	p := newTestProvider(f, expiring)
+	if c := p.Get(); c != fresh {
+		t.Fatalf("expiring credentials are not refreshed, got %+v", c)
+	}
+	p.Get()
+	if f.calls != 1 {
+		t.Errorf("fresh credentials are fetched again, %d calls", f.calls)
+	}
+
+	// failed refreshing is retried after retryInterval, the old credentials are kept meanwhile
+	f = &fakeFetcher{err: errors.New("unavailable")}
+	p = newTestProvider(f, expiring)
+	for i := 0; i < 3; i++ {
+		if c := p.Get(); c != expiring {
+			t.Fatalf("unexpected credentials %+v", c)
+		}
+	}
+	if f.calls != 1 {
+		t.Errorf("refreshing is not throttled, %d calls", f.calls)
+	}
+}
@@ -0,0 +1,82 @@
+package credentials
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const (
+	credentialsPath = "/latest/meta-data/ram/security-credentials/"
+	tokenPath       = "/latest/api/token"
+	tokenTTL        = "21600"
+)
+
+// ecsRAMRole get credentials of ram role attached to ecs instance from
+// metadata server, metadata tokens are used if the server supports them
+func ecsRAMRole(client *http.Client, cfg *config.Credentials) fetcher {
+	endpoint := strings.TrimSuffix(cfg.MetadataEndpoint, "/")
+	return func() (*Credentials, error) {
+		token := metadataToken(client, endpoint)
+		role := cfg.RoleName
+		if role == "" {
+			body, err := getMetadata(client, endpoint+credentialsPath, token)
+			if err != nil {
+				return nil, fmt.Errorf("get role name: %v", err)
+			}
+			if role = strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0]); role == "" {
+				return nil, fmt.Errorf("no ram role attached to instance")
+			}
+		}
+		body, err := getMetadata(client, endpoint+credentialsPath+role, token)
+		if err != nil {
+			return nil, fmt.Errorf("get credentials of role %s: %v", role, err)
+		}
+		return decode(body)
+	}
+}
+
+// metadataToken return empty string if tokens are not supported
+func metadataToken(client *http.Client, endpoint string) string {
+	req, err := http.NewRequest(http.MethodPut, endpoint+tokenPath, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-aliyun-ecs-metadata-token-ttl-seconds", tokenTTL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	return string(body)
+}
+
+func getMetadata(client *http.Client, url, token string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-aliyun-ecs-metadata-token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
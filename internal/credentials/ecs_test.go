@@ -0,0 +1,73 @@
+package credentials
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const ecsCredentials = `{"AccessKeyId":"id","AccessKeySecret":"secret","SecurityToken":"token","Expiration":"2030-01-01T00:00:00Z","Code":"Success"}`
+
+func TestECSRAMRole(t *testing.T) {
+	tests := []struct {
+		name          string
+		roleName      string
+		tokens        bool // metadata server supports tokens
+		roles         string
+		status        int
+		expectedError string
+	}{
+		{name: "role from metadata", roles: "role\n", status: http.StatusOK},
+		{name: "role from metadata with token", tokens: true, roles: "role\n", status: http.StatusOK},
+		{name: "role from config", roleName: "role", status: http.StatusOK},
+		{name: "no role attached", roles: "\n", status: http.StatusOK, expectedError: "no ram role attached"},
+		{name: "credentials not found", roleName: "role", status: http.StatusNotFound, expectedError: "status 404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut && r.URL.Path == tokenPath {
+					if !tt.tokens {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					if r.Header.Get("X-aliyun-ecs-metadata-token-ttl-seconds") == "" {
+						t.Error("token requested without ttl")
+					}
+					w.Write([]byte("metadata-token"))
+					return
+				}
+				if token := r.Header.Get("X-aliyun-ecs-metadata-token"); tt.tokens && token != "metadata-token" {
+					t.Errorf("metadata requested with token %q", token)
+				}
+				switch r.URL.Path {
+				case credentialsPath:
+					w.Write([]byte(tt.roles))
+				case credentialsPath + "role":
+					w.WriteHeader(tt.status)
+					w.Write([]byte(ecsCredentials))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			c, err := ecsRAMRole(srv.Client(), &config.Credentials{RoleName: tt.roleName, MetadataEndpoint: srv.URL + "/"})()
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.AccessKeyID != "id" || c.AccessKeySecret != "secret" || c.SecurityToken != "token" || c.Expiration.Year() != 2030 {
+				t.Errorf("unexpected credentials %+v", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// watchFile read credentials from json/yaml file, the file is only read
+// again once its size or modification time changes
+func watchFile(fn string) fetcher {
+	var (
+		mu      sync.Mutex
+		modTime time.Time
+		size    int64
+		last    *Credentials
+	)
+	return func() (*Credentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		info, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil && info.ModTime().Equal(modTime) && info.Size() == size {
+			return last, nil
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, err
+		}
+		c, err := decode(data)
+		if err != nil {
+			return nil, err
+		}
+		modTime, size, last = info.ModTime(), info.Size(), c
+		return c, nil
+	}
+}
@@ -0,0 +1,55 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "credentials.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetch := watchFile(fn)
+	now := time.Now()
+
+	write("AccessKeyId: id1\nAccessKeySecret: secret1\n", now)
+	c1, err := fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1.AccessKeyID != "id1" || c1.AccessKeySecret != "secret1" {
+		t.Fatalf("unexpected credentials %+v", c1)
+	}
+	if c, _ := fetch(); c != c1 {
+		t.Error("unchanged file is read again")
+	}
+
+	// rotated by a sidecar, same size
+	write(`{"AccessKeyId":"id2","AccessKeySecret":"secret2","SecurityToken":"token"}`, now.Add(time.Second))
+	c2, err := fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 == c1 || c2.AccessKeyID != "id2" || c2.SecurityToken != "token" {
+		t.Fatalf("rotated file is not reloaded, got %+v", c2)
+	}
+
+	// half written file is an error, the provider keeps the last credentials
+	write("AccessKeyId: id3\n", now.Add(2*time.Second))
+	if _, err = fetch(); err == nil {
+		t.Error("expected error of missing secret")
+	}
+	os.Remove(fn)
+	if _, err = fetch(); err == nil {
+		t.Error("expected error of missing file")
+	}
+}
@@ -0,0 +1,163 @@
+package credentials
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const stsVersion = "2015-04-01"
+
+type rpcError struct {
+	RequestID string `json:"RequestId"`
+	Code      string `json:"Code"`
+	Message   string `json:"Message"`
+}
+
+type stsResponse struct {
+	Credentials json.RawMessage `json:"Credentials"`
+}
+
+// Call invoke rpc api of version at endpoint signed with credentials of p,
+// eg. KMS, and return the response body.
+func (p *Provider) Call(endpoint, version string, params url.Values) ([]byte, error) {
+	params.Set("Format", "JSON")
+	params.Set("Version", version)
+	params.Set("Timestamp", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	c := p.Get()
+	signParams(params, c.AccessKeyID, c.AccessKeySecret, c.SecurityToken)
+	return call(p.client, endpoint, params)
+}
+
+// assumeRole get credentials of role by AssumeRole, signed with static keys
+func assumeRole(client *http.Client, cfg *config.Credentials) fetcher {
+	return func() (*Credentials, error) {
+		params := stsParams("AssumeRole", cfg)
+		if cfg.Policy != "" {
+			params.Set("Policy", cfg.Policy)
+		}
+		signParams(params, cfg.AccessKeyID, cfg.AccessKeySecret, cfg.SecurityToken)
+		return callSTS(client, cfg.StsEndpoint, params)
+	}
+}
+
+// assumeRoleWithOIDC get credentials of role with oidc token of pod, the
+// token file is read every time since it's rotated by kubelet
+func assumeRoleWithOIDC(client *http.Client, cfg *config.Credentials) fetcher {
+	return func() (*Credentials, error) {
+		token, err := ioutil.ReadFile(cfg.OIDCTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		params := stsParams("AssumeRoleWithOIDC", cfg)
+		params.Set("OIDCProviderArn", cfg.OIDCProviderArn)
+		params.Set("OIDCToken", strings.TrimSpace(string(token)))
+		if cfg.Policy != "" {
+			params.Set("Policy", cfg.Policy)
+		}
+		return callSTS(client, cfg.StsEndpoint, params)
+	}
+}
+
+func stsParams(action string, cfg *config.Credentials) url.Values {
+	params := url.Values{}
+	params.Set("Action", action)
+	params.Set("Format", "JSON")
+	params.Set("Version", stsVersion)
+	params.Set("Timestamp", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	params.Set("RoleArn", cfg.RoleArn)
+	params.Set("RoleSessionName", cfg.RoleSessionName)
+	params.Set("DurationSeconds", strconv.Itoa(cfg.DurationSeconds))
+	return params
+}
+
+func callSTS(client *http.Client, endpoint string, params url.Values) (*Credentials, error) {
+	body, err := call(client, endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	var r stsResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	return decode(r.Credentials)
+}
+
+// call post params to endpoint, https is used if endpoint has no scheme
+func call(client *http.Client, endpoint string, params url.Values) ([]byte, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	resp, err := client.PostForm(strings.TrimSuffix(endpoint, "/")+"/", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var r rpcError
+		if err = json.Unmarshal(body, &r); err != nil {
+			return nil, fmt.Errorf("status %d: %v", resp.StatusCode, err)
+		}
+		return nil, fmt.Errorf("status %d: %s %s, request id %s", resp.StatusCode, r.Code, r.Message, r.RequestID)
+	}
+	return body, nil
+}
+
+// signParams add access key and signature of params
+func signParams(params url.Values, accessKeyID, accessKeySecret, securityToken string) {
+	params.Set("AccessKeyId", accessKeyID)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureVersion", "1.0")
+	params.Set("SignatureNonce", nonce())
+	if securityToken != "" {
+		params.Set("SecurityToken", securityToken)
+	}
+	params.Set("Signature", sign(http.MethodPost, params, accessKeySecret))
+}
+
+// sign params with signature version 1.0 of rpc apis
+func sign(method string, params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, percentEncode(k)+"="+percentEncode(params.Get(k)))
+	}
+	stringToSign := method + "&" + percentEncode("/") + "&" + percentEncode(strings.Join(pairs, "&"))
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func percentEncode(s string) string {
+	s = url.QueryEscape(s)
+	s = strings.Replace(s, "+", "%20", -1)
+	s = strings.Replace(s, "*", "%2A", -1)
+	return strings.Replace(s, "%7E", "~", -1)
+}
+
+func nonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
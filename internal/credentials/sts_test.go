@@ -0,0 +1,128 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const stsCredentials = `{"RequestId":"req","Credentials":{"AccessKeyId":"STS.id","AccessKeySecret":"secret","SecurityToken":"token","Expiration":"2030-01-01T00:00:00Z"}}`
+
+// newFakeSTS serve sts, params of the last request are sent to params
+func newFakeSTS(t *testing.T, status int, body string) (*httptest.Server, *url.Values) {
+	var params url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		params = r.PostForm
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &params
+}
+
+func stsConfig(endpoint string) *config.Credentials {
+	return &config.Credentials{
+		AccessKeyID:     "id",
+		AccessKeySecret: "secret",
+		RoleArn:         "acs:ram::1:role/archiver",
+		RoleSessionName: "sls2oss",
+		DurationSeconds: 3600,
+		StsEndpoint:     endpoint,
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	srv, params := newFakeSTS(t, http.StatusOK, stsCredentials)
+	cfg := stsConfig(srv.URL)
+	cfg.Policy = `{"Version":"1"}`
+
+	c, err := assumeRole(srv.Client(), cfg)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccessKeyID != "STS.id" || c.SecurityToken != "token" || c.Expiration.Year() != 2030 {
+		t.Errorf("unexpected credentials %+v", c)
+	}
+	p := *params
+	for k, v := range map[string]string{
+		"Action":          "AssumeRole",
+		"RoleArn":         cfg.RoleArn,
+		"RoleSessionName": "sls2oss",
+		"DurationSeconds": "3600",
+		"Policy":          cfg.Policy,
+		"AccessKeyId":     "id",
+	} {
+		if got := p.Get(k); got != v {
+			t.Errorf("%s is %q, expected %q", k, got, v)
+		}
+	}
+	if _, ok := p["SecurityToken"]; ok {
+		t.Error("unexpected SecurityToken of static keys")
+	}
+	signature := p.Get("Signature")
+	p.Del("Signature")
+	if expected := sign(http.MethodPost, p, "secret"); signature != expected {
+		t.Errorf("signature is %q, expected %q", signature, expected)
+	}
+}
+
+func TestAssumeRoleWithOIDC(t *testing.T) {
+	srv, params := newFakeSTS(t, http.StatusOK, stsCredentials)
+	cfg := stsConfig(srv.URL)
+	cfg.AccessKeyID, cfg.AccessKeySecret = "", ""
+	cfg.OIDCProviderArn = "acs:ram::1:oidc-provider/ack"
+	cfg.OIDCTokenFile = filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(cfg.OIDCTokenFile, []byte("oidc-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := assumeRoleWithOIDC(srv.Client(), cfg)(); err != nil {
+		t.Fatal(err)
+	}
+	p := *params
+	if p.Get("Action") != "AssumeRoleWithOIDC" || p.Get("OIDCToken") != "oidc-token" || p.Get("OIDCProviderArn") != cfg.OIDCProviderArn {
+		t.Errorf("unexpected params %v", p)
+	}
+	if _, ok := p["Signature"]; ok {
+		t.Error("AssumeRoleWithOIDC must not be signed")
+	}
+}
+
+func TestAssumeRoleError(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		expectedError string
+	}{
+		{
+			name:          "rpc error",
+			status:        http.StatusForbidden,
+			body:          `{"RequestId":"req","Code":"NoPermission","Message":"denied"}`,
+			expectedError: "status 403: NoPermission denied, request id req",
+		},
+		{name: "not json", status: http.StatusBadGateway, body: "bad gateway", expectedError: "status 502"},
+		{name: "missing keys", status: http.StatusOK, body: `{"Credentials":{}}`, expectedError: "missing AccessKeyId"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newFakeSTS(t, tt.status, tt.body)
+			_, err := assumeRole(srv.Client(), stsConfig(srv.URL))()
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Fatalf("expected error %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
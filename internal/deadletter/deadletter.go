@@ -0,0 +1,192 @@
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/vjeantet/jodaTime"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/metrics"
+)
+
+// stages of pipeline where records fail
+const (
+	StageValidate = "validate"
+	StageEncode   = "encode"
+	StageWrite    = "write"
+)
+
+const (
+	extension  = ".ndjson"
+	dateFormat = "yyyy/MM/dd/HH"
+)
+
+// Entry is a record failed to be processed, record is the original fields
+// before filters. Shard and cursor of the batch locate it in sls, pulling
+// logs of shard from cursor returns the record within the first batch.
+type Entry struct {
+	FailedAt time.Time              `json:"failed_at"`
+	Stage    string                 `json:"stage"`
+	Error    string                 `json:"error"`
+	Project  string                 `json:"project,omitempty"`
+	Logstore string                 `json:"logstore,omitempty"`
+	Shard    int                    `json:"shard"`
+	Cursor   string                 `json:"cursor,omitempty"`
+	Record   map[string]interface{} `json:"record"`
+}
+
+func NewEntry(src *internal.Source, r *internal.Record, stage string, err error) *Entry {
+	e := &Entry{
+		FailedAt: time.Now(),
+		Stage:    stage,
+		Error:    err.Error(),
+		Record:   make(map[string]interface{}),
+	}
+	if src != nil {
+		e.Project, e.Logstore, e.Shard, e.Cursor = src.Project, src.Logstore, src.Shard, src.Cursor
+	}
+	r.Fields(e.Record)
+	return e
+}
+
+// ToRecord rebuild record from entry for replaying
+func (e *Entry) ToRecord() (*internal.Record, error) {
+	r := &internal.Record{}
+	for k, v := range e.Record {
+		switch k {
+		case internal.TopicKey:
+			r.Topic, _ = v.(string)
+		case internal.TimeKey:
+			s, _ := v.(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of dead letter: %v", internal.TimeKey, err)
+			}
+			r.Time = t
+		default:
+			key, value := k, fmt.Sprint(v)
+			if s, ok := v.(string); ok {
+				value = s
+			}
+			r.Contents = append(r.Contents, &sls.LogContent{Key: &key, Value: &value})
+		}
+	}
+	return r, nil
+}
+
+func (e *Entry) Source() *internal.Source {
+	return &internal.Source{Project: e.Project, Logstore: e.Logstore, Shard: e.Shard, Cursor: e.Cursor}
+}
+
+// Sink store dead letters
+type Sink interface {
+	Put(*Entry) error
+}
+
+// Put store entry and count it, errors are returned to be logged by caller
+func Put(s Sink, e *Entry) error {
+	metrics.PipelineDeadLetterTotal.WithLabelValues(e.Logstore, e.Stage).Inc()
+	return s.Put(e)
+}
+
+// Path return relative path of entry, grouped by logstore and hour of failure
+func Path(e *Entry) string {
+	logstore := e.Logstore
+	if logstore == "" {
+		logstore = "_unknown"
+	}
+	return filepath.Join(logstore, jodaTime.Format(dateFormat, e.FailedAt))
+}
+
+type ossSink struct {
+	prefix  string
+	writeTo func(path string, data []byte) (int, error)
+}
+
+// NewOssSink write dead letters under prefix of bucket through fn, which is
+// usually OssWriter.WriteTo, so they are rotated and uploaded as other objects.
+func NewOssSink(prefix string, fn func(path string, data []byte) (int, error)) Sink {
+	return &ossSink{prefix: strings.Trim(prefix, "/"), writeTo: fn}
+}
+
+func (s *ossSink) Put(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = s.writeTo(filepath.Join(s.prefix, Path(e), "{rand}-{unix}"+extension), b)
+	return err
+}
+
+type localSink struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewLocalSink append dead letters into files of local dir
+func NewLocalSink(dir string) (Sink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localSink{dir: dir}, nil
+}
+
+func (s *localSink) Put(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	fn := filepath.Join(s.dir, Path(e)+extension)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Decode read entries from r, which may be gzip compressed
+func Decode(r io.Reader, fn func(*Entry) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	dec := json.NewDecoder(br)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/credentials"
+)
+
+// Algorithm of encrypted objects, also set as object metadata
+const Algorithm = "AES-256-GCM"
+
+const (
+	// header: magic, version, len of wrapper name, name, len of wrapped key,
+	// wrapped key and nonce prefix. Chunks follow, each with a uint32 length
+	// whose highest bit marks the final chunk.
+	magic      = "S2OE"
+	version    = 1
+	keySize    = 32
+	nonceSize  = 12
+	chunkSize  = 64 * 1024
+	finalFlag  = 1 << 31
+	kmsVersion = "2016-01-20"
+)
+
+var (
+	errTruncated = errors.New("encrypted object is truncated")
+	errTrailing  = errors.New("unexpected data after the final chunk of encrypted object")
+)
+
+// KeyWrapper generate data keys and unwrap them
+type KeyWrapper interface {
+	// Name is stored in object header, so the wrapper can be checked on decryption
+	Name() string
+	// DataKey return a new data key and its wrapped form
+	DataKey() (plain, wrapped []byte, err error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// Cipher encrypt objects with data keys of wrapper
+type Cipher struct {
+	keys KeyWrapper
+}
+
+// New return nil if client side encryption is disabled, provider signs kms requests
+func New(cfg *config.Encryption, provider *credentials.Provider) (*Cipher, error) {
+	switch cfg.ClientSide {
+	case "":
+		return nil, nil
+	case config.EncryptionLocal:
+		key := cfg.MasterKey
+		if cfg.MasterKeyFile != "" {
+			data, err := ioutil.ReadFile(cfg.MasterKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			key = strings.TrimSpace(string(data))
+		}
+		w, err := NewLocal(key)
+		if err != nil {
+			return nil, err
+		}
+		return &Cipher{keys: w}, nil
+	case config.EncryptionKMS:
+		return &Cipher{keys: &kmsWrapper{provider: provider, endpoint: cfg.KMSEndpoint, keyID: cfg.KMSKeyID}}, nil
+	default:
+		return nil, fmt.Errorf("unknown client side encryption %q", cfg.ClientSide)
+	}
+}
+
+// NewWriter return writer encrypting into dst with a new data key, Close
+// must be called to write the final chunk.
+func (c *Cipher) NewWriter(dst io.Writer) (io.WriteCloser, error) {
+	plain, wrapped, err := c.keys.DataKey()
+	if err != nil {
+		return nil, fmt.Errorf("generate data key: %v", err)
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	name := c.keys.Name()
+	var header bytes.Buffer
+	header.WriteString(magic)
+	header.WriteByte(version)
+	header.WriteByte(byte(len(name)))
+	header.WriteString(name)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	header.Write(nonce)
+	if _, err = dst.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return &writer{dst: dst, aead: aead, nonce: nonce, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// NewReader return reader decrypting r, which must start with the header
+func (c *Cipher) NewReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	prefix := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, errTruncated
+	}
+	if string(prefix[:len(magic)]) != magic || prefix[len(magic)] != version {
+		return nil, errors.New("unknown encryption header")
+	}
+	name := make([]byte, prefix[len(magic)+1])
+	var n uint16
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, errTruncated
+	}
+	if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+		return nil, errTruncated
+	}
+	wrapped := make([]byte, n)
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(br, wrapped); err != nil {
+		return nil, errTruncated
+	}
+	if _, err := io.ReadFull(br, nonce); err != nil {
+		return nil, errTruncated
+	}
+	if string(name) != c.keys.Name() {
+		return nil, fmt.Errorf("data key is wrapped by %s, not %s", name, c.keys.Name())
+	}
+	plain, err := c.keys.Unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %v", err)
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{src: br, aead: aead, nonce: nonce}, nil
+}
+
+// IsEncrypted report whether content starting with prefix is encrypted
+func IsEncrypted(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(magic))
+}
+
+// Open return r decrypted by c if it's encrypted, an error is returned if
+// it's encrypted but c is nil.
+func Open(c *Cipher, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	prefix, _ := br.Peek(len(magic))
+	if !IsEncrypted(prefix) {
+		return br, nil
+	}
+	if c == nil {
+		return nil, errors.New("object is encrypted, but client side encryption is not configured")
+	}
+	return c.NewReader(br)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce xor counter into the last 8 bytes of nonce prefix
+func chunkNonce(prefix []byte, counter uint64) []byte {
+	nonce := append([]byte(nil), prefix...)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	for i := range c {
+		nonce[nonceSize-8+i] ^= c[i]
+	}
+	return nonce
+}
+
+// chunkAD authenticate whether chunk is the final one, so truncation is detected
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type writer struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// keep a full chunk buffered, the final chunk is only known on Close
+		if len(w.buf) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (w *writer) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.nonce, w.counter), w.buf, chunkAD(final))
+	w.counter++
+	w.buf = w.buf[:0]
+	length := uint32(len(sealed))
+	if final {
+		length |= finalFlag
+	}
+	if err := binary.Write(w.dst, binary.BigEndian, length); err != nil {
+		return err
+	}
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+type reader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) open() error {
+	var length uint32
+	if err := binary.Read(r.src, binary.BigEndian, &length); err != nil {
+		return errTruncated
+	}
+	final := length&finalFlag != 0
+	length &^= finalFlag
+	if length > chunkSize+uint32(r.aead.Overhead()) {
+		return errors.New("invalid encrypted chunk")
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		return errTruncated
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.nonce, r.counter), sealed, chunkAD(final))
+	if err != nil {
+		return fmt.Errorf("decrypt chunk %d: %v", r.counter, err)
+	}
+	if final {
+		// nothing is appended to an object after its final chunk
+		var b [1]byte
+		if _, err = io.ReadFull(r.src, b[:]); err != io.EOF {
+			if err == nil {
+				err = errTrailing
+			}
+			return err
+		}
+	}
+	r.counter++
+	r.buf = plain
+	r.done = final
+	return nil
+}
+
+// localWrapper wrap data keys with a master key by AES-GCM
+type localWrapper struct {
+	aead cipher.AEAD
+	name string
+}
+
+// NewLocal create wrapper with base64 encoded master key of 32 bytes
+func NewLocal(masterKey string) (KeyWrapper, error) {
+	key, err := base64.StdEncoding.DecodeString(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %v", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", keySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	// fingerprint tells which master key wraps an object without revealing it
+	sum := sha256.Sum256(key)
+	return &localWrapper{aead: aead, name: config.EncryptionLocal + ":" + hex.EncodeToString(sum[:4])}, nil
+}
+
+func (w *localWrapper) Name() string { return w.name }
+
+func (w *localWrapper) DataKey() ([]byte, []byte, error) {
+	plain := make([]byte, keySize+nonceSize)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, nil, err
+	}
+	nonce := plain[keySize:]
+	plain = plain[:keySize]
+	return plain, w.aead.Seal(append([]byte(nil), nonce...), nonce, plain, nil), nil
+}
+
+func (w *localWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return w.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], nil)
+}
+
+// kmsWrapper generate data keys by GenerateDataKey of KMS, wrapped keys are
+// ciphertext blobs which name the cmk themselves
+type kmsWrapper struct {
+	provider *credentials.Provider
+	endpoint string
+	keyID    string
+}
+
+func (w *kmsWrapper) Name() string { return config.EncryptionKMS }
+
+func (w *kmsWrapper) DataKey() ([]byte, []byte, error) {
+	params := url.Values{}
+	params.Set("Action", "GenerateDataKey")
+	params.Set("KeyId", w.keyID)
+	params.Set("KeySpec", "AES_256")
+	var resp struct {
+		Plaintext      string `json:"Plaintext"`
+		CiphertextBlob string `json:"CiphertextBlob"`
+	}
+	if err := w.call(params, &resp); err != nil {
+		return nil, nil, err
+	}
+	plain, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plain, []byte(resp.CiphertextBlob), nil
+}
+
+func (w *kmsWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	params := url.Values{}
+	params.Set("Action", "Decrypt")
+	params.Set("CiphertextBlob", string(wrapped))
+	var resp struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := w.call(params, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+func (w *kmsWrapper) call(params url.Values, v interface{}) error {
+	body, err := w.provider.Call(w.endpoint, kmsVersion, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
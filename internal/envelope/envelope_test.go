@@ -0,0 +1,184 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func newTestCipher(t *testing.T, seed byte) *Cipher {
+	w, err := NewLocal(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{seed}, keySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Cipher{keys: w}
+}
+
+func encrypt(t *testing.T, c *Cipher, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(c *Cipher, data []byte) ([]byte, error) {
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// split encrypted data into header and chunks with their length prefixes
+func split(t *testing.T, c *Cipher, data []byte) ([]byte, [][]byte) {
+	name := c.keys.Name()
+	wrappedAt := len(magic) + 2 + len(name)
+	wrapped := int(binary.BigEndian.Uint16(data[wrappedAt:]))
+	rest := data[wrappedAt+2+wrapped+nonceSize:]
+	header := data[:len(data)-len(rest)]
+	var chunks [][]byte
+	for len(rest) > 0 {
+		n := int(binary.BigEndian.Uint32(rest)&^finalFlag) + 4
+		if n > len(rest) {
+			t.Fatalf("chunk of %d bytes, %d left", n, len(rest))
+		}
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	return header, chunks
+}
+
+func join(header []byte, chunks ...[]byte) []byte {
+	data := append([]byte(nil), header...)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newTestCipher(t, 1)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		data := encrypt(t, c, plain)
+		// full chunks are kept until the next write, an empty final chunk is
+		// only written for empty content
+		expected := (size + chunkSize - 1) / chunkSize
+		if expected == 0 {
+			expected = 1
+		}
+		if _, chunks := split(t, c, data); len(chunks) != expected {
+			t.Errorf("%d bytes are sealed into %d chunks, expected %d", size, len(chunks), expected)
+		}
+		got, err := decrypt(c, data)
+		if err != nil {
+			t.Fatalf("decrypt %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("round trip of %d bytes got %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	c := newTestCipher(t, 1)
+	plain := make([]byte, 2*chunkSize+10)
+	rand.Read(plain)
+	data := encrypt(t, c, plain)
+	header, chunks := split(t, c, data)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	withFlag := func(chunk []byte, final bool) []byte {
+		chunk = append([]byte(nil), chunk...)
+		length := binary.BigEndian.Uint32(chunk) &^ finalFlag
+		if final {
+			length |= finalFlag
+		}
+		binary.BigEndian.PutUint32(chunk, length)
+		return chunk
+	}
+	tests := []struct {
+		name          string
+		data          []byte
+		expectedError string
+	}{
+		{name: "truncated final chunk", data: data[:len(data)-1], expectedError: errTruncated.Error()},
+		{name: "missing final chunk", data: join(header, chunks[0], chunks[1]), expectedError: errTruncated.Error()},
+		{name: "truncated header", data: header[:len(header)-1], expectedError: errTruncated.Error()},
+		{name: "reordered chunks", data: join(header, chunks[1], chunks[0], chunks[2]), expectedError: "decrypt chunk 0"},
+		{name: "final flag set early", data: join(header, withFlag(chunks[0], true)), expectedError: "decrypt chunk 0"},
+		{name: "final flag cleared", data: join(header, chunks[0], chunks[1], withFlag(chunks[2], false)), expectedError: "decrypt chunk 2"},
+		{name: "trailing bytes", data: join(data, []byte{0}), expectedError: errTrailing.Error()},
+		{name: "appended chunk", data: join(data, chunks[2]), expectedError: errTrailing.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(c, tt.data); err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("expected error %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestWrongMasterKey(t *testing.T) {
+	data := encrypt(t, newTestCipher(t, 1), []byte("records\n"))
+	other := newTestCipher(t, 2)
+	_, err := decrypt(other, data)
+	if err == nil {
+		t.Fatal("decrypted with another master key")
+	}
+	wrapper := newTestCipher(t, 1).keys.Name()
+	if !strings.Contains(err.Error(), wrapper) || !strings.Contains(err.Error(), other.keys.Name()) {
+		t.Errorf("error %q does not name fingerprints %s and %s", err, wrapper, other.keys.Name())
+	}
+}
+
+func TestOpen(t *testing.T) {
+	c := newTestCipher(t, 1)
+	encrypted := encrypt(t, c, []byte("records\n"))
+	tests := []struct {
+		name          string
+		cipher        *Cipher
+		data          []byte
+		expected      string
+		expectedError string
+	}{
+		{name: "plaintext", cipher: c, data: []byte("records\n"), expected: "records\n"},
+		{name: "plaintext without cipher", data: []byte("records\n"), expected: "records\n"},
+		{name: "empty", cipher: c, data: nil, expected: ""},
+		{name: "shorter than magic", cipher: c, data: []byte("S2O"), expected: "S2O"},
+		{name: "encrypted", cipher: c, data: encrypted, expected: "records\n"},
+		{name: "encrypted without cipher", data: encrypted, expectedError: "client side encryption is not configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Open(tt.cipher, bytes.NewReader(tt.data))
+			if err == nil {
+				var got []byte
+				if got, err = ioutil.ReadAll(r); err == nil && string(got) != tt.expected {
+					t.Errorf("got %q, expected %q", got, tt.expected)
+				}
+			}
+			if tt.expectedError == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tt.expectedError)) {
+				t.Errorf("expected error %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
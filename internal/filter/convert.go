@@ -0,0 +1,176 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const (
+	typeString    = "string"
+	typeInt       = "int"
+	typeFloat     = "float"
+	typeBool      = "bool"
+	typeTimestamp = "timestamp"
+	typeDuration  = "duration"
+
+	onFailureKeep = "keep"
+	onFailureNull = "null"
+	onFailureDrop = "drop"
+)
+
+type converter func(string) (interface{}, error)
+
+// NewConvertFilter coerce string values into typed values, so they are
+// encoded as numbers/booleans instead of strings.
+func NewConvertFilter(cfg *config.ConvertFilter) (FilterFunc, error) {
+	onFailure := strings.ToLower(cfg.OnFailure)
+	switch onFailure {
+	case "":
+		onFailure = onFailureKeep
+	case onFailureKeep, onFailureNull, onFailureDrop:
+	default:
+		return nil, fmt.Errorf("convert filter: unknown on_failure %q", cfg.OnFailure)
+	}
+	converters := make(map[string]converter, len(cfg.Fields))
+	for _, f := range cfg.Fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("convert filter: field name must not been null")
+		}
+		c, err := newConverter(f)
+		if err != nil {
+			return nil, err
+		}
+		converters[f.Name] = c
+	}
+	return func(msg map[string]interface{}) map[string]interface{} {
+		for k, v := range msg {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			c, ok := converters[k]
+			if !ok {
+				if cfg.Infer && k != internal.TopicKey {
+					msg[k] = infer(s)
+				}
+				continue
+			}
+			value, err := c(s)
+			if err == nil {
+				msg[k] = value
+				continue
+			}
+			switch onFailure {
+			case onFailureNull:
+				msg[k] = nil
+			case onFailureDrop:
+				return nil
+			}
+		}
+		return msg
+	}, nil
+}
+
+func newConverter(f *config.FieldConversion) (converter, error) {
+	switch strings.ToLower(f.Type) {
+	case typeString:
+		return func(s string) (interface{}, error) { return s, nil }, nil
+	case typeInt:
+		return func(s string) (interface{}, error) { return strconv.ParseInt(strings.TrimSpace(s), 10, 64) }, nil
+	case typeFloat:
+		return func(s string) (interface{}, error) { return strconv.ParseFloat(strings.TrimSpace(s), 64) }, nil
+	case typeBool:
+		return func(s string) (interface{}, error) { return strconv.ParseBool(strings.TrimSpace(s)) }, nil
+	case typeDuration:
+		// encoded as seconds
+		return func(s string) (interface{}, error) {
+			d, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			return d.Seconds(), nil
+		}, nil
+	case typeTimestamp:
+		layout := f.Layout
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		loc := time.UTC
+		if f.Timezone != "" {
+			var err error
+			if loc, err = time.LoadLocation(f.Timezone); err != nil {
+				return nil, fmt.Errorf("convert filter: timezone of field %q: %v", f.Name, err)
+			}
+		}
+		return func(s string) (interface{}, error) { return parseTime(s, layout, loc) }, nil
+	default:
+		return nil, fmt.Errorf("convert filter: unknown type %q of field %q", f.Type, f.Name)
+	}
+}
+
+var (
+	// numbers as written in json, so ids like `007` or `+86` are kept as strings
+	canonicalInt   = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+	canonicalFloat = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+)
+
+// infer try int, float and bool in order, fallback to the original string.
+func infer(s string) interface{} {
+	if canonicalInt.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+		// out of int64, a float loses precision
+		return s
+	}
+	if canonicalFloat.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+		return s
+	}
+	switch s {
+	case "true", "TRUE", "True":
+		return true
+	case "false", "FALSE", "False":
+		return false
+	}
+	return s
+}
+
+// parseTime parse s with a go time layout, or one of unix/unix_ms/unix_us/unix_ns
+// for numeric epoch timestamps.
+func parseTime(s, layout string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch layout {
+	case "unix", "unix_ms", "unix_us", "unix_ns":
+		if layout == "unix" && strings.Contains(s, ".") {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			sec := int64(f)
+			return time.Unix(sec, int64((f-float64(sec))*1e9)).In(loc), nil
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch layout {
+		case "unix_ms":
+			return time.Unix(0, i*int64(time.Millisecond)).In(loc), nil
+		case "unix_us":
+			return time.Unix(0, i*int64(time.Microsecond)).In(loc), nil
+		case "unix_ns":
+			return time.Unix(0, i).In(loc), nil
+		}
+		return time.Unix(i, 0).In(loc), nil
+	}
+	return time.ParseInLocation(layout, s, loc)
+}
@@ -0,0 +1,214 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+func TestInfer(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected interface{}
+	}{
+		{value: "200", expected: int64(200)},
+		{value: "-1", expected: int64(-1)},
+		{value: "0", expected: int64(0)},
+		{value: "007", expected: "007"},
+		{value: "+86", expected: "+86"},
+		{value: "92233720368547758070", expected: "92233720368547758070"},
+		{value: "0.123", expected: 0.123},
+		{value: "-1.5e3", expected: -1500.0},
+		{value: ".5", expected: ".5"},
+		{value: "1.", expected: "1."},
+		{value: "1e999", expected: "1e999"},
+		{value: "true", expected: true},
+		{value: "FALSE", expected: false},
+		{value: "yes", expected: "yes"},
+		{value: " 1", expected: " 1"},
+		{value: "", expected: ""},
+	}
+	for _, tt := range tests {
+		if got := infer(tt.value); got != tt.expected {
+			t.Errorf("infer %q got %#v, expected %#v", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestConverter(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name     string
+		field    config.FieldConversion
+		value    string
+		expected interface{}
+		failure  bool
+	}{
+		{name: "string", field: config.FieldConversion{Type: "string"}, value: "007", expected: "007"},
+		{name: "int", field: config.FieldConversion{Type: "INT"}, value: " 007 ", expected: int64(7)},
+		{name: "invalid int", field: config.FieldConversion{Type: "int"}, value: "1.5", failure: true},
+		{name: "float", field: config.FieldConversion{Type: "float"}, value: "0.5", expected: 0.5},
+		{name: "invalid float", field: config.FieldConversion{Type: "float"}, value: "x", failure: true},
+		{name: "bool", field: config.FieldConversion{Type: "bool"}, value: "1", expected: true},
+		{name: "invalid bool", field: config.FieldConversion{Type: "bool"}, value: "yes", failure: true},
+		{name: "duration", field: config.FieldConversion{Type: "duration"}, value: "1m30s", expected: 90.0},
+		{name: "invalid duration", field: config.FieldConversion{Type: "duration"}, value: "90", failure: true},
+		{
+			name:     "timestamp",
+			field:    config.FieldConversion{Type: "timestamp"},
+			value:    "2021-06-01T08:00:00.123+08:00",
+			expected: time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+		},
+		{
+			name:     "timestamp without zone in utc",
+			field:    config.FieldConversion{Type: "timestamp", Layout: "2006-01-02 15:04:05"},
+			value:    "2021-06-01 08:00:00",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "timestamp without zone in timezone",
+			field:    config.FieldConversion{Type: "timestamp", Layout: "2006-01-02 15:04:05", Timezone: "Asia/Shanghai"},
+			value:    "2021-06-01 08:00:00",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 0, shanghai),
+		},
+		{
+			name:     "timestamp with zone ignores timezone",
+			field:    config.FieldConversion{Type: "timestamp", Layout: "02/Jan/2006:15:04:05 -0700", Timezone: "Asia/Shanghai"},
+			value:    "01/Jun/2021:08:00:00 +0000",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "unix",
+			field:    config.FieldConversion{Type: "timestamp", Layout: "unix"},
+			value:    "1622534400.5",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 5e8, time.UTC),
+		},
+		{
+			name:     "unix_ms",
+			field:    config.FieldConversion{Type: "timestamp", Layout: "unix_ms", Timezone: "Asia/Shanghai"},
+			value:    "1622534400123",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 123e6, time.UTC),
+		},
+		{name: "invalid timestamp", field: config.FieldConversion{Type: "timestamp"}, value: "2021-06-01", failure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := tt.field
+			field.Name = "f"
+			c, err := newConverter(&field)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c(tt.value)
+			if tt.failure {
+				if err == nil {
+					t.Errorf("%q is converted to %#v", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ts, ok := got.(time.Time); ok {
+				if !ts.Equal(tt.expected.(time.Time)) {
+					t.Errorf("got %v, expected %v", ts, tt.expected)
+				}
+				return
+			}
+			if got != tt.expected {
+				t.Errorf("got %#v, expected %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConvertFilter(t *testing.T) {
+	fields := []*config.FieldConversion{{Name: "status", Type: "int"}}
+	tests := []struct {
+		name     string
+		cfg      config.ConvertFilter
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "converted",
+			cfg:      config.ConvertFilter{Fields: fields},
+			msg:      map[string]interface{}{"status": "200", "size": "10"},
+			expected: map[string]interface{}{"status": int64(200), "size": "10"},
+		},
+		{
+			name:     "infer others",
+			cfg:      config.ConvertFilter{Fields: fields, Infer: true},
+			msg:      map[string]interface{}{"__topic__": "1", "status": "200", "size": "10", "ok": "true", "n": 1},
+			expected: map[string]interface{}{"__topic__": "1", "status": int64(200), "size": int64(10), "ok": true, "n": 1},
+		},
+		{
+			name:     "keep on failure by default",
+			cfg:      config.ConvertFilter{Fields: fields},
+			msg:      map[string]interface{}{"status": "-"},
+			expected: map[string]interface{}{"status": "-"},
+		},
+		{
+			name:     "keep on failure",
+			cfg:      config.ConvertFilter{Fields: fields, OnFailure: "KEEP"},
+			msg:      map[string]interface{}{"status": "-"},
+			expected: map[string]interface{}{"status": "-"},
+		},
+		{
+			name:     "null on failure",
+			cfg:      config.ConvertFilter{Fields: fields, OnFailure: "null"},
+			msg:      map[string]interface{}{"status": "-", "size": "10"},
+			expected: map[string]interface{}{"status": nil, "size": "10"},
+		},
+		{
+			name: "drop on failure",
+			cfg:  config.ConvertFilter{Fields: fields, OnFailure: "drop"},
+			msg:  map[string]interface{}{"status": "-"},
+		},
+		{
+			name:     "not dropped without failure",
+			cfg:      config.ConvertFilter{Fields: fields, OnFailure: "drop"},
+			msg:      map[string]interface{}{"status": "200"},
+			expected: map[string]interface{}{"status": int64(200)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			fn, err := NewConvertFilter(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fn(tt.msg)
+			if tt.expected == nil {
+				if got != nil {
+					t.Errorf("%v is not dropped", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %#v, expected %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConvertFilterError(t *testing.T) {
+	tests := []config.ConvertFilter{
+		{OnFailure: "skip"},
+		{Fields: []*config.FieldConversion{{Type: "int"}}},
+		{Fields: []*config.FieldConversion{{Name: "f", Type: "uint"}}},
+		{Fields: []*config.FieldConversion{{Name: "f", Type: "timestamp", Timezone: "Mars/Olympus"}}},
+	}
+	for _, cfg := range tests {
+		cfg := cfg
+		if _, err := NewConvertFilter(&cfg); err == nil {
+			t.Errorf("%+v is accepted", cfg)
+		}
+	}
+}
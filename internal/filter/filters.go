@@ -1,3 +1,37 @@
 package filter
 
+import (
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
 type FilterFunc func(map[string]interface{}) map[string]interface{}
+
+// New build filter chain from config, filters run in the order of config.Filter fields.
+func New(cfg *config.Filter) ([]FilterFunc, error) {
+	filters := make([]FilterFunc, 0)
+	if cfg == nil {
+		return filters, nil
+	}
+	for _, c := range cfg.JSON {
+		fn, err := NewJSONFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, fn)
+	}
+	if cfg.Convert != nil {
+		fn, err := NewConvertFilter(cfg.Convert)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, fn)
+	}
+	if cfg.Timestamp != nil {
+		fn, err := NewTimestampFilter(cfg.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, fn)
+	}
+	return filters, nil
+}
@@ -0,0 +1,126 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+// NewJSONFilter parse a string field which contains json into nested objects,
+// or flatten them into the top level with separator when `flatten` is set.
+// Objects and arrays deeper than max depth are kept as json strings either way.
+func NewJSONFilter(cfg *config.JSONFilter) (FilterFunc, error) {
+	if cfg.Field == "" {
+		return nil, errors.New("json filter: field must not been null")
+	}
+	target := cfg.Target
+	if target == "" {
+		target = cfg.Field
+	}
+	if reserved(target) {
+		return nil, fmt.Errorf("json filter: target %s is reserved", target)
+	}
+	sep := cfg.Separator
+	if sep == "" {
+		sep = "."
+	}
+	return func(msg map[string]interface{}) map[string]interface{} {
+		s, ok := msg[cfg.Field].(string)
+		if !ok {
+			return msg
+		}
+		v, err := decodeJSON(s)
+		if err != nil {
+			// not a json string, leave it as it is
+			return msg
+		}
+		if !cfg.KeepOriginal {
+			delete(msg, cfg.Field)
+		}
+		obj, ok := v.(map[string]interface{})
+		if !cfg.Flatten || !ok {
+			// scalars and arrays are not flattened
+			msg[target] = limitDepth(v, cfg.MaxDepth, 1)
+			return msg
+		}
+		flatten(msg, target, sep, obj, cfg.MaxDepth, 1)
+		return msg
+	}, nil
+}
+
+// reserved report whether key is event time or topic, which are never overwritten
+func reserved(key string) bool {
+	return key == internal.TimeKey || key == internal.TopicKey
+}
+
+func decodeJSON(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	// only objects and arrays are considered as structured payloads
+	if s == "" || (s[0] != '{' && s[0] != '[') {
+		return nil, errors.New("not a json object or array")
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	// keep numbers as it is, avoid losing precision of large integers
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after json value")
+	}
+	return v, nil
+}
+
+// flatten write keys of obj at depth into dst, nested keys are joined with
+// sep. Values deeper than maxDepth are kept as json strings.
+func flatten(dst map[string]interface{}, prefix, sep string, obj map[string]interface{}, maxDepth, depth int) {
+	for k, v := range obj {
+		key := prefix + sep + k
+		if child, ok := v.(map[string]interface{}); ok && (maxDepth <= 0 || depth < maxDepth) {
+			flatten(dst, key, sep, child, maxDepth, depth+1)
+			continue
+		}
+		if reserved(key) {
+			continue
+		}
+		dst[key] = limitDepth(v, maxDepth, depth+1)
+	}
+}
+
+// limitDepth re-encode objects and arrays deeper than maxDepth as json
+// strings, v is at depth, the top level is 1.
+func limitDepth(v interface{}, maxDepth, depth int) interface{} {
+	if maxDepth <= 0 {
+		return v
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if depth > maxDepth {
+			return encodeJSON(value)
+		}
+		for k := range value {
+			value[k] = limitDepth(value[k], maxDepth, depth+1)
+		}
+	case []interface{}:
+		if depth > maxDepth {
+			return encodeJSON(value)
+		}
+		for i := range value {
+			value[i] = limitDepth(value[i], maxDepth, depth+1)
+		}
+	}
+	return v
+}
+
+func encodeJSON(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	return string(b)
+}
@@ -0,0 +1,111 @@
+package filter
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+func TestJSONFilter(t *testing.T) {
+	const nested = `{"a":{"b":{"c":1}},"list":[{"x":1}],"n":12345678901234567890}`
+	tests := []struct {
+		name     string
+		cfg      config.JSONFilter
+		message  string
+		expected string
+	}{
+		{
+			name:     "expand",
+			cfg:      config.JSONFilter{Field: "message"},
+			message:  nested,
+			expected: `{"__topic__":"t","message":{"a":{"b":{"c":1}},"list":[{"x":1}],"n":12345678901234567890}}`,
+		},
+		{
+			name:     "expand into target",
+			cfg:      config.JSONFilter{Field: "message", Target: "payload", KeepOriginal: true},
+			message:  `[1,2]`,
+			expected: `{"__topic__":"t","message":"[1,2]","payload":[1,2]}`,
+		},
+		{
+			name:     "expand with depth",
+			cfg:      config.JSONFilter{Field: "message", MaxDepth: 2},
+			message:  nested,
+			expected: `{"__topic__":"t","message":{"a":{"b":"{\"c\":1}"},"list":["{\"x\":1}"],"n":12345678901234567890}}`,
+		},
+		{
+			name:     "flatten with field as prefix",
+			cfg:      config.JSONFilter{Field: "message", Flatten: true},
+			message:  nested,
+			expected: `{"__topic__":"t","message.a.b.c":1,"message.list":[{"x":1}],"message.n":12345678901234567890}`,
+		},
+		{
+			name:     "flatten with prefix and separator",
+			cfg:      config.JSONFilter{Field: "message", Target: "p", Separator: "_", Flatten: true},
+			message:  `{"a":{"b":1}}`,
+			expected: `{"__topic__":"t","p_a_b":1}`,
+		},
+		{
+			// same levels as expand with depth, joined into keys
+			name:     "flatten with depth",
+			cfg:      config.JSONFilter{Field: "message", Flatten: true, MaxDepth: 2},
+			message:  nested,
+			expected: `{"__topic__":"t","message.a.b":"{\"c\":1}","message.list":["{\"x\":1}"],"message.n":12345678901234567890}`,
+		},
+		{
+			name:     "flatten array",
+			cfg:      config.JSONFilter{Field: "message", Flatten: true, MaxDepth: 1},
+			message:  `[{"x":1}]`,
+			expected: `{"__topic__":"t","message":["{\"x\":1}"]}`,
+		},
+		{
+			name:     "reserved keys are kept",
+			cfg:      config.JSONFilter{Field: "message", Target: "__", Separator: "topic__", Flatten: true},
+			message:  `{"":"x","y":1}`,
+			expected: `{"__topic__":"t","__topic__y":1}`,
+		},
+		{
+			name:     "invalid json",
+			cfg:      config.JSONFilter{Field: "message"},
+			message:  `{"a":`,
+			expected: `{"__topic__":"t","message":"{\"a\":"}`,
+		},
+		{
+			name:     "trailing data",
+			cfg:      config.JSONFilter{Field: "message"},
+			message:  `{} {}`,
+			expected: `{"__topic__":"t","message":"{} {}"}`,
+		},
+		{
+			name:     "scalar",
+			cfg:      config.JSONFilter{Field: "message", Flatten: true},
+			message:  `123`,
+			expected: `{"__topic__":"t","message":"123"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			fn, err := NewJSONFilter(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := fn(map[string]interface{}{"__topic__": "t", "message": tt.message})
+			b, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("got %s, expected %s", b, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJSONFilterReservedTarget(t *testing.T) {
+	for _, target := range []string{"@timestamp", "__topic__"} {
+		if _, err := NewJSONFilter(&config.JSONFilter{Field: "message", Target: target}); err == nil {
+			t.Errorf("target %s is accepted", target)
+		}
+	}
+}
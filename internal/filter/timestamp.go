@@ -0,0 +1,56 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+// NewTimestampFilter parse event time from a log field into internal.TimeKey,
+// the time set by consumer is kept if none of the layouts matches.
+func NewTimestampFilter(cfg *config.TimestampFilter) (FilterFunc, error) {
+	if cfg.Field == "" {
+		return nil, errors.New("timestamp filter: field must not been null")
+	}
+	layouts := cfg.Layouts
+	if len(layouts) == 0 {
+		layouts = []string{time.RFC3339Nano}
+	}
+	loc := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("timestamp filter: %v", err)
+		}
+	}
+	return func(msg map[string]interface{}) map[string]interface{} {
+		var (
+			ts time.Time
+			ok bool
+		)
+		switch value := msg[cfg.Field].(type) {
+		case time.Time:
+			// already converted by convert filter
+			ts, ok = value, true
+		case string:
+			for _, layout := range layouts {
+				t, err := parseTime(value, layout, loc)
+				if err == nil {
+					ts, ok = t, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return msg
+		}
+		msg[internal.TimeKey] = ts
+		if !cfg.KeepField && cfg.Field != internal.TimeKey {
+			delete(msg, cfg.Field)
+		}
+		return msg
+	}, nil
+}
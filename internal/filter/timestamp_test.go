@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+func TestTimestampFilter(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	// time set by consumer
+	slsTime := time.Date(2021, 6, 1, 0, 0, 1, 0, time.UTC)
+	layouts := []string{"2006-01-02 15:04:05.000", "unix_ms"}
+	tests := []struct {
+		name         string
+		cfg          config.TimestampFilter
+		value        interface{}
+		expected     time.Time
+		expectedKept bool
+	}{
+		{
+			name:     "rfc3339 by default",
+			cfg:      config.TimestampFilter{Field: "time"},
+			value:    "2021-06-01T08:00:00.123+08:00",
+			expected: time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+		},
+		{
+			name:     "first layout",
+			cfg:      config.TimestampFilter{Field: "time", Layouts: layouts, Timezone: "UTC"},
+			value:    "2021-06-01 00:00:00.123",
+			expected: time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+		},
+		{
+			name:     "second layout",
+			cfg:      config.TimestampFilter{Field: "time", Layouts: layouts, Timezone: "UTC"},
+			value:    "1622505600123",
+			expected: time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+		},
+		{
+			name:     "timezone of layout without zone",
+			cfg:      config.TimestampFilter{Field: "time", Layouts: layouts, Timezone: "Asia/Shanghai"},
+			value:    "2021-06-01 08:00:00.123",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 123e6, shanghai),
+		},
+		{
+			name:     "local by default",
+			cfg:      config.TimestampFilter{Field: "time", Layouts: layouts},
+			value:    "2021-06-01 08:00:00.123",
+			expected: time.Date(2021, 6, 1, 8, 0, 0, 123e6, time.Local),
+		},
+		{
+			name:         "no layout matches",
+			cfg:          config.TimestampFilter{Field: "time", Layouts: layouts},
+			value:        "yesterday",
+			expected:     slsTime,
+			expectedKept: true,
+		},
+		{
+			name:         "missing field",
+			cfg:          config.TimestampFilter{Field: "time"},
+			expected:     slsTime,
+			expectedKept: false,
+		},
+		{
+			name:         "neither string nor time",
+			cfg:          config.TimestampFilter{Field: "time", Layouts: layouts},
+			value:        int64(1622505600123),
+			expected:     slsTime,
+			expectedKept: true,
+		},
+		{
+			name:     "converted by convert filter",
+			cfg:      config.TimestampFilter{Field: "time"},
+			value:    time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+			expected: time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+		},
+		{
+			name:         "keep field",
+			cfg:          config.TimestampFilter{Field: "time", KeepField: true},
+			value:        "2021-06-01T00:00:00.123Z",
+			expected:     time.Date(2021, 6, 1, 0, 0, 0, 123e6, time.UTC),
+			expectedKept: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			fn, err := NewTimestampFilter(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := map[string]interface{}{internal.TimeKey: slsTime}
+			if tt.value != nil {
+				msg[cfg.Field] = tt.value
+			}
+			msg = fn(msg)
+			if ts, ok := msg[internal.TimeKey].(time.Time); !ok || !ts.Equal(tt.expected) {
+				t.Errorf("event time is %v, expected %v", msg[internal.TimeKey], tt.expected)
+			}
+			if _, kept := msg[cfg.Field]; kept != tt.expectedKept {
+				t.Errorf("field kept %v, expected %v", kept, tt.expectedKept)
+			}
+		})
+	}
+}
+
+func TestTimestampFilterOfTimeKey(t *testing.T) {
+	fn, err := NewTimestampFilter(&config.TimestampFilter{Field: internal.TimeKey, Layouts: []string{"unix"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := fn(map[string]interface{}{internal.TimeKey: "1622505600"})
+	if ts, ok := msg[internal.TimeKey].(time.Time); !ok || !ts.Equal(time.Unix(1622505600, 0)) {
+		t.Errorf("event time is %v", msg[internal.TimeKey])
+	}
+}
+
+func TestTimestampFilterError(t *testing.T) {
+	tests := []config.TimestampFilter{
+		{},
+		{Field: "time", Timezone: "Mars/Olympus"},
+	}
+	for _, cfg := range tests {
+		cfg := cfg
+		if _, err := NewTimestampFilter(&cfg); err == nil {
+			t.Errorf("%+v is accepted", cfg)
+		}
+	}
+}
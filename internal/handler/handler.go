@@ -1,94 +1,307 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"os"
 	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
-	"github.com/vjeantet/jodaTime"
+	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/deadletter"
 	"github.com/fengxsong/sls2oss/internal/filter"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
 	"github.com/fengxsong/sls2oss/internal/metrics"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/tracing"
 	"github.com/fengxsong/sls2oss/internal/writer"
 )
 
-type ConsumeFunc func(map[string]interface{}) error
+// flush encoded records of an object key once buffer grows larger than this,
+// so a single write never exceeds max size of rotate writer, unless objects
+// are named by cursors.
+const flushSize = 256 * 1024
+
+// ConsumeFunc take the ownership of batch and release it after consuming
+type ConsumeFunc func(*internal.Batch) error
 
 type MessageHandler struct {
-	format  string
-	filters []filter.FilterFunc
-	Consume ConsumeFunc
-	w       *writer.OssWriter
+	logger   log.Logger
+	layout   *partition.Layout
+	tpl      *keytpl.Template
+	hostname string
+	filters  []filter.FilterFunc
+	dlq      deadletter.Sink
+	// records of partitions passed by watermark are late if it's set
+	watermark    func() (time.Time, bool)
+	watermarkCfg *config.Watermark
+	Consume      ConsumeFunc
+	w            *writer.OssWriter
+	// queues of workers, closed by Close
+	incomings []chan *internal.Batch
+	workers   sync.WaitGroup
 }
 
-func New(logger log.Logger, format string, workerNum int, w *writer.OssWriter, quit <-chan struct{}) *MessageHandler {
+func New(logger log.Logger, layout *partition.Layout, tpl *keytpl.Template, workerNum int, workerKey string, w *writer.OssWriter) *MessageHandler {
+	hostname, err := os.Hostname()
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to get hostname", "err", err)
+	}
 	mh := &MessageHandler{
-		format:  format,
-		filters: make([]filter.FilterFunc, 0),
-		w:       w,
+		logger:   logger,
+		layout:   layout,
+		tpl:      tpl,
+		hostname: hostname,
+		filters:  make([]filter.FilterFunc, 0),
+		w:        w,
 	}
 	if workerNum < 1 {
 		// fallback to default 1
 		workerNum = 1
 	}
-	if workerNum == 1 {
+	switch {
+	case workerNum == 1:
 		mh.Consume = mh.consume
-	} else {
-		incoming := make(chan map[string]interface{}, workerNum)
+	case workerKey == WorkerKeyNone:
+		incoming := make(chan *internal.Batch, workerNum)
+		mh.incomings = append(mh.incomings, incoming)
 		for i := 0; i < workerNum; i++ {
-			w := newWorker(logger, mh.consume, incoming, quit)
-			go w.loop()
+			mh.start(newWorker(logger, "shared", mh.consume, incoming))
 		}
-		mh.Consume = func(m map[string]interface{}) error {
-			incoming <- m
+		mh.Consume = func(b *internal.Batch) error {
+			incoming <- b
+			metrics.PipelineWorkerQueueDepth.WithLabelValues("shared").Set(float64(len(incoming)))
+			return nil
+		}
+	default:
+		// each worker owns a channel, records with the same key always go to the
+		// same worker, so they are written in the order of consuming.
+		incomings := make([]chan *internal.Batch, workerNum)
+		for i := range incomings {
+			incomings[i] = make(chan *internal.Batch, 1)
+			mh.start(newWorker(logger, strconv.Itoa(i), mh.consume, incomings[i]))
+		}
+		mh.incomings = incomings
+		mh.Consume = func(b *internal.Batch) error {
+			for i, sub := range dispatch(workerKey, b, workerNum) {
+				if sub != nil {
+					incomings[i] <- sub
+					metrics.PipelineWorkerQueueDepth.WithLabelValues(strconv.Itoa(i)).Set(float64(len(incomings[i])))
+				}
+			}
 			return nil
 		}
 	}
 	return mh
 }
 
+func (mh *MessageHandler) start(w *worker) {
+	mh.workers.Add(1)
+	go func() {
+		defer mh.workers.Done()
+		w.loop()
+	}()
+}
+
+// Close stop workers after batches queued are consumed, Consume must not be
+// called after it.
+func (mh *MessageHandler) Close() {
+	for _, incoming := range mh.incomings {
+		close(incoming)
+	}
+	mh.workers.Wait()
+}
+
 func (mh *MessageHandler) AddFilters(filters ...filter.FilterFunc) {
 	mh.filters = append(mh.filters, filters...)
 }
 
-func (mh *MessageHandler) consume(msg map[string]interface{}) (err error) {
-	topic, ok := msg[internal.TopicKey].(string)
-	if !ok {
-		// skip msg without topic
-		return nil
+// SetDeadLetter set sink of records failed to be processed, they are
+// dropped with logs if it's not set.
+func (mh *MessageHandler) SetDeadLetter(sink deadletter.Sink) {
+	mh.dlq = sink
+}
+
+// SetWatermark write records of partitions closed by watermark under late prefix
+func (mh *MessageHandler) SetWatermark(cfg *config.Watermark, watermark func() (time.Time, bool)) {
+	mh.watermarkCfg = cfg
+	mh.watermark = watermark
+}
+
+// lateBefore return time before which records are late, zero if watermark is unknown
+func (mh *MessageHandler) lateBefore() time.Time {
+	if mh.watermark == nil {
+		return time.Time{}
 	}
-	ts, ok := msg[internal.TimeKey].(time.Time)
+	wm, ok := mh.watermark()
 	if !ok {
-		// skip, same reason as topic
-		return nil
+		return time.Time{}
+	}
+	// partitions ending before cutoff are closed, which are the ones before the
+	// partition containing cutoff.
+	start, _ := mh.layout.Period(wm.Add(-time.Duration(mh.watermarkCfg.AllowedLateness)))
+	return start
+}
+
+var (
+	errMissingTopic = errors.New("missing topic")
+	errMissingTime  = errors.New("missing or invalid " + internal.TimeKey)
+)
+
+func (mh *MessageHandler) deadLetter(src *internal.Source, r *internal.Record, stage string, err error) {
+	if mh.dlq == nil {
+		return
+	}
+	if derr := deadletter.Put(mh.dlq, deadletter.NewEntry(src, r, stage, err)); derr != nil {
+		level.Error(mh.logger).Log("msg", "put dead letter", "stage", stage, "err", derr)
+	}
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} { return &bytes.Buffer{} },
+}
+
+// pending hold encoded records of an object key
+type pending struct {
+	topic   string
+	buf     *bytes.Buffer
+	records []int // index of records in batch, for dead letters
+	stat    writer.FileStat
+}
+
+// consume encode records of batch and write them per object key
+func (mh *MessageHandler) consume(b *internal.Batch) (err error) {
+	defer b.Release()
+	if b.Done != nil {
+		defer b.Done()
 	}
-	metrics.PipelineEventInTotal.WithLabelValues(topic).Inc()
+	_, span := tracing.Tracer().Start(b.Ctx, "handler.consume",
+		trace.WithAttributes(attribute.Int("sls.records", len(b.Records))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	var (
+		// reused by all records of the batch
+		fields   = make(map[string]interface{}, 32)
+		pendings = make(map[string]*pending)
+		in       = make(map[string]int)
+		late     = mh.lateBefore()
+	)
+	defer func() {
+		for _, p := range pendings {
+			p.buf.Reset()
+			bufPool.Put(p.buf)
+		}
+	}()
+	for i := range b.Records {
+		r := &b.Records[i]
+		if r.Topic == "" {
+			// skip msg without topic
+			metrics.PipelineEventSkippedTotal.WithLabelValues(b.Source.Logstore, "missing_topic").Inc()
+			mh.deadLetter(b.Source, r, deadletter.StageValidate, errMissingTopic)
+			continue
+		}
+		in[r.Topic]++
 
-	for _, filter := range mh.filters {
-		msg = filter(msg)
+		r.Fields(fields)
+		msg := fields
+		for _, filter := range mh.filters {
+			if msg = filter(msg); msg == nil {
+				break
+			}
+		}
 		if msg == nil {
-			return nil
+			metrics.PipelineEventSkippedTotal.WithLabelValues(b.Source.Logstore, "filtered").Inc()
+			continue
+		}
+		// read after filters, event time may be overwritten by them
+		ts, ok := msg[internal.TimeKey].(time.Time)
+		if !ok {
+			// skip, same reason as topic
+			metrics.PipelineEventSkippedTotal.WithLabelValues(b.Source.Logstore, "missing_timestamp").Inc()
+			mh.deadLetter(b.Source, r, deadletter.StageValidate, errMissingTime)
+			continue
+		}
+
+		writePath := mh.getObjectKey(b.Source, msg)
+		if ts.Before(late) {
+			metrics.PipelineLateRecordsTotal.WithLabelValues(b.Source.Logstore).Inc()
+			writePath = path.Join(mh.watermarkCfg.LatePrefix, writePath)
+		}
+		// todo: remove unnecessary fields
+		data, merr := json.Marshal(&msg)
+		if merr != nil {
+			level.Error(mh.logger).Log("msg", "marshal record", "err", merr)
+			mh.deadLetter(b.Source, r, deadletter.StageEncode, merr)
+			continue
+		}
+		p, ok := pendings[writePath]
+		if !ok {
+			p = &pending{topic: r.Topic, buf: bufPool.Get().(*bytes.Buffer)}
+			pendings[writePath] = p
+		}
+		p.buf.Write(data)
+		p.buf.WriteByte('\n')
+		p.records = append(p.records, i)
+		p.stat.Add(writer.FileStat{Records: 1, MinTime: ts, MaxTime: ts})
+		// records of a batch are written at once if objects are named by
+		// cursors, so files are only rotated between batches
+		if p.buf.Len() >= flushSize && !mh.tpl.Cursors() {
+			if werr := mh.write(b, writePath, p); werr != nil {
+				err = werr
+			}
+		}
+	}
+	for writePath, p := range pendings {
+		if werr := mh.write(b, writePath, p); werr != nil {
+			err = werr
 		}
 	}
+	for topic, n := range in {
+		metrics.PipelineEventInTotal.WithLabelValues(topic).Add(float64(n))
+	}
+	return err
+}
 
-	writePath := path.Join(topic, mh.getPathFromTimestamp(ts))
-	// todo: remove unnecessary fields
-	b, err := json.Marshal(&msg)
-	if err != nil {
-		return err
+func (mh *MessageHandler) write(b *internal.Batch, writePath string, p *pending) error {
+	if len(p.records) == 0 {
+		return nil
+	}
+	defer func() {
+		p.buf.Reset()
+		p.records = p.records[:0]
+		p.stat = writer.FileStat{}
+	}()
+	stat := p.stat
+	stat.Logstores = []string{b.Source.Logstore}
+	stat.Shards = []int{b.Source.Shard}
+	if b.Source.Cursor != "" && b.Source.NextCursor != "" {
+		stat.FirstCursor, stat.NextCursor = b.Source.Cursor, b.Source.NextCursor
 	}
-	b = append(b, []byte("\n")...)
-	n, err := mh.w.WriteTo(writePath, b)
+	n, err := mh.w.WriteRecords(writePath, p.buf.Bytes(), stat)
 	if err != nil {
+		level.Error(mh.logger).Log("msg", "write records", "path", writePath, "err", err)
+		for _, i := range p.records {
+			mh.deadLetter(b.Source, &b.Records[i], deadletter.StageWrite, err)
+		}
 		return err
 	}
-	metrics.PipelineEventOutTotal.WithLabelValues(topic).Inc()
-	metrics.PipelineWriteBytesTotal.WithLabelValues(topic, "temp", "plaintext").Add(float64(n))
+	metrics.PipelineEventOutTotal.WithLabelValues(p.topic).Add(float64(len(p.records)))
+	metrics.PipelineWriteBytesTotal.WithLabelValues(p.topic, "temp", "plaintext").Add(float64(n))
 	return nil
 }
-
-func (mh *MessageHandler) getPathFromTimestamp(t time.Time) string {
-	return jodaTime.Format(mh.format, t)
-}
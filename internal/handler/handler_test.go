@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/go-kit/kit/log"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+// newTestWriter return oss writer uploading to a fake bucket, and objects
+// uploaded by object path
+func newTestWriter(t *testing.T) (*writer.OssWriter, map[string][]byte) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		objects[r.URL.Path] = b
+		mu.Unlock()
+		w.Header().Set("x-oss-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(b, crc64.MakeTable(crc64.ECMA)), 10))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := &config.OssConfig{
+		Endpoint:        srv.URL,
+		AccessKeyID:     "id",
+		AccessKeySecret: "secret",
+		Bucket:          "bucket",
+		TempDir:         t.TempDir(),
+		ScanInterval:    config.Duration(time.Second),
+	}
+	if err := cfg.ValidateAndSetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	t.Cleanup(func() { close(quit) })
+	w, err := writer.NewOssWriter(cfg, nil, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, objects
+}
+
+func newTestHandler(t *testing.T, workerNum int, workerKey string, w *writer.OssWriter) *MessageHandler {
+	layout, err := partition.New(&config.Partition{Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl, err := keytpl.Parse("{logstore}/{field.app}/{seq}.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(log.NewNopLogger(), layout, tpl, workerNum, workerKey, w)
+}
+
+func newRecord(app string, n int) internal.Record {
+	str := func(s string) *string { return &s }
+	return internal.Record{
+		Topic: "t",
+		Time:  time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		Contents: []*sls.LogContent{
+			{Key: str("app"), Value: str(app)},
+			{Key: str("n"), Value: str(strconv.Itoa(n))},
+		},
+	}
+}
+
+func TestWorkerKeyOrder(t *testing.T) {
+	apps := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	tests := []struct {
+		name      string
+		workerKey string
+		shards    int
+	}{
+		{name: "by field", workerKey: "field.app", shards: 1},
+		{name: "by shard", workerKey: WorkerKeyShard, shards: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, objects := newTestWriter(t)
+			h := newTestHandler(t, 4, tt.workerKey, w)
+			var done sync.WaitGroup
+			n := 0
+			for i := 0; i < 50; i++ {
+				b := internal.NewBatch(&internal.Source{Logstore: "ls", Shard: i % tt.shards})
+				for j := 0; j < 20; j++ {
+					b.Records = append(b.Records, newRecord(apps[(i+j)%len(apps)], n))
+					n++
+				}
+				done.Add(1)
+				b.Done = done.Done
+				if err := h.Consume(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			done.Wait()
+			h.Close()
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := w.Wait(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// records sharing a worker key keep the order of consuming
+			total := 0
+			for key, data := range objects {
+				last := make(map[string]int)
+				scanner := bufio.NewScanner(bytes.NewReader(data))
+				for scanner.Scan() {
+					var record struct {
+						App string `json:"app"`
+						N   string `json:"n"`
+					}
+					if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+						t.Fatal(err)
+					}
+					if !strings.HasPrefix(key, "/bucket/ls/"+record.App+"/") {
+						t.Fatalf("record of %s is written to %s", record.App, key)
+					}
+					n, _ := strconv.Atoi(record.N)
+					// batch n/20 comes from shard n/20%shards
+					workerKey := record.App
+					if tt.workerKey == WorkerKeyShard {
+						workerKey = strconv.Itoa(n / 20 % tt.shards)
+					}
+					if prev, ok := last[workerKey]; ok && n < prev {
+						t.Errorf("record %d of %s is written after %d", n, workerKey, prev)
+					}
+					last[workerKey] = n
+					total++
+				}
+			}
+			if total != n {
+				t.Errorf("%d records are written, expected %d", total, n)
+			}
+		})
+	}
+}
+
+func TestDispatchDone(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		apps    []string
+		workers int
+	}{
+		{name: "empty batch", key: "field.app", workers: 4},
+		{name: "single worker", key: "field.app", apps: []string{"a", "a", "a"}, workers: 4},
+		{name: "several workers", key: "field.app", apps: []string{"a", "b", "c", "d", "e", "f", "a"}, workers: 4},
+		{name: "by shard", key: WorkerKeyShard, apps: []string{"a", "b", "c"}, workers: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := internal.NewBatch(&internal.Source{Logstore: "ls"})
+			for i, app := range tt.apps {
+				b.Records = append(b.Records, newRecord(app, i))
+			}
+			calls := 0
+			b.Done = func() { calls++ }
+
+			var subs []*internal.Batch
+			records := 0
+			for _, sub := range dispatch(tt.key, b, tt.workers) {
+				if sub != nil {
+					subs = append(subs, sub)
+					records += len(sub.Records)
+				}
+			}
+			if records != len(tt.apps) {
+				t.Fatalf("%d records are dispatched, expected %d", records, len(tt.apps))
+			}
+			if len(subs) == 0 {
+				if calls != 1 {
+					t.Errorf("done of empty batch is called %d times", calls)
+				}
+				return
+			}
+			for i, sub := range subs {
+				if calls != 0 {
+					t.Fatalf("done is called before sub batch %d of %d is done", i, len(subs))
+				}
+				sub.Done()
+			}
+			if calls != 1 {
+				t.Errorf("done is called %d times after all sub batches are done", calls)
+			}
+		})
+	}
+}
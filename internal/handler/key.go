@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vjeantet/jodaTime"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+)
+
+// getObjectKey render key template with record, variables other than the
+// known ones and `field.xxx` are treated as joda formats of event time.
+func (mh *MessageHandler) getObjectKey(src *internal.Source, msg map[string]interface{}) string {
+	ts := msg[internal.TimeKey].(time.Time)
+	return mh.tpl.Execute(func(name string) (string, bool) {
+		switch name {
+		case "topic":
+			topic, _ := msg[internal.TopicKey].(string)
+			return topic, topic != ""
+		case "project":
+			return src.Project, src.Project != ""
+		case "logstore":
+			return src.Logstore, src.Logstore != ""
+		case "shard":
+			return strconv.Itoa(src.Shard), true
+		case "hostname":
+			return mh.hostname, mh.hostname != ""
+		case "partition":
+			return mh.getPathFromTimestamp(ts), true
+		}
+		if strings.HasPrefix(name, keytpl.FieldPrefix) {
+			v, ok := msg[strings.TrimPrefix(name, keytpl.FieldPrefix)]
+			if !ok || v == nil {
+				return "", false
+			}
+			if s, ok := v.(string); ok {
+				return s, true
+			}
+			return fmt.Sprint(v), true
+		}
+		return jodaTime.Format(name, ts.In(mh.layout.Location())), true
+	})
+}
+
+func (mh *MessageHandler) getPathFromTimestamp(t time.Time) string {
+	return mh.layout.Format(t)
+}
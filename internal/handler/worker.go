@@ -1,38 +1,101 @@
 package handler
 
 import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/metrics"
 )
 
 type worker struct {
+	name     string
 	logger   log.Logger
 	consume  ConsumeFunc
-	incoming chan map[string]interface{}
-	quit     <-chan struct{}
+	incoming chan *internal.Batch
 }
 
-func newWorker(logger log.Logger, consume ConsumeFunc, incoming chan map[string]interface{}, quit <-chan struct{}) *worker {
+func newWorker(logger log.Logger, name string, consume ConsumeFunc, incoming chan *internal.Batch) *worker {
 	return &worker{
+		name:     name,
 		logger:   logger,
 		consume:  consume,
 		incoming: incoming,
-		quit:     quit,
 	}
 }
 
+// loop consume batches until incoming is closed and drained
 func (w *worker) loop() {
-	for {
-		select {
-		case m, ok := <-w.incoming:
-			if !ok {
-				return
+	for b := range w.incoming {
+		metrics.PipelineWorkerQueueDepth.WithLabelValues(w.name).Set(float64(len(w.incoming)))
+		if err := w.consume(b); err != nil {
+			level.Error(w.logger).Log("msg", "consuming", "err", err)
+		}
+	}
+}
+
+const (
+	// WorkerKeyNone let all workers share one channel, order is not kept
+	WorkerKeyNone = "none"
+	// WorkerKeyShard dispatch records by logstore and shard
+	WorkerKeyShard = "shard"
+)
+
+// dispatch split batch into sub batches indexed by worker, key is
+// WorkerKeyShard or `field.<name>` to dispatch by value of a content field.
+// the original batch is reused or released.
+func dispatch(key string, b *internal.Batch, n int) []*internal.Batch {
+	subs := make([]*internal.Batch, n)
+	if !strings.HasPrefix(key, keytpl.FieldPrefix) {
+		// whole batch comes from the same shard
+		subs[partitionOf(b.Source.Logstore+"/"+strconv.Itoa(b.Source.Shard), n)] = b
+		return subs
+	}
+	field := strings.TrimPrefix(key, keytpl.FieldPrefix)
+	for i := range b.Records {
+		v, _ := b.Records[i].Get(field)
+		idx := partitionOf(v, n)
+		if subs[idx] == nil {
+			subs[idx] = internal.NewBatch(b.Source)
+			subs[idx].Ctx = b.Ctx
+		}
+		subs[idx].Records = append(subs[idx].Records, b.Records[i])
+	}
+	if b.Done != nil {
+		// the batch is done once all sub batches are done
+		var left int32
+		for _, sub := range subs {
+			if sub != nil {
+				left++
 			}
-			if err := w.consume(m); err != nil {
-				level.Error(w.logger).Log("msg", "consuming", "err", err)
+		}
+		if left == 0 {
+			b.Done()
+		}
+		done := b.Done
+		for _, sub := range subs {
+			if sub != nil {
+				sub.Done = func() {
+					if atomic.AddInt32(&left, -1) == 0 {
+						done()
+					}
+				}
 			}
-		case <-w.quit:
-			return
 		}
 	}
+	b.Release()
+	return subs
+}
+
+func partitionOf(key string, n int) int {
+	h := fnv.New32a()
+	fmt.Fprint(h, key)
+	return int(h.Sum32() % uint32(n))
 }
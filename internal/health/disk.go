@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import "syscall"
+
+func freeDiskBytes(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
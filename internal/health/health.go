@@ -0,0 +1,123 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+// Checker report liveness and readiness of pipeline
+type Checker struct {
+	cfg        *config.Health
+	logstores  []string
+	w          *writer.OssWriter
+	tempDir    string
+	startedAt  time.Time
+	mu         sync.Mutex
+	heartbeats map[string]time.Time // last progress of consumers of logstores
+	synced     bool                 // orphaned files are synced
+}
+
+func New(cfg *config.Health, logstores []string, w *writer.OssWriter, tempDir string) *Checker {
+	return &Checker{
+		cfg:        cfg,
+		logstores:  logstores,
+		w:          w,
+		tempDir:    tempDir,
+		startedAt:  time.Now(),
+		heartbeats: make(map[string]time.Time),
+	}
+}
+
+// Heartbeat record progress of consumer of logstore, which is processing
+// batches or holding shards by heartbeats
+func (c *Checker) Heartbeat(logstore string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heartbeats[logstore] = time.Now()
+}
+
+// SetOrphanSynced mark orphan sync before starting as done
+func (c *Checker) SetOrphanSynced() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced = true
+}
+
+// Ready fail until all consumers joined their groups and orphan sync is done,
+// or while temp dir is full
+func (c *Checker) Ready() map[string]string {
+	failures := make(map[string]string)
+	c.mu.Lock()
+	if !c.synced {
+		failures["orphan_sync"] = "not done"
+	}
+	for _, ls := range c.logstores {
+		if _, ok := c.heartbeats[ls]; !ok {
+			failures["consumer/"+ls] = "not joined consumer group"
+		}
+	}
+	c.mu.Unlock()
+
+	c.checkDisk(failures)
+	return failures
+}
+
+// Live fail if consumers stopped making progress, uploads keep failing or
+// temp dir is full
+func (c *Checker) Live() map[string]string {
+	failures := make(map[string]string)
+	timeout := time.Duration(c.cfg.HeartbeatTimeout)
+	c.mu.Lock()
+	for _, ls := range c.logstores {
+		last, ok := c.heartbeats[ls]
+		if !ok {
+			// not joined yet, give it a chance before timing out
+			last = c.startedAt
+		}
+		if since := time.Since(last); since > timeout {
+			failures["heartbeat/"+ls] = fmt.Sprintf("no progress in %s", since.Truncate(time.Second))
+		}
+	}
+	c.mu.Unlock()
+
+	if since := c.w.UploadFailingSince(); !since.IsZero() && time.Since(since) > time.Duration(c.cfg.UploadFailureTimeout) {
+		failures["upload"] = fmt.Sprintf("failing since %s", since.Format(time.RFC3339))
+	}
+	c.checkDisk(failures)
+	return failures
+}
+
+// checkDisk add failure of disk if free space of temp dir is below min_free_disk
+func (c *Checker) checkDisk(failures map[string]string) {
+	if c.cfg.MinFreeDisk <= 0 {
+		return
+	}
+	free, err := freeDiskBytes(c.tempDir)
+	if err != nil {
+		failures["disk"] = err.Error()
+	} else if free < uint64(c.cfg.MinFreeDisk)*1024*1024 {
+		failures["disk"] = fmt.Sprintf("only %d bytes free in %s", free, c.tempDir)
+	}
+}
+
+// Register /healthz and /readyz to mux
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) { writeResult(rw, c.Live()) })
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) { writeResult(rw, c.Ready()) })
+}
+
+func writeResult(rw http.ResponseWriter, failures map[string]string) {
+	code, status := http.StatusOK, "ok"
+	if len(failures) > 0 {
+		code, status = http.StatusServiceUnavailable, "failed"
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]interface{}{"status": status, "failures": failures})
+}
@@ -0,0 +1,365 @@
+package keytpl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FieldPrefix = "field."
+
+	// values of template variables which exceeded cardinality limit
+	OverflowValue = "_other"
+	// default value of missing variables
+	MissingValue = "_unknown"
+
+	maxValueLength = 128
+
+	// distinct values counted by the cardinality limit are forgotten after
+	// this window, so values showing up later are not stuck in OverflowValue
+	cardinalityWindow = time.Hour
+)
+
+// variables resolved from record and source, any other name must be a joda
+// format of event time
+var recordVars = map[string]bool{
+	"topic":     true,
+	"project":   true,
+	"logstore":  true,
+	"shard":     true,
+	"hostname":  true,
+	"partition": true,
+}
+
+// pattern letters of joda formats, other letters in a variable name mean it's a typo
+const jodaLetters = "GCYxweEyDMdaKhHkmsSzZ"
+
+// variables evaluated when a new file is opened, left untouched when rendering records
+var fileVars = map[string]bool{
+	"seq":          true,
+	"unix":         true,
+	"rand":         true,
+	"hash":         true,
+	"cursor_begin": true,
+	"cursor_end":   true,
+}
+
+// HashVar is rendered as content hash of the file right before uploading,
+// files on disk carry a unique placeholder `{hash-<random>}` instead, which
+// is a valid file name on windows as well.
+const HashVar = "hash"
+
+var hashPlaceholder = regexp.MustCompile(`\{hash-[a-z0-9]+\}`)
+
+// HashPlaceholder return a unique placeholder of content hash
+func HashPlaceholder(random string) string {
+	return "{" + HashVar + "-" + random + "}"
+}
+
+// HasHashPlaceholder report whether s contains content hash placeholder
+func HasHashPlaceholder(s string) bool {
+	return hashPlaceholder.MatchString(s)
+}
+
+// ReplaceHashPlaceholder render placeholder of content hash with sum
+func ReplaceHashPlaceholder(s, sum string) string {
+	return hashPlaceholder.ReplaceAllLiteralString(s, sum)
+}
+
+// CursorBeginVar and CursorEndVar are rendered as sequence numbers of the
+// first log group of a file and the one following its last log group, which
+// are only known once the file is closed. Files carry unique placeholders
+// `{cursor_begin-<random>}` and `{cursor_end-<random>}` until then.
+const (
+	CursorBeginVar = "cursor_begin"
+	CursorEndVar   = "cursor_end"
+)
+
+var cursorPlaceholder = regexp.MustCompile(`\{(cursor_begin|cursor_end)-[a-z0-9]+\}`)
+
+// CursorPlaceholder return a unique placeholder of cursor variable name
+func CursorPlaceholder(name, random string) string {
+	return "{" + name + "-" + random + "}"
+}
+
+// HasCursorPlaceholder report whether s contains placeholders of cursors
+func HasCursorPlaceholder(s string) bool {
+	return cursorPlaceholder.MatchString(s)
+}
+
+// ReplaceCursorPlaceholders render placeholders of cursors with begin and end
+func ReplaceCursorPlaceholders(s, begin, end string) string {
+	return cursorPlaceholder.ReplaceAllStringFunc(s, func(p string) string {
+		if strings.HasPrefix(p, "{"+CursorBeginVar+"-") {
+			return begin
+		}
+		return end
+	})
+}
+
+// Resolver return value of a variable, ok is false if it's not found
+type Resolver func(name string) (value string, ok bool)
+
+type segment struct {
+	literal string
+	name    string
+	def     string
+	hasDef  bool
+}
+
+// Template is a object key template, eg.
+// {project}/{logstore}/{field.app|none}/dt={yyyy-MM-dd}/{hostname}-{shard}-{seq}.json
+type Template struct {
+	raw            string
+	segments       []segment
+	cursors        bool
+	maxCardinality int
+	mu             sync.Mutex
+	seen           map[string]map[string]struct{}
+	seenSince      time.Time
+}
+
+func Parse(s string, maxCardinality int) (*Template, error) {
+	segments, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		if seg.name != "" && !isKnownVar(seg.name) {
+			return nil, fmt.Errorf("key template %q: unknown variable {%s}", s, seg.name)
+		}
+	}
+	name := s
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		name = s[i+1:]
+	}
+	fileNameOK := false
+	for _, seg := range mustParse(name) {
+		if fileVars[seg.name] {
+			fileNameOK = true
+		}
+	}
+	if !fileNameOK {
+		return nil, fmt.Errorf("key template %q: file name must contain one of {seq}, {unix}, {rand}, {hash}, {cursor_begin} or {cursor_end}", s)
+	}
+	vars := make(map[string]bool)
+	for _, seg := range segments {
+		vars[seg.name] = true
+	}
+	cursors := vars[CursorBeginVar] || vars[CursorEndVar]
+	if cursors && !(vars["logstore"] && vars["shard"]) {
+		// cursors are sequence numbers of a shard
+		return nil, fmt.Errorf("key template %q: {logstore} and {shard} are required by cursor variables", s)
+	}
+	return &Template{
+		raw:            s,
+		segments:       segments,
+		cursors:        cursors,
+		maxCardinality: maxCardinality,
+		seen:           make(map[string]map[string]struct{}),
+		seenSince:      time.Now(),
+	}, nil
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Cursors report whether objects are named by cursors of records
+func (t *Template) Cursors() bool {
+	return t.cursors
+}
+
+// Execute render record level variables, file level variables are kept as
+// placeholders which will be rendered by RenderFile.
+func (t *Template) Execute(resolve Resolver) string {
+	var sb strings.Builder
+	for _, seg := range t.segments {
+		if seg.name == "" {
+			sb.WriteString(seg.literal)
+			continue
+		}
+		if fileVars[seg.name] {
+			sb.WriteString("{" + seg.name + "}")
+			continue
+		}
+		v, ok := resolve(seg.name)
+		if ok && isDataVar(seg.name) {
+			v = t.guard(seg.name, Sanitize(v))
+		}
+		if !ok || v == "" {
+			v = MissingValue
+			if seg.hasDef && seg.def != "" {
+				v = seg.def
+			}
+		}
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
+
+// guard limit distinct values of a variable within cardinalityWindow, new
+// values are replaced by OverflowValue once the limit is reached.
+func (t *Template) guard(name, value string) string {
+	if t.maxCardinality <= 0 {
+		return value
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now := time.Now(); now.Sub(t.seenSince) >= cardinalityWindow {
+		t.seen = make(map[string]map[string]struct{})
+		t.seenSince = now
+	}
+	values, ok := t.seen[name]
+	if !ok {
+		values = make(map[string]struct{})
+		t.seen[name] = values
+	}
+	if _, ok = values[value]; ok {
+		return value
+	}
+	if len(values) >= t.maxCardinality {
+		return OverflowValue
+	}
+	values[value] = struct{}{}
+	return value
+}
+
+// RenderFile render file level variables left by Execute
+func RenderFile(s string, resolve Resolver) string {
+	var sb strings.Builder
+	for _, seg := range mustParse(s) {
+		if seg.name == "" {
+			sb.WriteString(seg.literal)
+			continue
+		}
+		v, ok := resolve(seg.name)
+		if !ok {
+			v = MissingValue
+		}
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
+
+// Sanitize make value safe to be used as a single path segment
+func Sanitize(s string) string {
+	b := []byte(strings.TrimSpace(s))
+	if len(b) > maxValueLength {
+		b = b[:maxValueLength]
+	}
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '=':
+		default:
+			b[i] = '_'
+		}
+	}
+	s = string(b)
+	if strings.Trim(s, ".") == "" {
+		// avoid `.` and `..`
+		return ""
+	}
+	return s
+}
+
+// isKnownVar report whether name is a variable or a joda format
+func isKnownVar(name string) bool {
+	if recordVars[name] || fileVars[name] || strings.HasPrefix(name, FieldPrefix) && len(name) > len(FieldPrefix) {
+		return true
+	}
+	letters := 0
+	for _, c := range name {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if !strings.ContainsRune(jodaLetters, c) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters > 0
+}
+
+func isDataVar(name string) bool {
+	switch name {
+	case "topic", "project", "logstore", "hostname":
+		return true
+	}
+	return strings.HasPrefix(name, FieldPrefix)
+}
+
+func parse(s string) ([]segment, error) {
+	if s == "" {
+		return nil, errors.New("key template must not been null")
+	}
+	var segments []segment
+	for len(s) > 0 {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			if strings.IndexByte(s, '}') >= 0 {
+				return nil, errors.New("key template: unexpected '}'")
+			}
+			segments = append(segments, segment{literal: s})
+			break
+		}
+		if start > 0 {
+			if strings.IndexByte(s[:start], '}') >= 0 {
+				return nil, errors.New("key template: unexpected '}'")
+			}
+			segments = append(segments, segment{literal: s[:start]})
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, errors.New("key template: unclosed '{'")
+		}
+		expr := s[start+1 : start+end]
+		if strings.IndexByte(expr, '{') >= 0 {
+			return nil, errors.New("key template: nested '{'")
+		}
+		seg := segment{name: strings.TrimSpace(expr)}
+		if i := strings.IndexByte(expr, '|'); i >= 0 {
+			seg.name = strings.TrimSpace(expr[:i])
+			seg.def = Sanitize(expr[i+1:])
+			seg.hasDef = true
+		}
+		if seg.name == "" {
+			return nil, errors.New("key template: empty variable")
+		}
+		segments = append(segments, seg)
+		s = s[start+end+1:]
+	}
+	return segments, nil
+}
+
+func mustParse(s string) []segment {
+	segments, err := parse(s)
+	if err != nil {
+		return []segment{{literal: s}}
+	}
+	return segments
+}
+
+// Prefix render s until the first variable which can not be resolved, so the
+// result is a listing prefix of all keys s could render.
+func Prefix(s string, resolve Resolver) string {
+	var sb strings.Builder
+	for _, seg := range mustParse(s) {
+		if seg.name == "" {
+			sb.WriteString(seg.literal)
+			continue
+		}
+		v, ok := resolve(seg.name)
+		if !ok {
+			break
+		}
+		if isDataVar(seg.name) {
+			v = Sanitize(v)
+		}
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
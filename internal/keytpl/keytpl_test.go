@@ -0,0 +1,194 @@
+package keytpl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrefix(t *testing.T) {
+	vars := map[string]string{
+		"topic":     "nginx access",
+		"logstore":  "../ls",
+		"partition": "2021/06/01",
+		"yyyy":      "2021",
+		"shard":     "1",
+	}
+	resolve := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{name: "literal", template: "archive/", expected: "archive/"},
+		{name: "all resolved", template: "{yyyy}/{partition}/{shard}-", expected: "2021/2021/06/01/1-"},
+		{name: "until unresolved", template: "{partition}/{hostname}/{shard}", expected: "2021/06/01/"},
+		{name: "unresolved first", template: "{hostname}/{partition}/", expected: ""},
+		{name: "unresolved with default", template: "{partition}/{field.app|none}/", expected: "2021/06/01/"},
+		{name: "data variables sanitized", template: "{topic}/{logstore}/", expected: "nginx_access/.._ls/"},
+		{name: "partition not sanitized", template: "{partition}", expected: "2021/06/01"},
+		{name: "invalid template", template: "{partition", expected: "{partition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Prefix(tt.template, resolve); got != tt.expected {
+				t.Errorf("prefix is %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "nginx-access_1.log", expected: "nginx-access_1.log"},
+		{value: "a/b", expected: "a_b"},
+		{value: `a\b`, expected: "a_b"},
+		{value: "..", expected: ""},
+		{value: ".", expected: ""},
+		{value: "../..", expected: ".._.."},
+		{value: " app ", expected: "app"},
+		{value: "a\x00b\nc\x7f", expected: "a_b_c_"},
+		{value: "日志", expected: "______"},
+		{value: strings.Repeat("a", maxValueLength+1), expected: strings.Repeat("a", maxValueLength)},
+	}
+	for _, tt := range tests {
+		if got := Sanitize(tt.value); got != tt.expected {
+			t.Errorf("sanitize %q got %q, expected %q", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	tpl, err := Parse("{project}/{logstore}/{field.app|none}/{field.env}/{yyyy}/{shard}-{seq}.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		vars     map[string]string
+		expected string
+	}{
+		{
+			name:     "resolved",
+			vars:     map[string]string{"project": "p", "logstore": "ls", "field.app": "web", "field.env": "prod", "yyyy": "2021", "shard": "1"},
+			expected: "p/ls/web/prod/2021/1-{seq}.json",
+		},
+		{
+			name:     "missing",
+			vars:     map[string]string{"project": "p", "logstore": "ls", "yyyy": "2021", "shard": "1"},
+			expected: "p/ls/none/_unknown/2021/1-{seq}.json",
+		},
+		{
+			name:     "data variables sanitized",
+			vars:     map[string]string{"project": "../..", "logstore": "..", "field.app": "a/b", "field.env": "\x00", "yyyy": "2021", "shard": "1"},
+			expected: ".._../_unknown/a_b/_/2021/1-{seq}.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tpl.Execute(func(name string) (string, bool) {
+				v, ok := tt.vars[name]
+				return v, ok
+			})
+			if got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	tpl, err := Parse("{field.app}/{shard}/{seq}", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute := func(app string) string {
+		return tpl.Execute(func(name string) (string, bool) {
+			if name == "shard" {
+				return "1", true
+			}
+			return app, true
+		})
+	}
+	for _, app := range []string{"a", "b", "a"} {
+		if got := execute(app); got != app+"/1/{seq}" {
+			t.Errorf("%s is rendered as %q", app, got)
+		}
+	}
+	if got := execute("c"); got != OverflowValue+"/1/{seq}" {
+		t.Errorf("value over the limit is rendered as %q", got)
+	}
+	if got := execute("b"); got != "b/1/{seq}" {
+		t.Errorf("seen value is rendered as %q after overflow", got)
+	}
+
+	// distinct values are forgotten after the window
+	tpl.seenSince = tpl.seenSince.Add(-cardinalityWindow)
+	if got := execute("c"); got != "c/1/{seq}" {
+		t.Errorf("value after the window is rendered as %q", got)
+	}
+	if got := execute("a"); got != "a/1/{seq}" {
+		t.Errorf("value after the window is rendered as %q", got)
+	}
+	if got := execute("b"); got != OverflowValue+"/1/{seq}" {
+		t.Errorf("value over the limit of the new window is rendered as %q", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		template      string
+		expectedError string
+	}{
+		{template: "{project}/{logstore}/{field.app|none}/dt={yyyy-MM-dd}/{hostname}-{shard}-{seq}.json"},
+		{template: "{logstore}/{shard}/{cursor_begin}-{cursor_end}.json"},
+		{template: "{hash}.json"},
+		{template: "", expectedError: "must not been null"},
+		{template: "{logstore}/{seqq}.json", expectedError: "unknown variable {seqq}"},
+		{template: "{logstore}/{yyyy-MM-dd-q}/{seq}.json", expectedError: "unknown variable {yyyy-MM-dd-q}"},
+		{template: "{field.}/{seq}.json", expectedError: "unknown variable {field.}"},
+		{template: "{seq}/{logstore}.json", expectedError: "file name must contain"},
+		{template: "{logstore}/{shard}.json", expectedError: "file name must contain"},
+		{template: "{logstore}/{seq", expectedError: "unclosed '{'"},
+		{template: "{logstore}}/{seq}", expectedError: "unexpected '}'"},
+		{template: "{ }/{seq}", expectedError: "empty variable"},
+		{template: "{logstore}/{cursor_begin}.json", expectedError: "{logstore} and {shard} are required"},
+		{template: "{shard}/{cursor_end}.json", expectedError: "{logstore} and {shard} are required"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.template, 0)
+		if tt.expectedError == "" {
+			if err != nil {
+				t.Errorf("parse %q: %v", tt.template, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+			t.Errorf("parse %q expected error %q, got %v", tt.template, tt.expectedError, err)
+		}
+	}
+
+	tpl, err := Parse("{logstore}/{shard}/{cursor_begin}.json", 0)
+	if err != nil || !tpl.Cursors() {
+		t.Errorf("template of cursors: %v", err)
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	s := "ls/1/" + CursorPlaceholder(CursorBeginVar, "abc") + "-" + CursorPlaceholder(CursorEndVar, "abc") + "-" + HashPlaceholder("abc") + ".json"
+	if !HasCursorPlaceholder(s) || !HasHashPlaceholder(s) {
+		t.Fatalf("placeholders of %q are not found", s)
+	}
+	s = ReplaceHashPlaceholder(ReplaceCursorPlaceholders(s, "100", "110"), "sum")
+	if s != "ls/1/100-110-sum.json" {
+		t.Errorf("got %q", s)
+	}
+	if HasCursorPlaceholder(s) || HasHashPlaceholder(s) {
+		t.Errorf("placeholders are left in %q", s)
+	}
+}
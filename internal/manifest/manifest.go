@@ -0,0 +1,395 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/partition"
+)
+
+const (
+	// JournalDir is where entries of unfinished partitions are kept, relative to temp dir
+	JournalDir = ".manifest"
+	journalExt = ".ndjson"
+
+	checkInterval = 30 * time.Second
+
+	maxConflicts    = 10
+	conflictBackoff = 100 * time.Millisecond
+)
+
+// Entry describe an uploaded object
+type Entry struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	Records    int       `json:"records"`
+	MinTime    time.Time `json:"min_time"`
+	MaxTime    time.Time `json:"max_time"`
+	CRC64      string    `json:"crc64"`
+	MD5        string    `json:"md5,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	// sources of records, kept for metadata of compacted objects
+	Logstores []string `json:"logstores,omitempty"`
+	Shards    []int    `json:"shards,omitempty"`
+}
+
+// Manifest list objects of a partition
+type Manifest struct {
+	Partition string    `json:"partition"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Watermark time.Time `json:"watermark"`
+	Records   int       `json:"records"`
+	Objects   []Entry   `json:"objects"`
+	// Replaced are objects merged by compaction and pending deletion
+	Replaced []string `json:"replaced,omitempty"`
+}
+
+// Merge add entries into m, entries with the same key are replaced
+func (m *Manifest) Merge(entries ...Entry) {
+	idx := make(map[string]int, len(m.Objects))
+	for i, e := range m.Objects {
+		idx[e.Key] = i
+	}
+	for _, e := range entries {
+		if i, ok := idx[e.Key]; ok {
+			m.Objects[i] = e
+			continue
+		}
+		idx[e.Key] = len(m.Objects)
+		m.Objects = append(m.Objects, e)
+	}
+	sort.Slice(m.Objects, func(i, j int) bool { return m.Objects[i].Key < m.Objects[j].Key })
+	m.Records = 0
+	for _, e := range m.Objects {
+		m.Records += e.Records
+	}
+}
+
+// Remove delete entries of keys from m
+func (m *Manifest) Remove(keys ...string) {
+	removed := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		removed[key] = struct{}{}
+	}
+	objects := m.Objects[:0]
+	for _, e := range m.Objects {
+		if _, ok := removed[e.Key]; ok {
+			m.Records -= e.Records
+			continue
+		}
+		objects = append(objects, e)
+	}
+	m.Objects = objects
+}
+
+// Lists report whether every key is listed in m
+func (m *Manifest) Lists(keys ...string) bool {
+	listed := make(map[string]struct{}, len(m.Objects))
+	for _, e := range m.Objects {
+		listed[e.Key] = struct{}{}
+	}
+	for _, key := range keys {
+		if _, ok := listed[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrConflict is returned by Update if the manifest keeps being rewritten by others
+var ErrConflict = errors.New("manifest keeps being rewritten, too many conflicts")
+
+// Update read manifest object key, pass it to fn and write back what fn
+// returns, nil is passed if the object does not exist and nothing is written
+// if fn returns nil. Recorders and compactors of any process rewrite the same
+// manifests, so the write is conditional on the ETag read, or on absence of
+// the object, and retried with a fresh read on conflict, fn may be called
+// more than once. The manifest written is returned.
+func Update(bucket *oss.Bucket, key string, fn func(*Manifest) (*Manifest, error)) (*Manifest, error) {
+	for i := 0; i < maxConflicts; i++ {
+		m, etag, err := get(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		if m, err = fn(m); err != nil || m == nil {
+			return nil, err
+		}
+		cond := oss.ForbidOverWrite(true)
+		if etag != "" {
+			cond = oss.IfMatch(etag)
+		}
+		if err = put(bucket, key, m, cond); !isConflict(err) {
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		}
+		// jitter keeps processes conflicting on the same manifest apart
+		time.Sleep(time.Duration(i+1)*conflictBackoff + time.Duration(rand.Int63n(int64(conflictBackoff))))
+	}
+	return nil, ErrConflict
+}
+
+// isConflict report whether a conditional write failed as the object changed
+func isConflict(err error) bool {
+	serr, ok := err.(oss.ServiceError)
+	return ok && (serr.StatusCode == http.StatusPreconditionFailed || serr.StatusCode == http.StatusConflict)
+}
+
+// Get download manifest object, nil without error if it does not exist
+func Get(bucket *oss.Bucket, key string) (*Manifest, error) {
+	m, _, err := get(bucket, key)
+	return m, err
+}
+
+// get download manifest object with its ETag
+func get(bucket *oss.Bucket, key string) (*Manifest, string, error) {
+	var header http.Header
+	body, err := bucket.GetObject(key, oss.GetResponseHeader(&header))
+	if err != nil {
+		if serr, ok := err.(oss.ServiceError); ok && serr.StatusCode == http.StatusNotFound {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer body.Close()
+	m := &Manifest{}
+	if err = json.NewDecoder(body).Decode(m); err != nil {
+		return nil, "", err
+	}
+	return m, header.Get(oss.HTTPHeaderEtag), nil
+}
+
+func put(bucket *oss.Bucket, key string, m *Manifest, options ...oss.Option) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return bucket.PutObject(key, bytes.NewReader(data), append(options, oss.ContentType("application/json"))...)
+}
+
+// Recorder collect uploaded objects by partition, and write manifest and
+// success marker of a partition once watermark passes its end plus grace.
+type Recorder struct {
+	cfg    *config.Manifest
+	layout *partition.Layout
+	bucket *oss.Bucket
+	dir    string
+	logger log.Logger
+
+	mu         sync.Mutex
+	partitions map[string]*state
+}
+
+// state of an unfinished partition
+type state struct {
+	start   time.Time
+	end     time.Time
+	entries []Entry
+}
+
+// New create recorder keeping journals in dir, entries left by previous runs are loaded
+func New(cfg *config.Manifest, layout *partition.Layout, bucket *oss.Bucket, dir string, logger log.Logger) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		cfg:        cfg,
+		layout:     layout,
+		bucket:     bucket,
+		dir:        dir,
+		logger:     logger,
+		partitions: make(map[string]*state),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+journalExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range files {
+		if err = r.load(fn); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Partition return partition of object key, which is its directory
+func Partition(key string) string {
+	return path.Dir(key)
+}
+
+// Add record an uploaded object
+func (r *Recorder) Add(e Entry) error {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fp, err := os.OpenFile(r.journal(Partition(e.Key)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err = fp.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	r.add(e)
+	return nil
+}
+
+func (r *Recorder) add(e Entry) {
+	p := Partition(e.Key)
+	start, _ := r.layout.Period(e.MinTime)
+	_, end := r.layout.Period(e.MaxTime)
+	s, ok := r.partitions[p]
+	if !ok {
+		s = &state{start: start, end: end}
+		r.partitions[p] = s
+	}
+	if start.Before(s.start) {
+		s.start = start
+	}
+	if end.After(s.end) {
+		s.end = end
+	}
+	s.entries = append(s.entries, e)
+}
+
+func (r *Recorder) journal(p string) string {
+	return filepath.Join(r.dir, url.PathEscape(p)+journalExt)
+}
+
+func (r *Recorder) load(fn string) error {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var e Entry
+		// skip line truncated by crash
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Key != "" {
+			r.add(e)
+		}
+	}
+	return scanner.Err()
+}
+
+// Run finish partitions periodically until quit, busy report whether files
+// of a partition are still open or being uploaded.
+func (r *Recorder) Run(quit <-chan struct{}, watermark func() (time.Time, bool), busy func(string) bool) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wm, ok := watermark()
+			if !ok {
+				continue
+			}
+			for _, p := range r.Ready(wm) {
+				if busy(p) {
+					continue
+				}
+				if err := r.Finish(p, wm); err != nil {
+					level.Error(r.logger).Log("msg", "finish partition", "partition", p, "err", err)
+				}
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Ready return partitions whose end plus grace is passed by watermark
+func (r *Recorder) Ready(watermark time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ps []string
+	for p, s := range r.partitions {
+		if !watermark.Before(s.end.Add(time.Duration(r.cfg.Grace))) {
+			ps = append(ps, p)
+		}
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+// Finish merge entries of partition into its manifest object and write the success marker
+func (r *Recorder) Finish(p string, watermark time.Time) error {
+	r.mu.Lock()
+	s, ok := r.partitions[p]
+	if !ok {
+		r.mu.Unlock()
+		return nil
+	}
+	entries := append([]Entry(nil), s.entries...)
+	start, end := s.start, s.end
+	r.mu.Unlock()
+
+	m, err := Update(r.bucket, path.Join(p, r.cfg.Name), func(m *Manifest) (*Manifest, error) {
+		if m == nil {
+			m = &Manifest{Partition: p, Start: start, End: end}
+		}
+		if m.Start.IsZero() || start.Before(m.Start) {
+			m.Start = start
+		}
+		if end.After(m.End) {
+			m.End = end
+		}
+		m.Watermark = watermark
+		m.Merge(entries...)
+		return m, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = r.bucket.PutObject(path.Join(p, r.cfg.SuccessMarker), strings.NewReader("")); err != nil {
+		return err
+	}
+	level.Info(r.logger).Log("msg", "partition finished", "partition", p, "objects", len(m.Objects), "records", m.Records)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// entries added while finishing stay for the next round
+	if s = r.partitions[p]; len(s.entries) > len(entries) {
+		s.entries = s.entries[len(entries):]
+		return r.rewrite(p, s.entries)
+	}
+	delete(r.partitions, p)
+	return os.Remove(r.journal(p))
+}
+
+func (r *Recorder) rewrite(p string, entries []Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		data, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return ioutil.WriteFile(r.journal(p), buf.Bytes(), 0644)
+}
@@ -38,10 +38,131 @@ var (
 			Help:      "total bytes write out",
 		}, []string{"logstore", "to", "type"},
 	)
+	PipelineDeadLetterTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "pipeline",
+			Name:      "dead_letter_total",
+			Help:      "total records sent to dead letter",
+		}, []string{"logstore", "stage"},
+	)
+	PipelineEventSkippedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "pipeline",
+			Name:      "event_skipped_total",
+			Help:      "total records skipped, by reason",
+		}, []string{"logstore", "reason"},
+	)
+	PipelineLateRecordsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "pipeline",
+			Name:      "late_records_total",
+			Help:      "total records of partitions already closed by watermark",
+		}, []string{"logstore"},
+	)
+	PipelineWorkerQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "pipeline",
+			Name:      "worker_queue_depth",
+			Help:      "batches waiting in channel of handler worker",
+		}, []string{"worker"},
+	)
+	ConsumerLagLogGroups = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "consumer",
+			Name:      "lag_loggroups",
+			Help:      "log groups between checkpoint and end cursor of shard",
+		}, []string{"logstore", "shard"},
+	)
+	ConsumerLastEventAgeSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "consumer",
+			Name:      "last_event_age_seconds",
+			Help:      "age of event time of the last record consumed from shard",
+		}, []string{"logstore", "shard"},
+	)
+	ConsumerWatermarkTimestampSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "consumer",
+			Name:      "watermark_timestamp_seconds",
+			Help:      "event-time watermark of shard in unix seconds",
+		}, []string{"logstore", "shard"},
+	)
+	WriterOpenFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "writer",
+			Name:      "open_files",
+			Help:      "number of rotate writers",
+		},
+	)
+	WriterTempDirBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "writer",
+			Name:      "temp_dir_bytes",
+			Help:      "total size of files in temp dir",
+		},
+	)
+	WriterGzipDurationSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "writer",
+			Name:      "gzip_duration_seconds",
+			Help:      "time spent on compressing files",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+	)
+	OssUploadDurationSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "oss",
+			Name:      "upload_duration_seconds",
+			Help:      "time spent on uploading objects",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		},
+	)
+	OssObjectSizeBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "oss",
+			Name:      "object_size_bytes",
+			Help:      "size of uploaded objects",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		},
+	)
+	OssUploadFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "oss",
+			Name:      "upload_failures_total",
+			Help:      "total upload failures, by reason",
+		}, []string{"reason"},
+	)
+	OssChecksumVerificationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "oss",
+			Name:      "checksum_verifications_total",
+			Help:      "total checksum verifications of uploads, by result match/mismatch/unverified",
+		}, []string{"result"},
+	)
 )
 
 func init() {
-	prometheus.MustRegister(PipelineEventInTotal, PipelineEventOutTotal, PipelineWriteBytesTotal)
+	prometheus.MustRegister(
+		PipelineEventInTotal, PipelineEventOutTotal, PipelineWriteBytesTotal, PipelineDeadLetterTotal,
+		PipelineEventSkippedTotal, PipelineLateRecordsTotal, PipelineWorkerQueueDepth,
+		ConsumerLagLogGroups, ConsumerLastEventAgeSeconds, ConsumerWatermarkTimestampSeconds,
+		WriterOpenFiles, WriterTempDirBytes, WriterGzipDurationSeconds,
+		OssUploadDurationSeconds, OssObjectSizeBytes, OssUploadFailuresTotal, OssChecksumVerificationsTotal,
+	)
 }
 
 func Serve(port int, metricPath string, logger log.Logger, quit <-chan struct{}) error {
@@ -0,0 +1,210 @@
+package partition
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vjeantet/jodaTime"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+const (
+	StyleJoda = "joda"
+	StyleHive = "hive"
+
+	DefaultFormat = "yyyy/MM/dd/HH"
+)
+
+var defaultHiveFields = []*config.HiveField{
+	{Name: "dt", Format: "yyyy-MM-dd"},
+	{Name: "hour", Format: "HH"},
+}
+
+// Layout turns event time into partition paths of objects
+type Layout struct {
+	style  string
+	format string
+	fields []*config.HiveField
+	loc    *time.Location
+}
+
+func New(cfg *config.Partition) (*Layout, error) {
+	l := &Layout{
+		style:  strings.ToLower(cfg.Style),
+		format: cfg.Format,
+		fields: cfg.HiveFields,
+		loc:    time.Local,
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition timezone: %v", err)
+		}
+		l.loc = loc
+	}
+	switch l.style {
+	case "", StyleJoda:
+		l.style = StyleJoda
+		if l.format == "" {
+			l.format = DefaultFormat
+		}
+	case StyleHive:
+		if len(l.fields) == 0 {
+			l.fields = defaultHiveFields
+		}
+		for _, f := range l.fields {
+			if f.Name == "" || f.Format == "" {
+				return nil, fmt.Errorf("hive partition field requires both name and format")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown partition style %q", cfg.Style)
+	}
+	return l, nil
+}
+
+// Format return partition path of t, eg. 2024/01/01/13 or dt=2024-01-01/hour=13
+func (l *Layout) Format(t time.Time) string {
+	t = t.In(l.loc)
+	if l.style == StyleJoda {
+		return jodaTime.Format(l.format, t)
+	}
+	parts := make([]string, len(l.fields))
+	for i, f := range l.fields {
+		parts[i] = f.Name + "=" + jodaTime.Format(f.Format, t)
+	}
+	return path.Join(parts...)
+}
+
+func (l *Layout) Location() *time.Location {
+	return l.loc
+}
+
+// time units of partitions, from the finest
+const (
+	unitSecond = iota
+	unitMinute
+	unitHour
+	unitDay
+	unitWeek
+	unitMonth
+	unitYear
+)
+
+// Period return time range [start, end) of the partition t belongs to
+func (l *Layout) Period(t time.Time) (start, end time.Time) {
+	t = t.In(l.loc)
+	unit := unitYear
+	if l.style == StyleJoda {
+		unit = finestUnit(l.format)
+	} else {
+		for _, f := range l.fields {
+			if u := finestUnit(f.Format); u < unit {
+				unit = u
+			}
+		}
+	}
+	// sub-day periods are cut from t itself, as the wall clock of a period
+	// is ambiguous when daylight saving time ends
+	sub := time.Duration(t.Nanosecond())
+	switch unit {
+	case unitSecond:
+		start = t.Add(-sub)
+		return start, start.Add(time.Second)
+	case unitMinute:
+		start = t.Add(-sub - time.Duration(t.Second())*time.Second)
+		return start, start.Add(time.Minute)
+	case unitHour:
+		start = t.Add(-sub - time.Duration(t.Second())*time.Second - time.Duration(t.Minute())*time.Minute)
+		return start, start.Add(time.Hour)
+	}
+	y, m, d := t.Date()
+	switch unit {
+	case unitDay:
+		start = time.Date(y, m, d, 0, 0, 0, 0, l.loc)
+		return start, start.AddDate(0, 0, 1)
+	case unitWeek:
+		// weeks of joda start on monday
+		start = time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, l.loc)
+		return start, start.AddDate(0, 0, 7)
+	case unitMonth:
+		start = time.Date(y, m, 1, 0, 0, 0, 0, l.loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = time.Date(y, 1, 1, 0, 0, 0, 0, l.loc)
+	return start, start.AddDate(1, 0, 0)
+}
+
+// finestUnit return the finest time unit of joda format, quoted literals are skipped
+func finestUnit(format string) int {
+	unit := unitYear
+	quoted := false
+	for _, c := range format {
+		if c == '\'' {
+			quoted = !quoted
+			continue
+		}
+		if quoted {
+			continue
+		}
+		u := unitYear
+		switch c {
+		case 's', 'S':
+			u = unitSecond
+		case 'm':
+			u = unitMinute
+		case 'H', 'h', 'k', 'K':
+			u = unitHour
+		case 'd', 'D', 'e', 'E':
+			u = unitDay
+		case 'w':
+			u = unitWeek
+		case 'M':
+			u = unitMonth
+		}
+		if u < unit {
+			unit = u
+		}
+	}
+	return unit
+}
+
+// Depth return number of path segments of partitions
+func (l *Layout) Depth() int {
+	return strings.Count(l.Format(time.Now()), "/") + 1
+}
+
+// Parse return start time of partition path made by Format
+func (l *Layout) Parse(p string) (time.Time, error) {
+	p = strings.Trim(p, "/")
+	if l.style == StyleJoda {
+		t, err := jodaTime.ParseInLocation(l.format, p, l.loc.String())
+		if err != nil {
+			return t, err
+		}
+		start, _ := l.Period(t)
+		return start, nil
+	}
+	parts := strings.Split(p, "/")
+	if len(parts) != len(l.fields) {
+		return time.Time{}, fmt.Errorf("partition %q does not match hive fields", p)
+	}
+	formats := make([]string, len(parts))
+	values := make([]string, len(parts))
+	for i, f := range l.fields {
+		if !strings.HasPrefix(parts[i], f.Name+"=") {
+			return time.Time{}, fmt.Errorf("partition %q does not match hive field %s", p, f.Name)
+		}
+		formats[i] = f.Format
+		values[i] = strings.TrimPrefix(parts[i], f.Name+"=")
+	}
+	t, err := jodaTime.ParseInLocation(strings.Join(formats, " "), strings.Join(values, " "), l.loc.String())
+	if err != nil {
+		return t, err
+	}
+	start, _ := l.Period(t)
+	return start, nil
+}
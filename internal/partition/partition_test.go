@@ -0,0 +1,267 @@
+package partition
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+func mustLayout(t *testing.T, cfg *config.Partition) *Layout {
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skip(err)
+	}
+	return loc
+}
+
+func TestFormat(t *testing.T) {
+	ts := time.Date(2021, 6, 1, 17, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		cfg      config.Partition
+		expected string
+	}{
+		{name: "joda default", cfg: config.Partition{Timezone: "UTC"}, expected: "2021/06/01/17"},
+		{name: "joda format", cfg: config.Partition{Format: "yyyy-MM-dd", Timezone: "UTC"}, expected: "2021-06-01"},
+		{name: "joda quoted", cfg: config.Partition{Format: "'year='yyyy/'month='MM", Timezone: "UTC"}, expected: "year=2021/month=06"},
+		{name: "hive default", cfg: config.Partition{Style: "hive", Timezone: "UTC"}, expected: "dt=2021-06-01/hour=17"},
+		{name: "hive fields", cfg: config.Partition{Style: "HIVE", Timezone: "UTC", HiveFields: []*config.HiveField{{Name: "y", Format: "yyyy"}, {Name: "m", Format: "MM"}}}, expected: "y=2021/m=06"},
+		{name: "timezone", cfg: config.Partition{Timezone: "Asia/Shanghai"}, expected: "2021/06/02/01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if got := mustLayout(t, &cfg).Format(ts); got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewError(t *testing.T) {
+	tests := []config.Partition{
+		{Style: "daily"},
+		{Timezone: "Mars/Olympus"},
+		{Style: "hive", HiveFields: []*config.HiveField{{Name: "dt"}}},
+	}
+	for _, cfg := range tests {
+		cfg := cfg
+		if _, err := New(&cfg); err == nil {
+			t.Errorf("%+v is accepted", cfg)
+		}
+	}
+}
+
+func TestFinestUnit(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected int
+	}{
+		{format: "yyyy", expected: unitYear},
+		{format: "yyyy/MM", expected: unitMonth},
+		{format: "xxxx/ww", expected: unitWeek},
+		{format: "yyyy/MM/dd", expected: unitDay},
+		{format: "yyyy/DDD", expected: unitDay},
+		{format: "yyyy/MM/dd/HH", expected: unitHour},
+		{format: "yyyy/MM/dd/hh a", expected: unitHour},
+		{format: "yyyy/MM/dd/HH/mm", expected: unitMinute},
+		{format: "yyyyMMddHHmmss", expected: unitSecond},
+		{format: "'hour'/yyyy/MM", expected: unitMonth},
+		{format: "'day=''s'/yyyy", expected: unitYear},
+	}
+	for _, tt := range tests {
+		if got := finestUnit(tt.format); got != tt.expected {
+			t.Errorf("finest unit of %s is %d, expected %d", tt.format, got, tt.expected)
+		}
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	utc := time.UTC
+	shanghai := mustLocation(t, "Asia/Shanghai")
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		name          string
+		cfg           config.Partition
+		t             time.Time
+		expectedStart time.Time
+		expectedEnd   time.Time
+	}{
+		{
+			name:          "second",
+			cfg:           config.Partition{Format: "yyyyMMddHHmmss", Timezone: "UTC"},
+			t:             time.Date(2021, 6, 1, 17, 4, 5, 999, utc),
+			expectedStart: time.Date(2021, 6, 1, 17, 4, 5, 0, utc),
+			expectedEnd:   time.Date(2021, 6, 1, 17, 4, 6, 0, utc),
+		},
+		{
+			name:          "minute",
+			cfg:           config.Partition{Format: "yyyy/MM/dd/HH/mm", Timezone: "UTC"},
+			t:             time.Date(2021, 6, 1, 17, 4, 5, 0, utc),
+			expectedStart: time.Date(2021, 6, 1, 17, 4, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 6, 1, 17, 5, 0, 0, utc),
+		},
+		{
+			name:          "hour at start",
+			cfg:           config.Partition{Timezone: "UTC"},
+			t:             time.Date(2021, 6, 1, 17, 0, 0, 0, utc),
+			expectedStart: time.Date(2021, 6, 1, 17, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 6, 1, 18, 0, 0, 0, utc),
+		},
+		{
+			name:          "hour before end",
+			cfg:           config.Partition{Timezone: "UTC"},
+			t:             time.Date(2021, 6, 1, 17, 59, 59, 999999999, utc),
+			expectedStart: time.Date(2021, 6, 1, 17, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 6, 1, 18, 0, 0, 0, utc),
+		},
+		{
+			name:          "day of timezone",
+			cfg:           config.Partition{Format: "yyyy/MM/dd", Timezone: "Asia/Shanghai"},
+			t:             time.Date(2021, 6, 1, 17, 0, 0, 0, utc),
+			expectedStart: time.Date(2021, 6, 2, 0, 0, 0, 0, shanghai),
+			expectedEnd:   time.Date(2021, 6, 3, 0, 0, 0, 0, shanghai),
+		},
+		{
+			name:          "week starts on monday",
+			cfg:           config.Partition{Format: "xxxx/ww", Timezone: "UTC"},
+			t:             time.Date(2021, 6, 6, 23, 0, 0, 0, utc), // sunday
+			expectedStart: time.Date(2021, 5, 31, 0, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 6, 7, 0, 0, 0, 0, utc),
+		},
+		{
+			name:          "month",
+			cfg:           config.Partition{Format: "yyyy/MM", Timezone: "UTC"},
+			t:             time.Date(2021, 2, 28, 23, 0, 0, 0, utc),
+			expectedStart: time.Date(2021, 2, 1, 0, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 3, 1, 0, 0, 0, 0, utc),
+		},
+		{
+			name:          "year",
+			cfg:           config.Partition{Format: "yyyy", Timezone: "UTC"},
+			t:             time.Date(2021, 12, 31, 23, 59, 59, 0, utc),
+			expectedStart: time.Date(2021, 1, 1, 0, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2022, 1, 1, 0, 0, 0, 0, utc),
+		},
+		{
+			name:          "hive takes the finest field",
+			cfg:           config.Partition{Style: "hive", Timezone: "UTC"},
+			t:             time.Date(2021, 6, 1, 17, 4, 5, 0, utc),
+			expectedStart: time.Date(2021, 6, 1, 17, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 6, 1, 18, 0, 0, 0, utc),
+		},
+		{
+			// 2021-03-14 02:00 EST is 03:00 EDT
+			name:          "day of spring forward",
+			cfg:           config.Partition{Format: "yyyy/MM/dd", Timezone: "America/New_York"},
+			t:             time.Date(2021, 3, 14, 12, 0, 0, 0, newYork),
+			expectedStart: time.Date(2021, 3, 14, 5, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 3, 15, 4, 0, 0, 0, utc),
+		},
+		{
+			name:          "hour before spring forward",
+			cfg:           config.Partition{Timezone: "America/New_York"},
+			t:             time.Date(2021, 3, 14, 6, 30, 0, 0, utc), // 01:30 EST
+			expectedStart: time.Date(2021, 3, 14, 6, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 3, 14, 7, 0, 0, 0, utc), // 03:00 EDT
+		},
+		{
+			// 2021-11-07 02:00 EDT is 01:00 EST, 01:xx happens twice
+			name:          "day of fall back",
+			cfg:           config.Partition{Format: "yyyy/MM/dd", Timezone: "America/New_York"},
+			t:             time.Date(2021, 11, 7, 12, 0, 0, 0, newYork),
+			expectedStart: time.Date(2021, 11, 7, 4, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 11, 8, 5, 0, 0, 0, utc),
+		},
+		{
+			name:          "first hour of fall back",
+			cfg:           config.Partition{Timezone: "America/New_York"},
+			t:             time.Date(2021, 11, 7, 5, 30, 0, 0, utc), // 01:30 EDT
+			expectedStart: time.Date(2021, 11, 7, 5, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 11, 7, 6, 0, 0, 0, utc),
+		},
+		{
+			name:          "second hour of fall back",
+			cfg:           config.Partition{Timezone: "America/New_York"},
+			t:             time.Date(2021, 11, 7, 6, 30, 0, 0, utc), // 01:30 EST
+			expectedStart: time.Date(2021, 11, 7, 6, 0, 0, 0, utc),
+			expectedEnd:   time.Date(2021, 11, 7, 7, 0, 0, 0, utc),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			start, end := mustLayout(t, &cfg).Period(tt.t)
+			if !start.Equal(tt.expectedStart) || !end.Equal(tt.expectedEnd) {
+				t.Errorf("period is [%v, %v), expected [%v, %v)", start, end, tt.expectedStart, tt.expectedEnd)
+			}
+			if tt.t.Before(start) || !tt.t.Before(end) {
+				t.Errorf("%v is out of its period [%v, %v)", tt.t, start, end)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Partition
+	}{
+		{name: "joda hour", cfg: config.Partition{Timezone: "UTC"}},
+		{name: "joda day", cfg: config.Partition{Format: "yyyy/MM/dd", Timezone: "Asia/Shanghai"}},
+		{name: "joda quoted", cfg: config.Partition{Format: "'year='yyyy/'month='MM", Timezone: "UTC"}},
+		{name: "hive", cfg: config.Partition{Style: "hive", Timezone: "Asia/Shanghai"}},
+		{name: "hive minute", cfg: config.Partition{Style: "hive", Timezone: "UTC", HiveFields: []*config.HiveField{{Name: "dt", Format: "yyyyMMdd"}, {Name: "hm", Format: "HHmm"}}}},
+	}
+	ts := time.Date(2021, 6, 1, 17, 4, 5, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			l := mustLayout(t, &cfg)
+			start, _ := l.Period(ts)
+			for _, p := range []string{l.Format(ts), "/" + l.Format(ts) + "/"} {
+				got, err := l.Parse(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !got.Equal(start) {
+					t.Errorf("parse %s got %v, expected %v", p, got, start)
+				}
+			}
+		})
+	}
+
+	hive := mustLayout(t, &config.Partition{Style: "hive", Timezone: "UTC"})
+	for _, p := range []string{"dt=2021-06-01", "hour=17/dt=2021-06-01", "dt=2021-06-01/hour=xx"} {
+		if _, err := hive.Parse(p); err == nil {
+			t.Errorf("%s is parsed", p)
+		}
+	}
+}
+
+func TestDepth(t *testing.T) {
+	tests := []struct {
+		cfg      config.Partition
+		expected int
+	}{
+		{cfg: config.Partition{}, expected: 4},
+		{cfg: config.Partition{Format: "yyyy-MM-dd"}, expected: 1},
+		{cfg: config.Partition{Style: "hive"}, expected: 2},
+		{cfg: config.Partition{Style: "hive", HiveFields: []*config.HiveField{{Name: "y", Format: "yyyy"}, {Name: "m", Format: "MM"}, {Name: "d", Format: "dd"}}}, expected: 3},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		if got := mustLayout(t, &cfg).Depth(); got != tt.expected {
+			t.Errorf("depth of %+v is %d, expected %d", tt.cfg, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a filter of records, eg.
+//
+//	status >= 500 and (path =~ "^/api" or not exists(user.id))
+//
+// Operators are == != =~ !~ > >= < <= and contains, combined by and/or/not.
+// A field alone matches records where it's present and not empty.
+type Expr interface {
+	Match(rec map[string]interface{}) bool
+}
+
+// Parse compile expression, empty expression matches all records
+func Parse(s string) (Expr, error) {
+	p := &parser{}
+	if err := p.tokenize(s); err != nil {
+		return nil, err
+	}
+	if len(p.tokens) == 0 {
+		return matchAll{}, nil
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+// Lookup return value of field, keys containing dots are tried before nested fields
+func Lookup(rec map[string]interface{}, field string) (interface{}, bool) {
+	if v, ok := rec[field]; ok {
+		return v, true
+	}
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) < 2 {
+		return nil, false
+	}
+	child, ok := rec[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return Lookup(child, parts[1])
+}
+
+type matchAll struct{}
+
+func (matchAll) Match(map[string]interface{}) bool { return true }
+
+type and struct{ left, right Expr }
+
+func (e and) Match(rec map[string]interface{}) bool { return e.left.Match(rec) && e.right.Match(rec) }
+
+type or struct{ left, right Expr }
+
+func (e or) Match(rec map[string]interface{}) bool { return e.left.Match(rec) || e.right.Match(rec) }
+
+type not struct{ expr Expr }
+
+func (e not) Match(rec map[string]interface{}) bool { return !e.expr.Match(rec) }
+
+type exists struct{ field string }
+
+func (e exists) Match(rec map[string]interface{}) bool {
+	v, ok := Lookup(rec, e.field)
+	return ok && v != nil && v != ""
+}
+
+type compare struct {
+	field  string
+	op     string
+	value  string
+	number float64
+	isNum  bool
+	re     *regexp.Regexp
+}
+
+func (e *compare) Match(rec map[string]interface{}) bool {
+	v, ok := Lookup(rec, e.field)
+	if !ok {
+		// missing fields only match negative operators
+		return e.op == "!=" || e.op == "!~"
+	}
+	s := toString(v)
+	switch e.op {
+	case "=~":
+		return e.re.MatchString(s)
+	case "!~":
+		return !e.re.MatchString(s)
+	case "contains":
+		return strings.Contains(s, e.value)
+	}
+	if e.isNum {
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return compareNumbers(n, e.number, e.op)
+		}
+	}
+	switch e.op {
+	case "==":
+		return s == e.value
+	case "!=":
+		return s != e.value
+	case ">":
+		return s > e.value
+	case ">=":
+		return s >= e.value
+	case "<":
+		return s < e.value
+	case "<=":
+		return s <= e.value
+	}
+	return false
+}
+
+func compareNumbers(a, b float64, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+const (
+	tokIdent = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+var operators = []string{"==", "!=", "=~", "!~", ">=", "<=", "&&", "||", ">", "<", "!"}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.@:-*/", r)
+}
+
+func (p *parser) tokenize(s string) error {
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			p.tokens = append(p.tokens, token{tokLParen, "("})
+			i++
+		case r == ')':
+			p.tokens = append(p.tokens, token{tokRParen, ")"})
+			i++
+		case r == '"' || r == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return fmt.Errorf("unterminated string at %d", i)
+			}
+			p.tokens = append(p.tokens, token{tokString, sb.String()})
+			i = j + 1
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(rs[i:]), op) {
+					p.tokens = append(p.tokens, token{tokOp, op})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if matched {
+				continue
+			}
+			if !isIdentRune(r) {
+				return fmt.Errorf("unexpected %q at %d", r, i)
+			}
+			j := i
+			for j < len(rs) && isIdentRune(rs[j]) {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokIdent, string(rs[i:j])})
+			i = j
+		}
+	}
+	return nil
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword report whether next token is one of words, and consume it if so
+func (p *parser) keyword(words ...string) bool {
+	t, ok := p.peek()
+	if !ok {
+		return false
+	}
+	for _, w := range words {
+		if (t.kind == tokIdent && strings.EqualFold(t.text, w)) || (t.kind == tokOp && t.text == w) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and", "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.keyword("not", "!") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not{e}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	switch {
+	case t.kind == tokLParen:
+		p.pos++
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok = p.peek(); !ok || t.kind != tokRParen {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "exists"):
+		p.pos++
+		if t, ok = p.peek(); !ok || t.kind != tokLParen {
+			return nil, fmt.Errorf("exists requires (field)")
+		}
+		p.pos++
+		field, ok := p.peek()
+		if !ok || field.kind != tokIdent {
+			return nil, fmt.Errorf("exists requires (field)")
+		}
+		p.pos++
+		if t, ok = p.peek(); !ok || t.kind != tokRParen {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return exists{field.text}, nil
+	case t.kind == tokIdent || t.kind == tokString:
+		p.pos++
+		return p.parseCompare(t.text)
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *parser) parseCompare(field string) (Expr, error) {
+	t, ok := p.peek()
+	if !ok || !(t.kind == tokOp || (t.kind == tokIdent && strings.EqualFold(t.text, "contains"))) || t.text == "&&" || t.text == "||" || t.text == "!" {
+		return exists{field}, nil
+	}
+	p.pos++
+	op := strings.ToLower(t.text)
+	v, ok := p.peek()
+	if !ok || (v.kind != tokIdent && v.kind != tokString) {
+		return nil, fmt.Errorf("%s %s requires a value", field, op)
+	}
+	p.pos++
+	c := &compare{field: field, op: op, value: v.text}
+	switch op {
+	case "=~", "!~":
+		re, err := regexp.Compile(v.text)
+		if err != nil {
+			return nil, err
+		}
+		c.re = re
+	default:
+		if v.kind == tokIdent {
+			if n, err := strconv.ParseFloat(v.text, 64); err == nil {
+				c.number, c.isNum = n, true
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	rec := make(map[string]interface{})
+	if err := dec.Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		record   string
+		expected bool
+	}{
+		{name: "empty matches all", expr: "", record: `{}`, expected: true},
+
+		// and binds tighter than or, not tighter than and
+		{name: "or of and", expr: "a == 1 or b == 1 and c == 1", record: `{"a":1}`, expected: true},
+		{name: "and of or", expr: "a == 1 or b == 1 and c == 1", record: `{"b":1}`, expected: false},
+		{name: "parentheses", expr: "(a == 1 or b == 1) and c == 1", record: `{"a":1}`, expected: false},
+		{name: "symbols", expr: "a == 1 || b == 1 && c == 1", record: `{"b":1,"c":1}`, expected: true},
+		{name: "not before and", expr: "not a == 1 and b == 1", record: `{"a":2,"b":1}`, expected: true},
+		{name: "not of parentheses", expr: "not (a == 1 and b == 1)", record: `{"a":1,"b":2}`, expected: true},
+		{name: "keywords ignore case", expr: "A == 1 OR NOT exists(b)", record: `{"A":2}`, expected: true},
+
+		// ! negates, != compares
+		{name: "not equal", expr: "a != 1", record: `{"a":2}`, expected: true},
+		{name: "not equal without spaces", expr: "a!=1", record: `{"a":1}`, expected: false},
+		{name: "bang of field", expr: "!a", record: `{"a":""}`, expected: true},
+		{name: "bang of compare", expr: "! a == 1", record: `{"a":1}`, expected: false},
+		{name: "bang of exists", expr: "!exists(a)", record: `{}`, expected: true},
+		{name: "double bang", expr: "!!a", record: `{"a":"x"}`, expected: true},
+
+		// quoting
+		{name: "double quoted", expr: `msg == "a b"`, record: `{"msg":"a b"}`, expected: true},
+		{name: "single quoted", expr: `msg == 'say "hi"'`, record: `{"msg":"say \"hi\""}`, expected: true},
+		{name: "escaped quote", expr: `msg == 'it\'s'`, record: `{"msg":"it's"}`, expected: true},
+		{name: "quoted field", expr: `"user agent" contains curl`, record: `{"user agent":"curl/7.0"}`, expected: true},
+		{name: "quoted keyword", expr: `a == "or"`, record: `{"a":"or"}`, expected: true},
+
+		// numbers compare as numbers, quoted values and non numbers as strings
+		{name: "number", expr: "status >= 500", record: `{"status":503}`, expected: true},
+		{name: "number of string", expr: "status >= 500", record: `{"status":"99"}`, expected: false},
+		{name: "number of float", expr: "latency < 1.5", record: `{"latency":0.25}`, expected: true},
+		{name: "number equals", expr: "code == 07", record: `{"code":"7"}`, expected: true},
+		{name: "quoted number", expr: `code == "07"`, record: `{"code":"7"}`, expected: false},
+		{name: "quoted number compares as string", expr: `version > "10"`, record: `{"version":9}`, expected: true},
+		{name: "string of non number", expr: "level > debug", record: `{"level":"error"}`, expected: true},
+		{name: "non number record", expr: "status == 500", record: `{"status":"5xx"}`, expected: false},
+
+		// fields
+		{name: "nested field", expr: "user.id == 1", record: `{"user":{"id":1}}`, expected: true},
+		{name: "dotted key first", expr: "user.id == 1", record: `{"user.id":1,"user":{"id":2}}`, expected: true},
+		{name: "tag field", expr: "__tag__:__hostname__ == web-1", record: `{"__tag__:__hostname__":"web-1"}`, expected: true},
+		{name: "missing field equals", expr: "a == 1", record: `{}`, expected: false},
+		{name: "missing field not equals", expr: "a != 1", record: `{}`, expected: true},
+		{name: "missing field not matches", expr: `a !~ "x"`, record: `{}`, expected: true},
+		{name: "null is not present", expr: "a", record: `{"a":null}`, expected: false},
+		{name: "object compares as json", expr: `a contains '"b":1'`, record: `{"a":{"b":1}}`, expected: true},
+
+		// operators
+		{name: "regexp", expr: `path =~ "^/api/"`, record: `{"path":"/api/v1"}`, expected: true},
+		{name: "not regexp", expr: `path !~ "^/api/"`, record: `{"path":"/api/v1"}`, expected: false},
+		{name: "contains", expr: "msg contains timeout", record: `{"msg":"read timeout"}`, expected: true},
+		{name: "contains ignores case of keyword", expr: "msg CONTAINS timeout", record: `{"msg":"ok"}`, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Match(decode(t, tt.record)); got != tt.expected {
+				t.Errorf("%s matches %s is %v, expected %v", tt.expr, tt.record, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		expr          string
+		expectedError string
+	}{
+		{expr: `msg == "a`, expectedError: "unterminated string"},
+		{expr: "a == 1 )", expectedError: `unexpected ")"`},
+		{expr: "(a == 1", expectedError: "missing )"},
+		{expr: "a ==", expectedError: "a == requires a value"},
+		{expr: "a == (", expectedError: "a == requires a value"},
+		{expr: "a and", expectedError: "unexpected end"},
+		{expr: "a # 1", expectedError: `unexpected '#'`},
+		{expr: "exists a", expectedError: "exists requires (field)"},
+		{expr: "exists(a", expectedError: "missing )"},
+		{expr: `a =~ "("`, expectedError: "missing closing )"},
+		{expr: "a b", expectedError: `unexpected "b"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Fatalf("expected error %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package restore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/archive"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+)
+
+const (
+	// prefix of tag keys in records, same as sls query results
+	tagPrefix = "__tag__:"
+	// log groups are flushed before reaching size limit of PutLogs, which is 5MB
+	maxGroupBytes = 3 * 1024 * 1024
+	maxRetries    = 5
+)
+
+var ErrInterrupted = errors.New("restore interrupted")
+
+// retryBackoff is the first backoff of retrying PutLogs, doubled on each retry
+var retryBackoff = time.Second
+
+// Options of restoring
+type Options struct {
+	Project   string
+	Logstore  string
+	Source    string // source of log groups
+	Rate      int    // max logs per second, 0 means unlimited
+	BatchSize int    // max logs of a log group, at most 4096
+	StateFile string // progress is saved in it, so restoring resumes from it
+	// Cipher decrypt objects encrypted on client side
+	Cipher *envelope.Cipher
+}
+
+// State is progress of restoring a prefix into a logstore
+type State struct {
+	Prefix   string   `json:"prefix"`
+	Logstore string   `json:"logstore"`
+	Done     []string `json:"done"`
+	Current  string   `json:"current,omitempty"`
+	Offset   int      `json:"offset,omitempty"` // records of current object already restored
+}
+
+// Stats summarize a restoring
+type Stats struct {
+	Objects int
+	Records int
+	Skipped int // records without valid event time
+}
+
+// Restorer put archived records back into logstore. Records are put at least
+// once, those of a failed PutLogs may be put again after resuming.
+type Restorer struct {
+	bucket  *oss.Bucket
+	client  sls.ClientInterface
+	opts    Options
+	logger  log.Logger
+	limiter *limiter
+
+	state  *State
+	groups map[string]*sls.LogGroup
+	order  []string // keys of groups in creation order
+	size   int
+	stats  Stats
+}
+
+func New(bucket *oss.Bucket, client sls.ClientInterface, opts Options, logger log.Logger) *Restorer {
+	if opts.BatchSize <= 0 || opts.BatchSize > 4096 {
+		opts.BatchSize = 4096
+	}
+	return &Restorer{
+		bucket:  bucket,
+		client:  client,
+		opts:    opts,
+		logger:  logger,
+		limiter: newLimiter(opts.Rate),
+		groups:  make(map[string]*sls.LogGroup),
+	}
+}
+
+// Run restore objects under prefix in order of keys until done or quit
+func (r *Restorer) Run(prefix string, quit <-chan struct{}) (Stats, error) {
+	if err := r.loadState(prefix); err != nil {
+		return r.stats, err
+	}
+	done := make(map[string]struct{}, len(r.state.Done))
+	for _, key := range r.state.Done {
+		done[key] = struct{}{}
+	}
+	objects, err := archive.List(r.bucket, prefix)
+	if err != nil {
+		return r.stats, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, obj := range objects {
+		if _, ok := done[obj.Key]; ok {
+			continue
+		}
+		offset := 0
+		if obj.Key == r.state.Current {
+			offset = r.state.Offset
+		}
+		level.Info(r.logger).Log("msg", "restore object", "object", obj.Key, "offset", offset)
+		if err = r.restoreObject(obj.Key, offset, quit); err != nil {
+			return r.stats, err
+		}
+		r.state.Done = append(r.state.Done, obj.Key)
+		r.state.Current, r.state.Offset = "", 0
+		if err = r.saveState(); err != nil {
+			return r.stats, err
+		}
+		r.stats.Objects++
+	}
+	return r.stats, nil
+}
+
+func (r *Restorer) restoreObject(key string, offset int, quit <-chan struct{}) error {
+	body, err := archive.Open(r.bucket, key, r.opts.Cipher)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	r.state.Current = key
+	err = archive.Decode(body, func(i int, rec map[string]interface{}) error {
+		if i < offset {
+			return nil
+		}
+		if !r.add(rec) {
+			r.stats.Skipped++
+		}
+		if r.size < maxGroupBytes && !r.full() {
+			return nil
+		}
+		select {
+		case <-quit:
+			return ErrInterrupted
+		default:
+		}
+		if err := r.flush(); err != nil {
+			return err
+		}
+		r.state.Offset = i + 1
+		return r.saveState()
+	})
+	if err != nil {
+		return err
+	}
+	return r.flush()
+}
+
+// add record into log group of its topic and tags, false if it has no event time
+func (r *Restorer) add(rec map[string]interface{}) bool {
+	t, ok := archive.RecordTime(rec)
+	if !ok {
+		return false
+	}
+	topic := archive.String(rec[internal.TopicKey])
+	var (
+		tags     []*sls.LogTag
+		contents []*sls.LogContent
+	)
+	for k, v := range rec {
+		switch {
+		case k == internal.TimeKey || k == internal.TopicKey:
+		case strings.HasPrefix(k, tagPrefix):
+			tags = append(tags, &sls.LogTag{Key: proto.String(strings.TrimPrefix(k, tagPrefix)), Value: proto.String(archive.String(v))})
+		default:
+			value := archive.String(v)
+			contents = append(contents, &sls.LogContent{Key: proto.String(k), Value: proto.String(value)})
+			r.size += len(k) + len(value)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].GetKey() < tags[j].GetKey() })
+	sort.Slice(contents, func(i, j int) bool { return contents[i].GetKey() < contents[j].GetKey() })
+
+	gk := groupKey(topic, tags)
+	lg, ok := r.groups[gk]
+	if !ok {
+		lg = &sls.LogGroup{
+			Topic:   proto.String(topic),
+			Source:  proto.String(r.opts.Source),
+			LogTags: tags,
+		}
+		r.groups[gk] = lg
+		r.order = append(r.order, gk)
+	}
+	lg.Logs = append(lg.Logs, &sls.Log{Time: proto.Uint32(uint32(t.Unix())), Contents: contents})
+	r.stats.Records++
+	return true
+}
+
+func groupKey(topic string, tags []*sls.LogTag) string {
+	var sb strings.Builder
+	sb.WriteString(topic)
+	for _, tag := range tags {
+		sb.WriteByte(0)
+		sb.WriteString(tag.GetKey())
+		sb.WriteByte('=')
+		sb.WriteString(tag.GetValue())
+	}
+	return sb.String()
+}
+
+func (r *Restorer) full() bool {
+	for _, lg := range r.groups {
+		if len(lg.Logs) >= r.opts.BatchSize {
+			return true
+		}
+	}
+	return false
+}
+
+// flush put all pending log groups
+func (r *Restorer) flush() error {
+	for _, gk := range r.order {
+		lg := r.groups[gk]
+		r.limiter.wait(len(lg.Logs))
+		if err := r.put(lg); err != nil {
+			return err
+		}
+		delete(r.groups, gk)
+	}
+	r.order = r.order[:0]
+	r.size = 0
+	return nil
+}
+
+func (r *Restorer) put(lg *sls.LogGroup) error {
+	var err error
+	backoff := retryBackoff
+	for i := 0; i < maxRetries; i++ {
+		if err = r.client.PutLogs(r.opts.Project, r.opts.Logstore, lg); err == nil {
+			return nil
+		}
+		level.Warn(r.logger).Log("msg", "put logs", "logs", len(lg.Logs), "retry", i+1, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return fmt.Errorf("put logs: %v", err)
+}
+
+// loadState resume from state file if it's restoring the same prefix into the same logstore
+func (r *Restorer) loadState(prefix string) error {
+	r.state = &State{Prefix: prefix, Logstore: r.opts.Logstore}
+	if r.opts.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &State{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", r.opts.StateFile, err)
+	}
+	if state.Prefix != prefix || state.Logstore != r.opts.Logstore {
+		return fmt.Errorf("state file %s is restoring %s into %s", r.opts.StateFile, state.Prefix, state.Logstore)
+	}
+	level.Info(r.logger).Log("msg", "resume restoring", "done", len(state.Done), "current", state.Current, "offset", state.Offset)
+	r.state = state
+	return nil
+}
+
+func (r *Restorer) saveState() error {
+	if r.opts.StateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(r.opts.StateFile), 0755); err != nil {
+		return err
+	}
+	tmp := r.opts.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.opts.StateFile)
+}
+
+// limiter block callers to keep rate of logs
+type limiter struct {
+	rate  int
+	start time.Time
+	sent  int
+}
+
+func newLimiter(rate int) *limiter {
+	return &limiter{rate: rate, start: time.Now()}
+}
+
+func (l *limiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.sent += n
+	due := l.start.Add(time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
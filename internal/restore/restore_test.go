@@ -0,0 +1,240 @@
+package restore
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+)
+
+// fakeOSS serve listing and getting objects of a bucket
+type fakeOSS map[string]string
+
+func (f fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		body, ok := f[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		fmt.Fprint(w, body)
+		return
+	}
+	type object struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []object `xml:"Contents"`
+	}{}
+	for k, v := range f {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			result.Contents = append(result.Contents, object{Key: k, Size: len(v)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newBucket(t *testing.T, objects fakeOSS) *oss.Bucket {
+	srv := httptest.NewServer(objects)
+	t.Cleanup(srv.Close)
+	client, err := oss.New(srv.URL, "id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.Bucket("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+// fakeSLS record log groups put, PutLogs fails since the fail-th call
+type fakeSLS struct {
+	sls.ClientInterface
+	mu    sync.Mutex
+	fail  int
+	calls int
+	puts  []*sls.LogGroup
+	times []time.Time
+}
+
+func (f *fakeSLS) PutLogs(project, logstore string, lg *sls.LogGroup) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail > 0 && f.calls >= f.fail {
+		return errors.New("injected failure")
+	}
+	f.puts = append(f.puts, lg)
+	f.times = append(f.times, time.Now())
+	return nil
+}
+
+// ids of logs put in order
+func (f *fakeSLS) ids() []string {
+	var ids []string
+	for _, lg := range f.puts {
+		for _, l := range lg.Logs {
+			for _, c := range l.Contents {
+				if c.GetKey() == "id" {
+					ids = append(ids, c.GetValue())
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// records encode n records as ndjson, ids starting from first
+func records(first, n int, topic string) string {
+	var sb strings.Builder
+	for i := first; i < first+n; i++ {
+		b, _ := json.Marshal(map[string]interface{}{
+			"@timestamp": "2021-06-01T00:00:00Z",
+			"__topic__":  topic,
+			"id":         strconv.Itoa(i),
+		})
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func TestBatching(t *testing.T) {
+	tests := []struct {
+		name          string
+		objects       fakeOSS
+		batchSize     int
+		expectedSizes []int
+	}{
+		{
+			name:          "batch size",
+			objects:       fakeOSS{"p/a.json": records(0, 7, "")},
+			batchSize:     3,
+			expectedSizes: []int{3, 3, 1},
+		},
+		{
+			name:          "groups of topics",
+			objects:       fakeOSS{"p/a.json": records(0, 2, "x") + records(2, 3, "y")},
+			batchSize:     3,
+			expectedSizes: []int{2, 3},
+		},
+		{
+			name:          "flushed per object",
+			objects:       fakeOSS{"p/a.json": records(0, 2, ""), "p/b.json": records(2, 2, ""), "p/_manifest.json": records(4, 1, "")},
+			batchSize:     10,
+			expectedSizes: []int{2, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSLS{}
+			r := New(newBucket(t, tt.objects), client, Options{Logstore: "logstore", BatchSize: tt.batchSize}, log.NewNopLogger())
+			stats, err := r.Run("p/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sizes []int
+			total := 0
+			for _, lg := range client.puts {
+				sizes = append(sizes, len(lg.Logs))
+				total += len(lg.Logs)
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.expectedSizes) {
+				t.Errorf("log groups of sizes %v, expected %v", sizes, tt.expectedSizes)
+			}
+			if stats.Records != total {
+				t.Errorf("%d records restored, %d put", stats.Records, total)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	client := &fakeSLS{}
+	r := New(newBucket(t, fakeOSS{"p/a.json": records(0, 20, "")}), client, Options{Logstore: "logstore", Rate: 100, BatchSize: 5}, log.NewNopLogger())
+	start := time.Now()
+	if _, err := r.Run("p/", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.times) != 4 {
+		t.Fatalf("%d log groups put, expected 4", len(client.times))
+	}
+	for i, at := range client.times {
+		// 5 logs at 100 logs per second
+		if due := start.Add(time.Duration(i+1) * 50 * time.Millisecond); at.Before(due) {
+			t.Errorf("log group %d is put %v before due", i, due.Sub(at))
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = backoff }()
+
+	objects := fakeOSS{"p/a.json": records(0, 4, ""), "p/b.json": records(4, 6, "")}
+	opts := Options{Logstore: "logstore", BatchSize: 2, StateFile: filepath.Join(t.TempDir(), "state.json")}
+
+	// a.json and the first 2 records of b.json are put before failing
+	failing := &fakeSLS{fail: 4}
+	if _, err := New(newBucket(t, objects), failing, opts, log.NewNopLogger()).Run("p/", nil); err == nil {
+		t.Fatal("expected error of failed PutLogs")
+	}
+	if failing.calls != 3+maxRetries {
+		t.Errorf("PutLogs called %d times, expected %d", failing.calls, 3+maxRetries)
+	}
+	data, err := ioutil.ReadFile(opts.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &State{}
+	if err = json.Unmarshal(data, state); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(state.Done) != "[p/a.json]" || state.Current != "p/b.json" || state.Offset != 2 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	client := &fakeSLS{}
+	stats, err := New(newBucket(t, objects), client, opts, log.NewNopLogger()).Run("p/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := fmt.Sprint(failing.ids(), client.ids()); ids != "[0 1 2 3 4 5] [6 7 8 9]" {
+		t.Errorf("put %s, expected each record once", ids)
+	}
+	if stats.Objects != 1 || stats.Records != 4 {
+		t.Errorf("unexpected stats of resuming %+v", stats)
+	}
+
+	// a restored prefix is not restored again
+	client = &fakeSLS{}
+	if _, err = New(newBucket(t, objects), client, opts, log.NewNopLogger()).Run("p/", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.puts) != 0 {
+		t.Errorf("%d log groups put again", len(client.puts))
+	}
+}
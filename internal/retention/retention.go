@@ -0,0 +1,245 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/partition"
+)
+
+// max keys of a DeleteObjects request
+const deleteBatch = 1000
+
+// Audit is a deleted object, or one would be deleted in dry run
+type Audit struct {
+	Time      time.Time `json:"time"`
+	Logstore  string    `json:"logstore"`
+	Prefix    string    `json:"prefix"`
+	Partition string    `json:"partition"`
+	Object    string    `json:"object"`
+	Days      int       `json:"days"`
+	DryRun    bool      `json:"dry_run"`
+}
+
+// Stats summarize a sweep
+type Stats struct {
+	Partitions int
+	Objects    int
+}
+
+// Sweeper delete partitions older than retention of rules, partitions are
+// found by walking date paths under prefixes of rules, and the same prefixes
+// under late prefix.
+type Sweeper struct {
+	cfg        *config.Retention
+	layout     *partition.Layout
+	bucket     *oss.Bucket
+	latePrefix string
+	logger     log.Logger
+
+	mu    sync.Mutex
+	audit io.Writer
+}
+
+// New create sweeper, late records are swept under latePrefix unless it's empty
+func New(cfg *config.Retention, layout *partition.Layout, bucket *oss.Bucket, latePrefix string, logger log.Logger) (*Sweeper, error) {
+	s := &Sweeper{
+		cfg:        cfg,
+		layout:     layout,
+		bucket:     bucket,
+		latePrefix: latePrefix,
+		logger:     logger,
+	}
+	if cfg.AuditLog != "" {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.audit = f
+	}
+	return s, nil
+}
+
+// Run sweep periodically until quit
+func (s *Sweeper) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(s.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats, err := s.Sweep(s.cfg.DryRun)
+			if err != nil {
+				level.Error(s.logger).Log("msg", "sweep expired partitions", "err", err)
+				continue
+			}
+			level.Info(s.logger).Log("msg", "sweep done", "partitions", stats.Partitions, "objects", stats.Objects, "dry_run", s.cfg.DryRun)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Sweep delete expired partitions of all rules
+func (s *Sweeper) Sweep(dryRun bool) (Stats, error) {
+	var stats Stats
+	now := time.Now()
+	for _, rule := range s.cfg.Rules {
+		if err := s.sweepRule(rule, now, dryRun, &stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *Sweeper) sweepRule(rule *config.RetentionRule, now time.Time, dryRun bool, stats *Stats) error {
+	prefixes := []string{rule.Prefix}
+	if s.latePrefix != "" {
+		// late records of the same partitions expire with them
+		prefixes = append(prefixes, s.latePrefix+"/"+rule.Prefix)
+	}
+	for _, prefix := range prefixes {
+		if err := s.sweepPrefix(rule, prefix, now, dryRun, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sweeper) sweepPrefix(rule *config.RetentionRule, prefix string, now time.Time, dryRun bool, stats *Stats) error {
+	expireBefore := now.AddDate(0, 0, -rule.Days)
+	dirs, err := s.partitions(prefix)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		start, err := s.layout.Parse(strings.TrimPrefix(dir, prefix))
+		if err != nil {
+			// not a date path
+			level.Debug(s.logger).Log("msg", "skip dir", "dir", dir, "err", err)
+			continue
+		}
+		if _, end := s.layout.Period(start); end.After(expireBefore) {
+			continue
+		}
+		n, err := s.deletePartition(rule, prefix, dir, dryRun)
+		stats.Objects += n
+		if err != nil {
+			return err
+		}
+		stats.Partitions++
+	}
+	return nil
+}
+
+// partitions return dirs under prefix as deep as partition paths
+func (s *Sweeper) partitions(prefix string) ([]string, error) {
+	dirs := []string{prefix}
+	for depth := 0; depth < s.layout.Depth(); depth++ {
+		var next []string
+		for _, dir := range dirs {
+			marker := oss.Marker("")
+			for {
+				result, err := s.bucket.ListObjects(oss.Prefix(dir), oss.Delimiter("/"), marker)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, result.CommonPrefixes...)
+				if !result.IsTruncated {
+					break
+				}
+				marker = oss.Marker(result.NextMarker)
+			}
+		}
+		dirs = next
+	}
+	return dirs, nil
+}
+
+// deletePartition delete all objects under dir of prefix, return number of them
+func (s *Sweeper) deletePartition(rule *config.RetentionRule, prefix, dir string, dryRun bool) (int, error) {
+	var (
+		keys  []string
+		count int
+	)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		deleted := keys
+		if !dryRun {
+			// deleted keys are only returned in verbose mode
+			result, err := s.bucket.DeleteObjects(keys)
+			if err != nil {
+				return err
+			}
+			deleted = result.DeletedObjects
+		}
+		for _, key := range deleted {
+			s.record(Audit{
+				Time:      time.Now(),
+				Logstore:  rule.Logstore,
+				Prefix:    prefix,
+				Partition: dir,
+				Object:    key,
+				Days:      rule.Days,
+				DryRun:    dryRun,
+			})
+		}
+		count += len(deleted)
+		if len(deleted) < len(keys) {
+			return fmt.Errorf("%d of %d objects under %s are not deleted", len(keys)-len(deleted), len(keys), dir)
+		}
+		keys = keys[:0]
+		return nil
+	}
+	marker := oss.Marker("")
+	for {
+		result, err := s.bucket.ListObjects(oss.Prefix(dir), marker)
+		if err != nil {
+			return count, err
+		}
+		for _, obj := range result.Objects {
+			keys = append(keys, obj.Key)
+			if len(keys) == deleteBatch {
+				if err = flush(); err != nil {
+					return count, err
+				}
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = oss.Marker(result.NextMarker)
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	level.Info(s.logger).Log("msg", "partition expired", "partition", dir, "objects", count, "days", rule.Days, "dry_run", dryRun)
+	return count, nil
+}
+
+func (s *Sweeper) record(a Audit) {
+	if s.audit == nil {
+		level.Info(s.logger).Log("msg", "audit", "logstore", a.Logstore, "partition", a.Partition, "object", a.Object, "days", a.Days, "dry_run", a.DryRun)
+		return
+	}
+	data, err := json.Marshal(&a)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err = s.audit.Write(append(data, '\n')); err != nil {
+		level.Error(s.logger).Log("msg", "write audit log", "err", err)
+	}
+}
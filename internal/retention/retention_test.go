@@ -0,0 +1,285 @@
+package retention
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/partition"
+)
+
+// fakeOSS serve listing and deleting objects of a bucket, keys in undeletable
+// are left and not reported as deleted
+type fakeOSS struct {
+	mu          sync.Mutex
+	objects     map[string]bool
+	undeletable map[string]bool
+}
+
+func (f *fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := r.URL.Query()["delete"]; ok && r.Method == http.MethodPost {
+		var req struct {
+			Quiet   bool `xml:"Quiet"`
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		type deleted struct {
+			Key string `xml:"Key"`
+		}
+		result := struct {
+			XMLName xml.Name  `xml:"DeleteResult"`
+			Deleted []deleted `xml:"Deleted"`
+		}{}
+		for _, obj := range req.Objects {
+			if f.undeletable[obj.Key] {
+				continue
+			}
+			delete(f.objects, obj.Key)
+			if !req.Quiet {
+				result.Deleted = append(result.Deleted, deleted{Key: obj.Key})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	type object struct {
+		Key string `xml:"Key"`
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Contents       []object `xml:"Contents"`
+		CommonPrefixes []string `xml:"CommonPrefixes>Prefix"`
+	}{}
+	seen := make(map[string]bool)
+	for k := range f.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			if p := k[:len(prefix)+i+1]; !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, p)
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, object{Key: k})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	sort.Strings(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeOSS) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newBucket(t *testing.T, f *fakeOSS) *oss.Bucket {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client, err := oss.New(srv.URL, "id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.Bucket("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+func TestSweep(t *testing.T) {
+	objects := []string{
+		"ls/2021/05/30/23/a.json",
+		"ls/2021/05/30/23/b.json",
+		"ls/2021/05/31/00/a.json",
+		"ls/2021/05/31/01/a.json",
+		"ls/tmp/x/y/z/a.json",
+		"late/ls/2021/05/30/10/a.json",
+		"late/ls/2021/05/31/10/a.json",
+		"other/2021/05/30/23/a.json",
+	}
+	// partitions ending at or before 2021-05-31T01:00:00Z expire
+	now := time.Date(2021, 6, 1, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		latePrefix      string
+		dryRun          bool
+		undeletable     []string
+		expectedLeft    []string
+		expectedAudit   []string
+		expectedStats   Stats
+		expectedFailure bool
+	}{
+		{
+			name: "expired partitions",
+			expectedLeft: []string{
+				"late/ls/2021/05/30/10/a.json",
+				"late/ls/2021/05/31/10/a.json",
+				"ls/2021/05/31/01/a.json",
+				"ls/tmp/x/y/z/a.json",
+				"other/2021/05/30/23/a.json",
+			},
+			expectedAudit: []string{
+				"ls/2021/05/30/23/a.json",
+				"ls/2021/05/30/23/b.json",
+				"ls/2021/05/31/00/a.json",
+			},
+			expectedStats: Stats{Partitions: 2, Objects: 3},
+		},
+		{
+			name:       "late prefix",
+			latePrefix: "late",
+			expectedLeft: []string{
+				"late/ls/2021/05/31/10/a.json",
+				"ls/2021/05/31/01/a.json",
+				"ls/tmp/x/y/z/a.json",
+				"other/2021/05/30/23/a.json",
+			},
+			expectedAudit: []string{
+				"ls/2021/05/30/23/a.json",
+				"ls/2021/05/30/23/b.json",
+				"ls/2021/05/31/00/a.json",
+				"late/ls/2021/05/30/10/a.json",
+			},
+			expectedStats: Stats{Partitions: 3, Objects: 4},
+		},
+		{
+			name:         "dry run",
+			latePrefix:   "late",
+			dryRun:       true,
+			expectedLeft: objects,
+			expectedAudit: []string{
+				"ls/2021/05/30/23/a.json",
+				"ls/2021/05/30/23/b.json",
+				"ls/2021/05/31/00/a.json",
+				"late/ls/2021/05/30/10/a.json",
+			},
+			expectedStats: Stats{Partitions: 3, Objects: 4},
+		},
+		{
+			name:        "objects not deleted",
+			undeletable: []string{"ls/2021/05/30/23/b.json"},
+			expectedLeft: []string{
+				"late/ls/2021/05/30/10/a.json",
+				"late/ls/2021/05/31/10/a.json",
+				"ls/2021/05/30/23/b.json",
+				"ls/2021/05/31/00/a.json",
+				"ls/2021/05/31/01/a.json",
+				"ls/tmp/x/y/z/a.json",
+				"other/2021/05/30/23/a.json",
+			},
+			expectedAudit:   []string{"ls/2021/05/30/23/a.json"},
+			expectedStats:   Stats{Partitions: 0, Objects: 1},
+			expectedFailure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeOSS{objects: make(map[string]bool), undeletable: make(map[string]bool)}
+			for _, k := range objects {
+				f.objects[k] = true
+			}
+			for _, k := range tt.undeletable {
+				f.undeletable[k] = true
+			}
+			layout, err := partition.New(&config.Partition{Timezone: "UTC"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(&config.Retention{}, layout, newBucket(t, f), tt.latePrefix, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var audit bytes.Buffer
+			s.audit = &audit
+
+			var stats Stats
+			rule := &config.RetentionRule{Logstore: "ls", Prefix: "ls/", Days: 1}
+			err = s.sweepRule(rule, now, tt.dryRun, &stats)
+			if (err != nil) != tt.expectedFailure {
+				t.Fatalf("sweep error %v", err)
+			}
+			if stats != tt.expectedStats {
+				t.Errorf("stats %+v, expected %+v", stats, tt.expectedStats)
+			}
+			expectedLeft := append([]string(nil), tt.expectedLeft...)
+			sort.Strings(expectedLeft)
+			if left := f.keys(); strings.Join(left, ",") != strings.Join(expectedLeft, ",") {
+				t.Errorf("left %v, expected %v", left, expectedLeft)
+			}
+
+			var audited []string
+			scanner := bufio.NewScanner(&audit)
+			for scanner.Scan() {
+				var a Audit
+				if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+					t.Fatal(err)
+				}
+				if a.DryRun != tt.dryRun || a.Logstore != "ls" || a.Days != 1 || !strings.HasPrefix(a.Object, a.Partition) {
+					t.Errorf("unexpected audit %+v", a)
+				}
+				audited = append(audited, a.Object)
+			}
+			if strings.Join(audited, ",") != strings.Join(tt.expectedAudit, ",") {
+				t.Errorf("audited %v, expected %v", audited, tt.expectedAudit)
+			}
+		})
+	}
+}
+
+func TestPartitionsDepth(t *testing.T) {
+	f := &fakeOSS{objects: map[string]bool{
+		"ls/dt=2021-05-30/hour=01/a.json": true,
+		"ls/dt=2021-05-30/hour=02/a.json": true,
+		"ls/dt=2021-05-31/hour=01/a.json": true,
+		"ls/dt=2021-05-31/b.json":         true,
+		"ls/c.json":                       true,
+	}}
+	layout, err := partition.New(&config.Partition{Style: "hive", Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(&config.Retention{}, layout, newBucket(t, f), "", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := s.partitions("ls/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ls/dt=2021-05-30/hour=01/", "ls/dt=2021-05-30/hour=02/", "ls/dt=2021-05-31/hour=01/"}
+	if strings.Join(dirs, ",") != strings.Join(expected, ",") {
+		t.Errorf("partitions %v, expected %v", dirs, expected)
+	}
+}
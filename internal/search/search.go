@@ -0,0 +1,196 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/vjeantet/jodaTime"
+
+	"github.com/fengxsong/sls2oss/internal/archive"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/query"
+)
+
+var errLimitReached = errors.New("limit reached")
+
+// Prefixes return listing prefixes of objects of logstore in [from, to). The
+// directory of key template is rendered with each partition in range, and
+// truncated at the first variable unknown before reading records, such as
+// {hostname} or {field.*}.
+func Prefixes(keyTemplate string, layout *partition.Layout, project, logstore string, from, to time.Time) []string {
+	dir := ""
+	if i := strings.LastIndex(keyTemplate, "/"); i >= 0 {
+		dir = keyTemplate[:i+1]
+	}
+	var (
+		prefixes []string
+		seen     = make(map[string]struct{})
+	)
+	for t, _ := layout.Period(from); t.Before(to); _, t = layout.Period(t) {
+		t := t
+		prefix := keytpl.Prefix(dir, func(name string) (string, bool) {
+			switch name {
+			case "topic", "logstore":
+				return logstore, true
+			case "project":
+				return project, true
+			case "partition":
+				return layout.Format(t), true
+			case "hostname", "shard", "seq", "unix", "rand", keytpl.HashVar:
+				return "", false
+			}
+			if strings.HasPrefix(name, keytpl.FieldPrefix) {
+				return "", false
+			}
+			return jodaTime.Format(name, t.In(layout.Location())), true
+		})
+		if _, ok := seen[prefix]; !ok {
+			seen[prefix] = struct{}{}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Options of searching
+type Options struct {
+	From     time.Time
+	To       time.Time
+	Expr     query.Expr
+	Parallel int
+	Limit    int // max records printed, 0 means unlimited
+	// Cipher decrypt objects encrypted on client side
+	Cipher *envelope.Cipher
+}
+
+// Stats summarize a search
+type Stats struct {
+	Objects int
+	Records int
+	Matched int
+}
+
+// Search stream objects under prefixes in parallel, records in time range
+// matching expression are written to out as ndjson. A nil expression matches
+// every record, and matched records are only counted if out is nil.
+func Search(bucket *oss.Bucket, prefixes []string, opts Options, out io.Writer, logger log.Logger) (Stats, error) {
+	var (
+		stats Stats
+		keys  []string
+		seen  = make(map[string]struct{})
+	)
+	for _, prefix := range prefixes {
+		objects, err := archive.List(bucket, prefix)
+		if err != nil {
+			return stats, err
+		}
+		for _, obj := range objects {
+			if _, ok := seen[obj.Key]; !ok {
+				seen[obj.Key] = struct{}{}
+				keys = append(keys, obj.Key)
+			}
+		}
+	}
+	level.Debug(logger).Log("msg", "objects to search", "count", len(keys))
+	if opts.Parallel <= 0 {
+		opts.Parallel = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		done     = make(chan struct{})
+		stopOnce sync.Once
+		incoming = make(chan string)
+	)
+	stop := func() { stopOnce.Do(func() { close(done) }) }
+	for i := 0; i < opts.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range incoming {
+				records, err := searchObject(bucket, key, opts, done, func(rec map[string]interface{}) error {
+					if out == nil {
+						mu.Lock()
+						stats.Matched++
+						mu.Unlock()
+						return nil
+					}
+					data, err := json.Marshal(rec)
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if opts.Limit > 0 && stats.Matched >= opts.Limit {
+						stop()
+						return errLimitReached
+					}
+					if _, err = out.Write(append(data, '\n')); err != nil {
+						return err
+					}
+					stats.Matched++
+					return nil
+				})
+				mu.Lock()
+				stats.Objects++
+				stats.Records += records
+				if err != nil && err != errLimitReached && firstErr == nil {
+					firstErr = err
+					stop()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+loop:
+	for _, key := range keys {
+		select {
+		case incoming <- key:
+		case <-done:
+			break loop
+		}
+	}
+	close(incoming)
+	wg.Wait()
+	return stats, firstErr
+}
+
+func searchObject(bucket *oss.Bucket, key string, opts Options, done <-chan struct{}, emit func(map[string]interface{}) error) (int, error) {
+	body, err := archive.Open(bucket, key, opts.Cipher)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	records := 0
+	err = archive.Decode(body, func(_ int, rec map[string]interface{}) error {
+		select {
+		case <-done:
+			return errLimitReached
+		default:
+		}
+		records++
+		if t, ok := archive.RecordTime(rec); !ok || t.Before(opts.From) || !t.Before(opts.To) {
+			return nil
+		}
+		if opts.Expr != nil && !opts.Expr.Match(rec) {
+			return nil
+		}
+		return emit(rec)
+	})
+	if err != nil && err != errLimitReached {
+		err = fmt.Errorf("%s: %v", key, err)
+	}
+	return records, err
+}
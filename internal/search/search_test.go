@@ -0,0 +1,107 @@
+package search
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/partition"
+)
+
+func TestPrefixes(t *testing.T) {
+	hourly := &config.Partition{Timezone: "UTC"}
+	tests := []struct {
+		name             string
+		keyTemplate      string
+		partition        *config.Partition
+		from, to         string
+		expectedPrefixes []string
+	}{
+		{
+			name:             "partitions in range",
+			keyTemplate:      config.DefaultKeyTemplate,
+			partition:        hourly,
+			from:             "2021-06-01T22:30:00Z",
+			to:               "2021-06-02T01:00:00Z",
+			expectedPrefixes: []string{"ls/2021/06/01/22/", "ls/2021/06/01/23/", "ls/2021/06/02/00/"},
+		},
+		{
+			name:             "hive partitions",
+			keyTemplate:      config.DefaultKeyTemplate,
+			partition:        &config.Partition{Style: "hive", Timezone: "UTC"},
+			from:             "2021-06-01T23:00:00Z",
+			to:               "2021-06-02T00:00:01Z",
+			expectedPrefixes: []string{"ls/dt=2021-06-01/hour=23/", "ls/dt=2021-06-02/hour=00/"},
+		},
+		{
+			name:             "timezone of partitions",
+			keyTemplate:      config.DefaultKeyTemplate,
+			partition:        &config.Partition{Timezone: "Asia/Shanghai"},
+			from:             "2021-06-01T16:00:00Z",
+			to:               "2021-06-01T17:00:00Z",
+			expectedPrefixes: []string{"ls/2021/06/02/00/"},
+		},
+		{
+			name:             "joda variables",
+			keyTemplate:      "{project}/{yyyy}/{MM}/{logstore}-{dd}/{rand}",
+			partition:        hourly,
+			from:             "2021-06-01T22:00:00Z",
+			to:               "2021-06-02T00:30:00Z",
+			expectedPrefixes: []string{"proj/2021/06/ls-01/", "proj/2021/06/ls-02/"},
+		},
+		{
+			name:             "truncated at hostname",
+			keyTemplate:      "{topic}/{hostname}/{partition}/{rand}",
+			partition:        hourly,
+			from:             "2021-06-01T22:00:00Z",
+			to:               "2021-06-02T02:00:00Z",
+			expectedPrefixes: []string{"ls/"},
+		},
+		{
+			name:             "truncated at field",
+			keyTemplate:      "{topic}/{partition}/{field.app}/{rand}",
+			partition:        hourly,
+			from:             "2021-06-01T22:00:00Z",
+			to:               "2021-06-01T23:00:00Z",
+			expectedPrefixes: []string{"ls/2021/06/01/22/"},
+		},
+		{
+			name:             "content hash",
+			keyTemplate:      config.ContentHashKeyTemplate,
+			partition:        hourly,
+			from:             "2021-06-01T22:00:00Z",
+			to:               "2021-06-01T23:00:00Z",
+			expectedPrefixes: []string{"ls/2021/06/01/22/"},
+		},
+		{
+			name:             "no directory",
+			keyTemplate:      "{logstore}-{rand}",
+			partition:        hourly,
+			from:             "2021-06-01T22:00:00Z",
+			to:               "2021-06-02T02:00:00Z",
+			expectedPrefixes: []string{""},
+		},
+		{
+			name:        "empty range",
+			keyTemplate: config.DefaultKeyTemplate,
+			partition:   hourly,
+			from:        "2021-06-01T22:00:00Z",
+			to:          "2021-06-01T22:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := partition.New(tt.partition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, _ := time.Parse(time.RFC3339, tt.from)
+			to, _ := time.Parse(time.RFC3339, tt.to)
+			prefixes := Prefixes(tt.keyTemplate, layout, "proj", "ls", from, to)
+			if fmt.Sprintf("%q", prefixes) != fmt.Sprintf("%q", tt.expectedPrefixes) {
+				t.Errorf("prefixes are %q, expected %q", prefixes, tt.expectedPrefixes)
+			}
+		})
+	}
+}
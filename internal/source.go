@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"encoding/base64"
+	"strconv"
+)
+
+// Source describe where records come from
+type Source struct {
+	Project  string
+	Logstore string
+	Shard    int
+	// cursor of the first log group of batch, empty if it's unknown
+	Cursor string
+	// cursor following the last log group of batch, empty if it's unknown or
+	// only some of records of the range are picked, eg. by backfill
+	NextCursor string
+}
+
+// EncodeCursor return sls cursor of sequence number of a log group
+func EncodeCursor(seq int64) string {
+	return base64.StdEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+// DecodeCursor return sequence number of sls cursor, which is base64 encoded
+func DecodeCursor(cursor string) (int64, bool) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
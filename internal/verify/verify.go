@@ -0,0 +1,274 @@
+package verify
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/consumer"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+	"github.com/fengxsong/sls2oss/internal/manifest"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/search"
+)
+
+const (
+	SourceManifest = "manifest"
+	SourceObjects  = "objects"
+
+	StatusOK        = "ok"
+	StatusGap       = "gap"
+	StatusMissing   = "missing"
+	StatusDuplicate = "duplicate"
+
+	histogramRetries = 5
+	pullBatchSize    = 1000
+)
+
+// Options of verifying a logstore
+type Options struct {
+	Project     string
+	Logstore    string
+	KeyTemplate string
+	// LatePrefix is searched as well if not empty
+	LatePrefix string
+	// Query filter logs counted in sls, eg. to exclude logs dropped by filters
+	Query string
+	// Source of archived counts, manifest falls back to counting objects of
+	// windows without manifest
+	Source   string
+	Manifest string // name of manifest objects
+	Parallel int
+	// Cipher decrypt objects encrypted on client side
+	Cipher *envelope.Cipher
+}
+
+// Window compare counts of a partition period
+type Window struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	SLS      int64     `json:"sls"`
+	Archived int64     `json:"archived"`
+	Source   string    `json:"source"`
+	Prefixes []string  `json:"-"`
+}
+
+// Status of window, missing if nothing is archived while sls has logs
+func (w *Window) Status() string {
+	switch {
+	case w.Archived == w.SLS:
+		return StatusOK
+	case w.Archived == 0:
+		return StatusMissing
+	case w.Archived < w.SLS:
+		return StatusGap
+	default:
+		return StatusDuplicate
+	}
+}
+
+// Verifier compare record counts of sls and archive
+type Verifier struct {
+	client sls.ClientInterface
+	bucket *oss.Bucket
+	layout *partition.Layout
+	opts   Options
+	logger log.Logger
+}
+
+func New(client sls.ClientInterface, bucket *oss.Bucket, layout *partition.Layout, opts Options, logger log.Logger) *Verifier {
+	if opts.Source == "" {
+		opts.Source = SourceManifest
+	}
+	if opts.Parallel <= 0 {
+		opts.Parallel = 1
+	}
+	return &Verifier{
+		client: client,
+		bucket: bucket,
+		layout: layout,
+		opts:   opts,
+		logger: logger,
+	}
+}
+
+// Verify compare counts of every partition period in [from, to)
+func (v *Verifier) Verify(from, to time.Time) ([]*Window, error) {
+	var windows []*Window
+	for start, end := v.layout.Period(from); start.Before(to); start, end = v.layout.Period(end) {
+		w := &Window{Start: start, End: end}
+		w.Prefixes = search.Prefixes(v.opts.KeyTemplate, v.layout, v.opts.Project, v.opts.Logstore, start, end)
+		if v.opts.LatePrefix != "" {
+			for _, p := range w.Prefixes {
+				w.Prefixes = append(w.Prefixes, path.Join(v.opts.LatePrefix, p)+"/")
+			}
+		}
+		var err error
+		if w.SLS, err = v.countSLS(start, end); err != nil {
+			return windows, fmt.Errorf("count sls logs of %s: %v", start, err)
+		}
+		if err = v.countArchived(w); err != nil {
+			return windows, fmt.Errorf("count archived records of %s: %v", start, err)
+		}
+		level.Debug(v.logger).Log("msg", "window verified", "start", start, "sls", w.SLS, "archived", w.Archived, "source", w.Source)
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// countSLS count logs in [start, end) by event time, histograms may be
+// incomplete while sls is still indexing, retry until complete
+func (v *Verifier) countSLS(start, end time.Time) (int64, error) {
+	var (
+		resp *sls.GetHistogramsResponse
+		err  error
+	)
+	for i := 0; i < histogramRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		resp, err = v.client.GetHistograms(v.opts.Project, v.opts.Logstore, "", start.Unix(), end.Unix(), v.opts.Query)
+		if err == nil && resp.IsComplete() {
+			return resp.Count, nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	level.Warn(v.logger).Log("msg", "histograms are incomplete", "start", start, "progress", resp.Progress)
+	return resp.Count, nil
+}
+
+func (v *Verifier) countArchived(w *Window) error {
+	if v.opts.Source == SourceManifest {
+		found := false
+		for _, prefix := range w.Prefixes {
+			n, ok, err := v.countManifests(prefix, w.Start, w.End)
+			if err != nil {
+				return err
+			}
+			found = found || ok
+			w.Archived += n
+		}
+		if found {
+			w.Source = SourceManifest
+			return nil
+		}
+		w.Archived = 0
+	}
+	stats, err := search.Search(v.bucket, w.Prefixes, search.Options{
+		From:     w.Start,
+		To:       w.End,
+		Parallel: v.opts.Parallel,
+		Cipher:   v.opts.Cipher,
+	}, nil, v.logger)
+	if err != nil {
+		return err
+	}
+	w.Source = SourceObjects
+	w.Archived = int64(stats.Matched)
+	return nil
+}
+
+// countManifests sum records of manifests under prefix starting in [start, end)
+func (v *Verifier) countManifests(prefix string, start, end time.Time) (int64, bool, error) {
+	var (
+		total int64
+		found bool
+	)
+	marker := oss.Marker("")
+	for {
+		result, err := v.bucket.ListObjects(oss.Prefix(prefix), marker)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, obj := range result.Objects {
+			if path.Base(obj.Key) != v.opts.Manifest {
+				continue
+			}
+			m, err := manifest.Get(v.bucket, obj.Key)
+			if err != nil {
+				return 0, false, err
+			}
+			if m == nil || m.Start.Before(start) || !m.Start.Before(end) {
+				continue
+			}
+			found = true
+			total += int64(m.Records)
+		}
+		if !result.IsTruncated {
+			return total, found, nil
+		}
+		marker = oss.Marker(result.NextMarker)
+	}
+}
+
+// Backfill pull logs of window from every shard and pass them to consume.
+// Cursors are located by receive time, so the range is widened by slack on
+// both sides and logs outside of window by event time are dropped.
+func (v *Verifier) Backfill(w *Window, slack time.Duration, includeMeta bool, consume func(*internal.Batch) error) (int, error) {
+	shards, err := v.client.ListShards(v.opts.Project, v.opts.Logstore)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, shard := range shards {
+		n, err := v.backfillShard(shard.ShardID, w, slack, includeMeta, consume)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("shard %d: %v", shard.ShardID, err)
+		}
+	}
+	level.Info(v.logger).Log("msg", "window backfilled", "start", w.Start, "records", total)
+	return total, nil
+}
+
+func (v *Verifier) backfillShard(shard int, w *Window, slack time.Duration, includeMeta bool, consume func(*internal.Batch) error) (int, error) {
+	cursor, err := v.client.GetCursor(v.opts.Project, v.opts.Logstore, shard, strconv.FormatInt(w.Start.Add(-slack).Unix(), 10))
+	if err != nil {
+		return 0, err
+	}
+	endTime := w.End.Add(slack)
+	from := "end"
+	if endTime.Before(time.Now()) {
+		from = strconv.FormatInt(endTime.Unix(), 10)
+	}
+	endCursor, err := v.client.GetCursor(v.opts.Project, v.opts.Logstore, shard, from)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for cursor != endCursor {
+		gl, next, err := v.client.PullLogs(v.opts.Project, v.opts.Logstore, shard, cursor, endCursor, pullBatchSize)
+		if err != nil {
+			return total, err
+		}
+		if gl != nil && len(gl.LogGroups) > 0 {
+			source := &internal.Source{Project: v.opts.Project, Logstore: v.opts.Logstore, Shard: shard, Cursor: cursor}
+			b, _ := consumer.ToBatch(source, gl, includeMeta)
+			records := b.Records[:0]
+			for _, r := range b.Records {
+				if !r.Time.Before(w.Start) && r.Time.Before(w.End) {
+					records = append(records, r)
+				}
+			}
+			b.Records = records
+			total += len(records)
+			if err = consume(b); err != nil {
+				return total, err
+			}
+		}
+		if next == "" || next == cursor {
+			break
+		}
+		cursor = next
+	}
+	return total, nil
+}
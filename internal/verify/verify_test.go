@@ -0,0 +1,151 @@
+package verify
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/go-kit/kit/log"
+
+	"github.com/fengxsong/sls2oss/internal/manifest"
+)
+
+// fakeOSS serve listing and getting objects of a bucket
+type fakeOSS map[string]string
+
+func (f fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		body, ok := f[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		fmt.Fprint(w, body)
+		return
+	}
+	type object struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []object `xml:"Contents"`
+	}{}
+	for k, v := range f {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			result.Contents = append(result.Contents, object{Key: k, Size: len(v)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newBucket(t *testing.T, objects fakeOSS) *oss.Bucket {
+	srv := httptest.NewServer(objects)
+	t.Cleanup(srv.Close)
+	client, err := oss.New(srv.URL, "id", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.Bucket("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+func TestWindowStatus(t *testing.T) {
+	tests := []struct {
+		sls, archived int64
+		expected      string
+	}{
+		{sls: 0, archived: 0, expected: StatusOK},
+		{sls: 10, archived: 10, expected: StatusOK},
+		{sls: 10, archived: 0, expected: StatusMissing},
+		{sls: 10, archived: 4, expected: StatusGap},
+		{sls: 10, archived: 11, expected: StatusDuplicate},
+		{sls: 0, archived: 1, expected: StatusDuplicate},
+	}
+	for _, tt := range tests {
+		w := &Window{SLS: tt.sls, Archived: tt.archived}
+		if got := w.Status(); got != tt.expected {
+			t.Errorf("status of %d archived of %d is %s, expected %s", tt.archived, tt.sls, got, tt.expected)
+		}
+	}
+}
+
+func TestCountArchived(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	manifestOf := func(start time.Time, records int) string {
+		b, _ := json.Marshal(&manifest.Manifest{Start: start, End: start.Add(time.Hour), Records: records})
+		return string(b)
+	}
+	// 2 records in window, 1 after it
+	records := `{"@timestamp":"2021-06-01T00:10:00Z"}` + "\n" +
+		`{"@timestamp":"2021-06-01T00:20:00Z"}` + "\n" +
+		`{"@timestamp":"2021-06-01T01:10:00Z"}` + "\n"
+	tests := []struct {
+		name           string
+		source         string
+		objects        fakeOSS
+		expected       int64
+		expectedSource string
+	}{
+		{
+			name:           "manifest",
+			objects:        fakeOSS{"a/_manifest.json": manifestOf(start, 5), "a/1.json": records},
+			expected:       5,
+			expectedSource: SourceManifest,
+		},
+		{
+			name:           "manifests of prefixes",
+			objects:        fakeOSS{"a/_manifest.json": manifestOf(start, 5), "b/_manifest.json": manifestOf(start, 2)},
+			expected:       7,
+			expectedSource: SourceManifest,
+		},
+		{
+			name:           "without manifest",
+			objects:        fakeOSS{"a/1.json": records, "b/1.json": records},
+			expected:       4,
+			expectedSource: SourceObjects,
+		},
+		{
+			name:           "manifest of another window",
+			objects:        fakeOSS{"a/_manifest.json": manifestOf(end, 5), "a/1.json": records},
+			expected:       2,
+			expectedSource: SourceObjects,
+		},
+		{
+			name:           "objects source",
+			source:         SourceObjects,
+			objects:        fakeOSS{"a/_manifest.json": manifestOf(start, 5), "a/1.json": records},
+			expected:       2,
+			expectedSource: SourceObjects,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New(nil, newBucket(t, tt.objects), nil, Options{Source: tt.source, Manifest: "_manifest.json"}, log.NewNopLogger())
+			w := &Window{Start: start, End: end, Prefixes: []string{"a/", "b/"}}
+			if err := v.countArchived(w); err != nil {
+				t.Fatal(err)
+			}
+			if w.Archived != tt.expected || w.Source != tt.expectedSource {
+				t.Errorf("archived %d from %s, expected %d from %s", w.Archived, w.Source, tt.expected, tt.expectedSource)
+			}
+		})
+	}
+}
@@ -27,3 +27,8 @@ func Version() string {
 	}
 	return string(b)
 }
+
+// Short return version only
+func Short() string {
+	return version
+}
@@ -0,0 +1,164 @@
+package watermark
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal/metrics"
+)
+
+// Tracker keep event-time watermarks of shards consumed by this process,
+// watermark of a shard is the latest event time of batches written from it,
+// or the time it was found caught up.
+type Tracker struct {
+	mu     sync.Mutex
+	expire time.Duration
+	shards map[string]*shard
+	// shards of logstores held by other consumers of the group, nil if
+	// the group is not checked yet
+	foreign map[string][]int
+}
+
+type shard struct {
+	mark    time.Time
+	updated time.Time
+	// batches handed over in order, not written yet
+	inflight []*flight
+}
+
+type flight struct {
+	latest time.Time
+	done   bool
+}
+
+// New create tracker, shards not updated within expire are considered
+// released to other consumers and no longer hold back the watermark.
+func New(expire time.Duration) *Tracker {
+	return &Tracker{
+		expire:  expire,
+		shards:  make(map[string]*shard),
+		foreign: make(map[string][]int),
+	}
+}
+
+// Key return key of shard in watermarks
+func Key(logstore string, shardId int) string {
+	return logstore + "/" + strconv.Itoa(shardId)
+}
+
+// Begin register a batch of shard with latest event time, which is handed
+// over to be written. The returned done must be called once records of the
+// batch are written, watermark only moves over batches written in order.
+func (t *Tracker) Begin(logstore string, shardId int, latest time.Time) (done func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.get(logstore, shardId)
+	f := &flight{latest: latest}
+	s.inflight = append(s.inflight, f)
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		f.done = true
+		for len(s.inflight) > 0 && s.inflight[0].done {
+			t.move(logstore, shardId, s, s.inflight[0].latest)
+			s.inflight = s.inflight[1:]
+		}
+		s.updated = time.Now()
+	}
+}
+
+func (t *Tracker) get(logstore string, shardId int) *shard {
+	key := Key(logstore, shardId)
+	s, ok := t.shards[key]
+	if !ok {
+		s = &shard{}
+		t.shards[key] = s
+	}
+	s.updated = time.Now()
+	return s
+}
+
+// move watermark of shard forward to ts
+func (t *Tracker) move(logstore string, shardId int, s *shard, ts time.Time) {
+	if ts.After(s.mark) {
+		s.mark = ts
+		metrics.ConsumerWatermarkTimestampSeconds.WithLabelValues(logstore, strconv.Itoa(shardId)).Set(float64(s.mark.Unix()))
+	}
+}
+
+// Advance move watermark of a caught up shard forward to ts, shards never
+// consumed by this process or with batches not written yet are ignored.
+func (t *Tracker) Advance(logstore string, shardId int, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.shards[Key(logstore, shardId)]
+	if !ok || len(s.inflight) > 0 {
+		return
+	}
+	t.move(logstore, shardId, s, ts)
+	s.updated = time.Now()
+}
+
+// SetForeign set shards of logstore held by other consumers of the group
+func (t *Tracker) SetForeign(logstore string, shardIds []int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if shardIds == nil {
+		shardIds = []int{}
+	}
+	t.foreign[logstore] = shardIds
+}
+
+// Complete return watermark of the whole consumer group of logstores, which
+// is only known if this process holds every shard of them. Progress of other
+// consumers is unknown, so false is returned if any shard is held by them.
+func (t *Tracker) Complete(logstores []string) (time.Time, bool) {
+	t.mu.Lock()
+	for _, ls := range logstores {
+		if shardIds, ok := t.foreign[ls]; !ok || len(shardIds) > 0 {
+			t.mu.Unlock()
+			return time.Time{}, false
+		}
+	}
+	t.mu.Unlock()
+	return t.Watermark()
+}
+
+// Watermark return the minimum watermark of active shards, false if there is none
+func (t *Tracker) Watermark() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var (
+		min   time.Time
+		found bool
+	)
+	for key, s := range t.shards {
+		if t.expired(s) {
+			delete(t.shards, key)
+			continue
+		}
+		if !found || s.mark.Before(min) {
+			min = s.mark
+			found = true
+		}
+	}
+	return min, found
+}
+
+// Shards return watermarks of active shards by key
+func (t *Tracker) Shards() map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	marks := make(map[string]time.Time, len(t.shards))
+	for key, s := range t.shards {
+		if !t.expired(s) {
+			marks[key] = s.mark
+		}
+	}
+	return marks
+}
+
+func (t *Tracker) expired(s *shard) bool {
+	return t.expire > 0 && time.Since(s.updated) > t.expire
+}
@@ -0,0 +1,127 @@
+package watermark
+
+import (
+	"testing"
+	"time"
+)
+
+var base = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func at(minutes int) time.Time {
+	return base.Add(time.Duration(minutes) * time.Minute)
+}
+
+func mark(t *testing.T, tr *Tracker, shardId int) time.Time {
+	m, ok := tr.Shards()[Key("ls", shardId)]
+	if !ok {
+		t.Fatalf("shard %d is not tracked", shardId)
+	}
+	return m
+}
+
+func TestOutOfOrderDone(t *testing.T) {
+	tr := New(time.Minute)
+	first := tr.Begin("ls", 0, at(1))
+	second := tr.Begin("ls", 0, at(2))
+	third := tr.Begin("ls", 0, at(3))
+
+	second()
+	if m := mark(t, tr, 0); !m.IsZero() {
+		t.Fatalf("watermark moved to %v past an unfinished earlier batch", m)
+	}
+	first()
+	if m := mark(t, tr, 0); !m.Equal(at(2)) {
+		t.Fatalf("watermark is %v after the first two batches, expected %v", m, at(2))
+	}
+	third()
+	if m := mark(t, tr, 0); !m.Equal(at(3)) {
+		t.Fatalf("watermark is %v after all batches, expected %v", m, at(3))
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	tests := []struct {
+		name     string
+		inflight bool
+		advance  time.Time
+		expected time.Time
+	}{
+		{name: "caught up", advance: at(5), expected: at(5)},
+		{name: "backward", advance: at(0), expected: at(1)},
+		{name: "batch in flight", inflight: true, advance: at(5), expected: at(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(time.Minute)
+			tr.Begin("ls", 0, at(1))()
+			if tt.inflight {
+				tr.Begin("ls", 0, at(2))
+			}
+			tr.Advance("ls", 0, tt.advance)
+			if m := mark(t, tr, 0); !m.Equal(tt.expected) {
+				t.Errorf("watermark is %v, expected %v", m, tt.expected)
+			}
+		})
+	}
+
+	// shards never consumed here are not tracked
+	tr := New(time.Minute)
+	tr.Advance("ls", 1, at(5))
+	if _, ok := tr.Watermark(); ok {
+		t.Error("watermark of shard never consumed")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tr := New(50 * time.Millisecond)
+	tr.Begin("ls", 0, at(1))()
+	tr.Begin("ls", 1, at(5))()
+	time.Sleep(75 * time.Millisecond)
+	tr.Begin("ls", 1, at(6))()
+
+	wm, ok := tr.Watermark()
+	if !ok || !wm.Equal(at(6)) {
+		t.Fatalf("watermark is %v %v, expected %v of the shard left", wm, ok, at(6))
+	}
+	if _, ok = tr.Shards()[Key("ls", 0)]; ok {
+		t.Error("expired shard is still tracked")
+	}
+
+	// never expire
+	tr = New(0)
+	tr.Begin("ls", 0, at(1))()
+	time.Sleep(time.Millisecond)
+	if _, ok = tr.Watermark(); !ok {
+		t.Error("shard expired without expire")
+	}
+}
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		name    string
+		foreign map[string][]int
+		ok      bool
+	}{
+		{name: "foreign unset", ok: false},
+		{name: "foreign empty", foreign: map[string][]int{"ls": nil, "other": {}}, ok: true},
+		{name: "foreign shards", foreign: map[string][]int{"ls": nil, "other": {1}}, ok: false},
+		{name: "foreign of a logstore unset", foreign: map[string][]int{"ls": nil}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := New(time.Minute)
+			tr.Begin("ls", 0, at(1))()
+			tr.Begin("other", 0, at(2))()
+			for ls, shardIds := range tt.foreign {
+				tr.SetForeign(ls, shardIds)
+			}
+			wm, ok := tr.Complete([]string{"ls", "other"})
+			if ok != tt.ok {
+				t.Fatalf("complete is %v, expected %v", ok, tt.ok)
+			}
+			if ok && !wm.Equal(at(1)) {
+				t.Errorf("watermark is %v, expected the minimum %v", wm, at(1))
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package writer
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+
+	"github.com/fengxsong/sls2oss/internal/metrics"
+)
+
+// metadata of client side encrypted objects, crc64 of content before encryption
+const plaintextCRC64Meta = "plaintext-crc64"
+
+// checksum of uploaded content, computed while it's compressed or encrypted,
+// so corruption of temp files before uploading is caught as well
+type checksum struct {
+	md5 hash.Hash
+	crc hash.Hash64
+}
+
+func newChecksum() *checksum {
+	return &checksum{md5: md5.New(), crc: crc64.New(crc64.MakeTable(crc64.ECMA))}
+}
+
+func (c *checksum) Write(p []byte) (int, error) {
+	c.md5.Write(p)
+	return c.crc.Write(p)
+}
+
+// Reset discard content written so far
+func (c *checksum) Reset() {
+	c.md5.Reset()
+	c.crc.Reset()
+}
+
+// ContentMD5 return base64 of md5, as Content-MD5 header
+func (c *checksum) ContentMD5() string {
+	return base64.StdEncoding.EncodeToString(c.md5.Sum(nil))
+}
+
+// MD5 return hex of md5
+func (c *checksum) MD5() string {
+	return hex.EncodeToString(c.md5.Sum(nil))
+}
+
+// CRC64 return decimal crc64 ecma, the same as x-oss-hash-crc64ecma
+func (c *checksum) CRC64() string {
+	return strconv.FormatUint(c.crc.Sum64(), 10)
+}
+
+// verify compare checksum with crc64 returned by oss
+func (c *checksum) verify(header http.Header) error {
+	remote := header.Get(oss.HTTPHeaderOssCRC64)
+	if remote == "" {
+		metrics.OssChecksumVerificationsTotal.WithLabelValues("unverified").Inc()
+		return nil
+	}
+	if local := c.CRC64(); remote != local {
+		return &checksumError{local: local, remote: remote}
+	}
+	metrics.OssChecksumVerificationsTotal.WithLabelValues("match").Inc()
+	return nil
+}
+
+// checksumError is returned if crc64 of uploaded object differs from the local one
+type checksumError struct {
+	local, remote string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("crc64 of uploaded object is %s, expected %s", e.remote, e.local)
+}
+
+// isChecksumMismatch report whether err means content is corrupted on the way,
+// which is detected by us, by sdk or by oss with Content-MD5
+func isChecksumMismatch(err error) bool {
+	switch e := err.(type) {
+	case *checksumError, oss.CRCCheckError:
+		return true
+	case oss.ServiceError:
+		return e.Code == "InvalidDigest"
+	}
+	return false
+}
+
+// sumFile write content of file into sum
+func sumFile(sum *checksum, path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = io.Copy(sum, fp)
+	return err
+}
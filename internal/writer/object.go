@@ -0,0 +1,129 @@
+package writer
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/version"
+)
+
+const (
+	// records are encoded as lines of json
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeBinary = "application/octet-stream"
+	codecGzip         = "gzip"
+	codecNone         = "none"
+
+	maxTagValueLength = 256
+)
+
+var hostname, _ = os.Hostname()
+
+// contentOptions set Content-Type and Content-Encoding of object key. Encrypted
+// objects are opaque, so encoding is not announced as clients can't decode them.
+func contentOptions(cfg *config.OssConfig, key string) []oss.Option {
+	if cfg.Encryption.ClientSide != "" {
+		return []oss.Option{oss.ContentType(contentTypeBinary)}
+	}
+	options := []oss.Option{oss.ContentType(contentTypeNDJSON)}
+	if objectCodec(key) == codecGzip {
+		options = append(options, oss.ContentEncoding(codecGzip))
+	}
+	return options
+}
+
+// metadataOptions render user metadata and tagging of object key summarized by stat
+func metadataOptions(cfg *config.OssConfig, key string, stat FileStat) []oss.Option {
+	var options []oss.Option
+	resolve := objectVarResolver(key, stat)
+	for _, k := range sortedKeys(cfg.Metadata) {
+		options = append(options, oss.Meta(k, keytpl.RenderFile(cfg.Metadata[k], resolve)))
+	}
+	if len(cfg.Tagging) > 0 {
+		var tagging oss.Tagging
+		for _, k := range sortedKeys(cfg.Tagging) {
+			tagging.Tags = append(tagging.Tags, oss.Tag{Key: k, Value: tagValue(keytpl.RenderFile(cfg.Tagging[k], resolve))})
+		}
+		options = append(options, oss.SetTagging(tagging))
+	}
+	return options
+}
+
+// objectVarResolver resolve variables of metadata and tagging templates
+func objectVarResolver(key string, stat FileStat) keytpl.Resolver {
+	return func(name string) (string, bool) {
+		var v string
+		switch name {
+		case "topic":
+			v = getTopicFromObjectKey(key)
+		case "logstore":
+			v = strings.Join(stat.Logstores, ",")
+		case "shard":
+			shards := make([]string, len(stat.Shards))
+			for i, shard := range stat.Shards {
+				shards[i] = strconv.Itoa(shard)
+			}
+			v = strings.Join(shards, ",")
+		case "records":
+			v = strconv.Itoa(stat.Records)
+		case "min_time":
+			v = formatTime(stat.MinTime)
+		case "max_time":
+			v = formatTime(stat.MaxTime)
+		case "codec":
+			v = objectCodec(key)
+		case "hostname":
+			v = hostname
+		case "version":
+			v = version.Short()
+		}
+		return v, v != ""
+	}
+}
+
+func objectCodec(key string) string {
+	if strings.HasSuffix(key, gzExtension) {
+		return codecGzip
+	}
+	return codecNone
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// tagValue replace characters not allowed in tag values with `_`
+func tagValue(s string) string {
+	b := []byte(s)
+	if len(b) > maxTagValueLength {
+		b = b[:maxTagValueLength]
+	}
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte(" +-=._:/", c) >= 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
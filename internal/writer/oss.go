@@ -1,13 +1,21 @@
 package writer
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,12 +23,28 @@ import (
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/fengxsong/sls2oss/internal"
 	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/credentials"
+	"github.com/fengxsong/sls2oss/internal/envelope"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/manifest"
 	"github.com/fengxsong/sls2oss/internal/metrics"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/tracing"
 )
 
-const gzExtension = ".gz"
+const (
+	gzExtension  = ".gz"
+	encExtension = ".enc"
+	maxLineSize  = 16 * megabyte
+	// attempts of uploading an object whose checksum mismatches
+	uploadAttempts = 3
+)
 
 // oss writer wrap rotateWriter
 type OssWriter struct {
@@ -31,8 +55,37 @@ type OssWriter struct {
 	ossBucketClient *oss.Bucket
 	// simple mutex to ensure thread safe
 	files map[string]*RotateWriter
-	wg    *sync.WaitGroup
-	mu    sync.Mutex
+	// uploads in flight, including files closed but not sent yet
+	wg *sync.WaitGroup
+	mu sync.Mutex
+	// closed by Close, rotate writers close their files then
+	closing   chan struct{}
+	closeOnce sync.Once
+	// files being sent, so orphan sync will not send them twice
+	sending map[string]struct{}
+	// files closed or left by previous runs but not uploaded yet, including
+	// failed ones, partitions of them are busy until they're uploaded
+	unsent    map[string]struct{}
+	sendingMu sync.Mutex
+	// time of the first upload failure since last success
+	failingSince time.Time
+	failingMu    sync.Mutex
+	// records uploaded objects if it's set
+	manifest *manifest.Recorder
+	// close files of partitions passed by watermark if it's set
+	watermark    func() (time.Time, bool)
+	watermarkCfg *config.Watermark
+	layout       *partition.Layout
+	// encrypt objects on client side if it's set
+	cipher *envelope.Cipher
+}
+
+// WriterInfo describe an open file of rotate writer
+type WriterInfo struct {
+	Pattern string          `json:"pattern"`
+	Path    string          `json:"path"`
+	Size    int64           `json:"size"`
+	Age     config.Duration `json:"age"`
 }
 
 func NewOssWriter(cfg *config.OssConfig, logger log.Logger, quit <-chan struct{}) (*OssWriter, error) {
@@ -40,13 +93,22 @@ func NewOssWriter(cfg *config.OssConfig, logger log.Logger, quit <-chan struct{}
 		logger = &nopLogger{}
 	}
 	w := &OssWriter{
-		cfg:    cfg,
-		quit:   quit,
-		logger: logger,
-		files:  make(map[string]*RotateWriter),
-		wg:     &sync.WaitGroup{},
+		cfg:     cfg,
+		quit:    quit,
+		logger:  logger,
+		files:   make(map[string]*RotateWriter),
+		wg:      &sync.WaitGroup{},
+		sending: make(map[string]struct{}),
+		unsent:  make(map[string]struct{}),
+		closing: make(chan struct{}),
 	}
-	ossClient, err := oss.New(w.cfg.Endpoint, w.cfg.AccessKeyID, w.cfg.AccessKeySecret)
+	w.walkTempDir(w.markUnsent)
+	provider, err := credentials.New(w.cfg.Credentials, logger)
+	if err != nil {
+		return nil, err
+	}
+	go provider.Run(quit)
+	ossClient, err := oss.New(w.cfg.Endpoint, "", "", oss.SetCredentialsProvider(provider))
 	if err != nil {
 		return nil, err
 	}
@@ -54,151 +116,692 @@ func NewOssWriter(cfg *config.OssConfig, logger log.Logger, quit <-chan struct{}
 	if err != nil {
 		return nil, err
 	}
+	if w.cipher, err = envelope.New(w.cfg.Encryption, provider); err != nil {
+		return nil, fmt.Errorf("invalid client side encryption: %v", err)
+	}
 	go w.loop()
 	return w, nil
 }
 
+// Bucket return client of output bucket
+func (w *OssWriter) Bucket() *oss.Bucket {
+	return w.ossBucketClient
+}
+
+// Cipher return cipher of client side encryption, nil if it's disabled
+func (w *OssWriter) Cipher() *envelope.Cipher {
+	return w.cipher
+}
+
+// UploadOptions return options of uploading archived object key summarized by stat
+func UploadOptions(cfg *config.OssConfig, key string, stat FileStat) []oss.Option {
+	var options []oss.Option
+	if cfg.StorageClassType != "" {
+		options = append(options, oss.ObjectStorageClass(oss.StorageClassType(cfg.StorageClassType)))
+	}
+	if cfg.Encryption.ServerSide != "" {
+		options = append(options, oss.ServerSideEncryption(cfg.Encryption.ServerSide))
+		if cfg.Encryption.ServerSide == "KMS" && cfg.Encryption.KMSKeyID != "" {
+			options = append(options, oss.ServerSideEncryptionKeyID(cfg.Encryption.KMSKeyID))
+		}
+	}
+	if cfg.Encryption.ClientSide != "" {
+		options = append(options, oss.Meta("client-side-encryption", envelope.Algorithm))
+	}
+	options = append(options, contentOptions(cfg, key)...)
+	return append(options, metadataOptions(cfg, key, stat)...)
+}
+
+// SetManifest set recorder of uploaded objects
+func (w *OssWriter) SetManifest(r *manifest.Recorder) {
+	w.manifest = r
+}
+
+// SetWatermark close files of partitions once watermark passes their end plus
+// allowed lateness, instead of waiting for close_inactive or max_age.
+func (w *OssWriter) SetWatermark(cfg *config.Watermark, watermark func() (time.Time, bool), layout *partition.Layout) {
+	w.watermarkCfg = cfg
+	w.watermark = watermark
+	w.layout = layout
+}
+
+// interval of measuring temp dir size
+const tempDirStatInterval = 30 * time.Second
+
 // clean file holder
 func (w *OssWriter) loop() {
 	ticker := time.NewTicker(time.Duration(w.cfg.ScanInterval))
-	for range ticker.C {
-		for n, rw := range w.files {
-			if rw.Closed() {
-				w.mu.Lock()
-				delete(w.files, n)
-				w.mu.Unlock()
+	statTicker := time.NewTicker(tempDirStatInterval)
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			for n, rw := range w.files {
+				if rw.Closed() {
+					delete(w.files, n)
+				}
 			}
+			metrics.WriterOpenFiles.Set(float64(len(w.files)))
+			w.mu.Unlock()
+			w.closePartitions()
+		case <-statTicker.C:
+			metrics.WriterTempDirBytes.Set(float64(dirSize(w.cfg.TempDir)))
 		}
 	}
 }
 
+// closePartitions close files whose records all belong to partitions passed by watermark
+func (w *OssWriter) closePartitions() {
+	if w.watermark == nil {
+		return
+	}
+	wm, ok := w.watermark()
+	if !ok {
+		return
+	}
+	cutoff := wm.Add(-time.Duration(w.watermarkCfg.AllowedLateness))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for pattern, rw := range w.files {
+		// late records are closed by timers as usual, or each of them makes an object
+		if strings.HasPrefix(pattern, w.watermarkCfg.LatePrefix+"/") {
+			continue
+		}
+		stat := rw.FileStat()
+		if stat.Records == 0 {
+			continue
+		}
+		if _, end := w.layout.Period(stat.MaxTime); end.After(cutoff) {
+			continue
+		}
+		level.Debug(w.logger).Log("msg", "close file of partition passed by watermark", "pattern", pattern, "watermark", wm)
+		if err := rw.Flush(); err != nil {
+			level.Error(w.logger).Log("msg", "failed to close by watermark", "pattern", pattern, "err", err)
+		}
+	}
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
 func (w *OssWriter) StartWait() error {
 	if !w.cfg.SyncOrphanedFiles {
 		return nil
 	}
+	return w.SyncOrphanedFiles()
+}
+
+// SyncOrphanedFiles send files left in temp dir, files opened by rotate
+// writers or being sent are skipped.
+func (w *OssWriter) SyncOrphanedFiles() error {
 	// for saving memory, do NOT use async.
-	err := filepath.Walk(w.cfg.TempDir, func(path string, info os.FileInfo, err error) error {
+	return w.walkTempDir(func(path string) {
+		// checked right before sending, as writers keep opening files while walking
+		if w.owned(path) {
+			return
+		}
+		var stat FileStat
+		if w.manifest != nil {
+			stat = scanFileStat(path)
+		}
+		w.send(context.Background(), path, stat)
+	})
+}
+
+// owned report whether path is the current file of a rotate writer
+func (w *OssWriter) owned(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, rw := range w.files {
+		if p, _, _ := rw.Stat(); p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// walkTempDir call fn with data files in temp dir, hidden dirs and files
+// made while uploading are skipped.
+func (w *OssWriter) walkTempDir(fn func(path string)) error {
+	return filepath.Walk(w.cfg.TempDir, func(path string, info os.FileInfo, err error) error {
 		// Lstat will only return one kind of error is 'pathErr', just ignore.
 		if err != nil {
 			return nil
 		}
-		if !info.IsDir() && !strings.HasSuffix(path, gzExtension) {
-			w.send(path)
+		if info.IsDir() {
+			// journals of manifest and so on
+			if path != w.cfg.TempDir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
 		}
+		if strings.HasSuffix(path, gzExtension) || strings.HasSuffix(path, encExtension) {
+			return nil
+		}
+		fn(path)
 		return nil
 	})
-	return err
 }
 
-// todo or fix: ensure wait happend after rotate writer close
-func (w *OssWriter) Wait() error {
-	<-w.quit
-	// very simple trick :)
-	time.Sleep(time.Second)
-	w.wg.Wait()
-	level.Info(w.logger).Log("msg", "about to exit oss writer")
-	return nil
+// Writers return open files of rotate writers
+func (w *OssWriter) Writers() []WriterInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	infos := make([]WriterInfo, 0, len(w.files))
+	for pattern, rw := range w.files {
+		path, size, age := rw.Stat()
+		if path == "" {
+			continue
+		}
+		infos = append(infos, WriterInfo{Pattern: pattern, Path: path, Size: size, Age: config.Duration(age)})
+	}
+	return infos
+}
+
+// Flush close file of rotate writer with pattern, or all of them if pattern is empty
+func (w *OssWriter) Flush(pattern string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if pattern != "" {
+		rw, ok := w.files[pattern]
+		if !ok {
+			return fmt.Errorf("writer %s not found", pattern)
+		}
+		return rw.Flush()
+	}
+	var lastErr error
+	for _, rw := range w.files {
+		if err := rw.Flush(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Close close all files so they're uploaded, it must be called after writes
+// are stopped, files opened by later writes are left for orphan sync.
+func (w *OssWriter) Close() error {
+	w.closeOnce.Do(func() { close(w.closing) })
+	return w.Flush("")
+}
+
+// Wait block until every upload is done or ctx is done, files left in temp dir
+// are returned in the latter case, which are sent by orphan sync next time.
+func (w *OssWriter) Wait(ctx context.Context) ([]string, error) {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		level.Info(w.logger).Log("msg", "all uploads are done")
+		return nil, nil
+	case <-ctx.Done():
+		return w.Pending(), ctx.Err()
+	}
+}
+
+// Pending return data files in temp dir which are not uploaded yet
+func (w *OssWriter) Pending() []string {
+	var files []string
+	w.walkTempDir(func(path string) { files = append(files, path) })
+	return files
 }
 
-// todo: limit number of rotateWriters, too many goroutines may cause panic
+// get return rotate writer of pattern, which is object key with file level
+// variables of key template not rendered yet.
 func (w *OssWriter) get(pattern string) (*RotateWriter, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	rw, ok := w.files[pattern]
 	if !ok {
+		if w.cfg.MaxOpenFiles > 0 && len(w.files) >= w.cfg.MaxOpenFiles {
+			return nil, fmt.Errorf("too many open files (%d), refuse to open %s", len(w.files), pattern)
+		}
 		var err error
 		// todo: check if argument is valid
-		rw, err = New(path.Join(w.cfg.TempDir, pattern), w.quit,
+		rw, err = New(path.Join(w.cfg.TempDir, pattern), w.closing,
+			WithFilenameFunc(func(seq int) string {
+				return filepath.Join(w.cfg.TempDir, keytpl.RenderFile(pattern, fileVarResolver(seq)))
+			}),
 			WithMaxSize(w.cfg.MaxSize),
 			WithMaxAge(time.Duration(w.cfg.MaxAge)),
 			WithScanInterval(time.Duration(w.cfg.ScanInterval)),
 			WithCloseInactive(time.Duration(w.cfg.CloseInactive)),
 			WithLogger(w.logger),
-			WithAsyncRotateCallback(w.send))
+			WithRenameFunc(cursorName),
+			WithCloseCallback(w.markUnsent),
+			WithAsyncRotateCallback(w.send),
+			WithWaitGroup(w.wg))
 		if err != nil {
 			return nil, err
 		}
 		w.files[pattern] = rw
+		metrics.WriterOpenFiles.Set(float64(len(w.files)))
 	}
 	return rw, nil
 }
 
 func (w *OssWriter) WriteTo(path string, data []byte) (n int, err error) {
+	return w.WriteRecords(path, data, FileStat{})
+}
+
+// WriteRecords write encoded records summarized by stat, objects are recorded
+// in manifest only if they contain records with event time.
+func (w *OssWriter) WriteRecords(path string, data []byte, stat FileStat) (n int, err error) {
 	rw, err := w.get(path)
 	if err != nil {
 		return 0, err
 	}
-	return rw.Write(data)
+	return rw.WriteRecords(data, stat)
+}
+
+func (w *OssWriter) markUnsent(path string) {
+	w.sendingMu.Lock()
+	defer w.sendingMu.Unlock()
+	w.unsent[path] = struct{}{}
+}
+
+func (w *OssWriter) markSent(path string) {
+	w.sendingMu.Lock()
+	defer w.sendingMu.Unlock()
+	delete(w.unsent, path)
+}
+
+// Busy report whether files of object directory are open or not uploaded yet,
+// failed uploads keep it busy until orphan sync uploads them.
+func (w *OssWriter) Busy(dir string) bool {
+	w.mu.Lock()
+	for pattern, rw := range w.files {
+		if path.Dir(pattern) == dir && !rw.Closed() {
+			w.mu.Unlock()
+			return true
+		}
+	}
+	w.mu.Unlock()
+	w.sendingMu.Lock()
+	defer w.sendingMu.Unlock()
+	for fn := range w.unsent {
+		if path.Dir(filepath.ToSlash(getObjectKeyFromPath(fn, w.cfg.TempDir))) == dir {
+			return true
+		}
+	}
+	return false
 }
 
 var bufPool = sync.Pool{
 	New: func() interface{} { return &bytes.Buffer{} },
 }
 
-func (w *OssWriter) send(path string) {
+func (w *OssWriter) send(ctx context.Context, path string, stat FileStat) {
 	level.Debug(w.logger).Log("sendfile", path)
 	w.wg.Add(1)
 	defer w.wg.Done()
 
+	w.sendingMu.Lock()
+	if _, ok := w.sending[path]; ok {
+		w.sendingMu.Unlock()
+		return
+	}
+	w.sending[path] = struct{}{}
+	w.sendingMu.Unlock()
+	defer func() {
+		w.sendingMu.Lock()
+		delete(w.sending, path)
+		w.sendingMu.Unlock()
+	}()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// uploaded by rotate callback and orphan sync at the same time
+		w.markSent(path)
+		return
+	}
+
 	if w.ossBucketClient == nil {
 		level.Warn(w.logger).Log("msg", "null oss bucket client")
 		return
 	}
+	_, span := tracing.Tracer().Start(ctx, "oss.upload", trace.WithAttributes(attribute.String("file.path", path)))
 	var err error
 	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
 		if err == nil {
 			os.Remove(path)
+			w.markSent(path)
 			level.Debug(w.logger).Log("msg", "remove file", "path", path)
 		}
 	}()
 
-	ossOptions := []oss.Option{}
-	if w.cfg.StorageClassType != "" {
-		ossOptions = append(ossOptions, oss.ObjectStorageClass(oss.StorageClassType(w.cfg.StorageClassType)))
-	}
-
+	uploadFile := path
+	sum := newChecksum()
 	if w.cfg.Compress {
 		buf := bufPool.Get().(*bytes.Buffer)
 		defer func() {
 			buf.Reset()
 			bufPool.Put(buf)
 		}()
-		gw, err := gzip.NewWriterLevel(buf, w.cfg.CompressLevel)
-		if err != nil {
-			level.Error(w.logger).Log("msg", "create gzip writer", "err", err)
-			return
-		}
-		fp, err := os.Open(path)
-		if err != nil {
-			level.Error(w.logger).Log("msg", "open file", "err", err)
-			return
-		}
-		defer fp.Close()
-		io.Copy(gw, fp)
-		if err = gw.Close(); err != nil {
-			level.Error(w.logger).Log("msg", "close gzipwriter", "err", err)
+		start := time.Now()
+		if err = gzipFile(io.MultiWriter(buf, sum), path, w.cfg.CompressLevel); err != nil {
+			level.Error(w.logger).Log("msg", "gzip file", "err", err)
+			metrics.OssUploadFailuresTotal.WithLabelValues("gzip").Inc()
 			return
 		}
+		metrics.WriterGzipDurationSeconds.Observe(time.Since(start).Seconds())
 		gzFile := path + gzExtension
 		if err = ioutil.WriteFile(gzFile, buf.Bytes(), 0644); err != nil {
 			level.Error(w.logger).Log("msg", "write gzip file", "err", err)
+			metrics.OssUploadFailuresTotal.WithLabelValues("write_gzip").Inc()
 			return
 		}
 		defer os.Remove(gzFile)
+		uploadFile = gzFile
+	}
 
-		objectKey := getObjectKeyFromPath(gzFile, w.cfg.TempDir)
-		level.Info(w.logger).Log("msg", "put object file", "object", objectKey, "gzfile", gzFile)
-		if err = w.ossBucketClient.PutObjectFromFile(objectKey, gzFile, ossOptions...); err != nil {
-			level.Error(w.logger).Log("msg", "send objectfile", "err", err)
+	objectKey := getObjectKeyFromPath(uploadFile, w.cfg.TempDir)
+	// cursors are rendered when files are closed, ones left are of files
+	// left by crash or of batches with unknown cursors
+	if hasHash, hasCursor := keytpl.HasHashPlaceholder(objectKey), keytpl.HasCursorPlaceholder(objectKey); hasHash || hasCursor {
+		// hash of uncompressed content, so it does not depend on compression settings
+		var hash string
+		if hash, err = contentHash(path); err != nil {
+			level.Error(w.logger).Log("msg", "hash file", "err", err)
+			metrics.OssUploadFailuresTotal.WithLabelValues("hash").Inc()
+			return
+		}
+		objectKey = keytpl.ReplaceHashPlaceholder(objectKey, hash)
+		objectKey = keytpl.ReplaceCursorPlaceholders(objectKey, unknownCursor, hash)
+	}
+	if !w.cfg.Compress {
+		if err = sumFile(sum, uploadFile); err != nil {
+			level.Error(w.logger).Log("msg", "checksum file", "err", err)
+			metrics.OssUploadFailuresTotal.WithLabelValues("io").Inc()
 			return
 		}
-		metrics.PipelineWriteBytesTotal.WithLabelValues(getTopicFromObjectKey(objectKey), "oss", "gzip").Add(float64(buf.Len()))
-		return
 	}
-	objectKey := getObjectKeyFromPath(path, w.cfg.TempDir)
-	level.Info(w.logger).Log("msg", "put object file", "object", objectKey, "file", path)
-	if err = w.ossBucketClient.PutObjectFromFile(objectKey, path, ossOptions...); err != nil {
+	// crc64 before encryption, ciphertext differs every time as keys are random
+	plainCRC64 := sum.CRC64()
+	options := UploadOptions(w.cfg, objectKey, stat)
+	if w.cipher != nil {
+		// compressed content is encrypted, as ciphertext does not compress
+		encFile := uploadFile + encExtension
+		sum.Reset()
+		if err = w.encryptFile(encFile, uploadFile, sum); err != nil {
+			level.Error(w.logger).Log("msg", "encrypt file", "err", err)
+			metrics.OssUploadFailuresTotal.WithLabelValues("encrypt").Inc()
+			return
+		}
+		defer os.Remove(encFile)
+		uploadFile = encFile
+		options = append(options, oss.Meta(plaintextCRC64Meta, plainCRC64))
+	}
+	span.SetAttributes(attribute.String("oss.crc64", sum.CRC64()))
+	if w.cfg.SkipExisting {
+		var same bool
+		if same, err = w.sameObjectExists(objectKey, plainCRC64); err != nil {
+			level.Error(w.logger).Log("msg", "check existing object", "object", objectKey, "err", err)
+			metrics.OssUploadFailuresTotal.WithLabelValues(failureReason(err)).Inc()
+			return
+		}
+		if same {
+			level.Info(w.logger).Log("msg", "skip object with same checksum", "object", objectKey, "file", uploadFile)
+			span.SetAttributes(attribute.Bool("oss.skipped", true))
+			w.record(objectKey, uploadFile, stat, sum)
+			return
+		}
+	}
+	span.SetAttributes(attribute.String("oss.object", objectKey))
+	level.Info(w.logger).Log("msg", "put object file", "object", objectKey, "file", uploadFile)
+	start := time.Now()
+	err = w.put(objectKey, uploadFile, sum, options)
+	w.recordUpload(err)
+	if err != nil {
+		// path is kept for orphan sync, as it's only removed on success
 		level.Error(w.logger).Log("msg", "send objectfile", "err", err)
+		metrics.OssUploadFailuresTotal.WithLabelValues(failureReason(err)).Inc()
+		return
+	}
+	metrics.OssUploadDurationSeconds.Observe(time.Since(start).Seconds())
+	w.record(objectKey, uploadFile, stat, sum)
+	if info, statErr := os.Stat(uploadFile); statErr == nil {
+		metrics.OssObjectSizeBytes.Observe(float64(info.Size()))
+		span.SetAttributes(attribute.Int64("oss.object_size", info.Size()))
+	}
+	if w.cfg.Compress {
+		if info, statErr := os.Stat(uploadFile); statErr == nil {
+			metrics.PipelineWriteBytesTotal.WithLabelValues(getTopicFromObjectKey(objectKey), "oss", "gzip").Add(float64(info.Size()))
+		}
+	}
+}
+
+// put upload file with Content-MD5 and verify crc64 of what's stored, it's
+// uploaded again on checksum mismatch. An object failed every attempt is
+// deleted, so readers never see corrupted content.
+func (w *OssWriter) put(objectKey, uploadFile string, sum *checksum, options []oss.Option) error {
+	options = append(options, oss.ContentMD5(sum.ContentMD5()))
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		var header http.Header
+		err = w.ossBucketClient.PutObjectFromFile(objectKey, uploadFile, append(options, oss.GetResponseHeader(&header))...)
+		if err == nil {
+			err = sum.verify(header)
+		}
+		if !isChecksumMismatch(err) {
+			return err
+		}
+		metrics.OssChecksumVerificationsTotal.WithLabelValues("mismatch").Inc()
+		level.Warn(w.logger).Log("msg", "checksum mismatch", "object", objectKey, "attempt", attempt, "err", err)
+	}
+	if derr := w.ossBucketClient.DeleteObject(objectKey); derr != nil {
+		level.Error(w.logger).Log("msg", "delete corrupted object", "object", objectKey, "err", derr)
+	}
+	return err
+}
+
+// failureReason return error code of oss, or a rough category of err
+func failureReason(err error) string {
+	switch e := err.(type) {
+	case oss.ServiceError:
+		return e.Code
+	case oss.UnexpectedStatusCodeError:
+		return "unexpected_status"
+	case oss.CRCCheckError, *checksumError:
+		return "crc_mismatch"
+	case *os.PathError:
+		return "io"
+	}
+	return "network"
+}
+
+// record add uploaded object to manifest
+func (w *OssWriter) record(objectKey, uploadFile string, stat FileStat, sum *checksum) {
+	if w.manifest == nil || stat.Records == 0 || stat.MaxTime.IsZero() {
+		return
+	}
+	e := manifest.Entry{
+		Key:        objectKey,
+		Records:    stat.Records,
+		MinTime:    stat.MinTime,
+		MaxTime:    stat.MaxTime,
+		CRC64:      sum.CRC64(),
+		MD5:        sum.MD5(),
+		UploadedAt: time.Now(),
+		Logstores:  stat.Logstores,
+		Shards:     stat.Shards,
+	}
+	if info, err := os.Stat(uploadFile); err == nil {
+		e.Size = info.Size()
+	}
+	if err := w.manifest.Add(e); err != nil {
+		level.Error(w.logger).Log("msg", "add object to manifest", "object", objectKey, "err", err)
+	}
+}
+
+// scanFileStat summarize records of a file left by previous runs, which are
+// lines of json with event time.
+func scanFileStat(path string) FileStat {
+	var stat FileStat
+	fp, err := os.Open(path)
+	if err != nil {
+		return stat
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		// same as internal.TimeKey
+		var r struct {
+			Time time.Time `json:"@timestamp"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || r.Time.IsZero() {
+			continue
+		}
+		stat.Add(FileStat{Records: 1, MinTime: r.Time, MaxTime: r.Time})
+	}
+	return stat
+}
+
+func (w *OssWriter) recordUpload(err error) {
+	w.failingMu.Lock()
+	defer w.failingMu.Unlock()
+	if err == nil {
+		w.failingSince = time.Time{}
+	} else if w.failingSince.IsZero() {
+		w.failingSince = time.Now()
+	}
+}
+
+// UploadFailingSince return time of the first failure of continuous upload
+// failures, zero time if the last upload succeeded.
+func (w *OssWriter) UploadFailingSince() time.Time {
+	w.failingMu.Lock()
+	defer w.failingMu.Unlock()
+	return w.failingSince
+}
+
+// encryptFile encrypt src into dst, ciphertext is written into sum as well
+func (w *OssWriter) encryptFile(dst, src string, sum io.Writer) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	ew, err := w.cipher.NewWriter(io.MultiWriter(out, sum))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(ew, in); err != nil {
+		return err
+	}
+	if err = ew.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func gzipFile(dst io.Writer, path string, compressLevel int) error {
+	gw, err := gzip.NewWriterLevel(dst, compressLevel)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err = io.Copy(gw, fp); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// contentHash return the first 128 bits of sha256 of file content in hex
+func contentHash(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// sameObjectExists report whether object exists with the same crc64 of
+// content before encryption, which is kept in metadata of encrypted objects
+func (w *OssWriter) sameObjectExists(objectKey, crc64 string) (bool, error) {
+	header, err := w.ossBucketClient.GetObjectDetailedMeta(objectKey)
+	if err != nil {
+		if serr, ok := err.(oss.ServiceError); ok && serr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	remote := header.Get(oss.HTTPHeaderOssCRC64)
+	if w.cipher != nil {
+		remote = header.Get(oss.HTTPHeaderOssMetaPrefix + plaintextCRC64Meta)
+	}
+	return remote != "" && remote == crc64, nil
+}
+
+// seqBase offset {seq} by startup time, so file names keep increasing across
+// restarts instead of starting over and overwriting objects uploaded before
+var seqBase = time.Now().Unix() * 1000000
+
+// unknownCursor is rendered as the begin cursor of files whose cursors are
+// unknown, the end cursor is their content hash, so they're kept apart
+const unknownCursor = "unknown"
+
+// cursorName render placeholders of cursors of closed file with sequence
+// numbers of its cursor range, so files of the same batches get the same name
+func cursorName(path string, stat FileStat) string {
+	if !keytpl.HasCursorPlaceholder(path) {
+		return path
+	}
+	begin, ok := internal.DecodeCursor(stat.FirstCursor)
+	if !ok {
+		return path
+	}
+	end, ok := internal.DecodeCursor(stat.NextCursor)
+	if !ok {
+		return path
+	}
+	return keytpl.ReplaceCursorPlaceholders(path, strconv.FormatInt(begin, 10), strconv.FormatInt(end, 10))
+}
+
+func fileVarResolver(seq int) keytpl.Resolver {
+	return func(name string) (string, bool) {
+		switch name {
+		case "seq":
+			return strconv.FormatInt(seqBase+int64(seq), 10), true
+		case "unix":
+			return strconv.FormatInt(time.Now().Unix(), 10), true
+		case "rand":
+			return RandStringRunes(5), true
+		case keytpl.HashVar:
+			return keytpl.HashPlaceholder(RandStringRunes(8)), true
+		case keytpl.CursorBeginVar, keytpl.CursorEndVar:
+			return keytpl.CursorPlaceholder(name, RandStringRunes(8)), true
+		}
+		return "", false
 	}
 }
 
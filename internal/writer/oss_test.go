@@ -0,0 +1,134 @@
+package writer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+)
+
+func newTestOssWriter(t *testing.T, endpoint string) *OssWriter {
+	cfg := &config.OssConfig{
+		Endpoint:        endpoint,
+		AccessKeyID:     "id",
+		AccessKeySecret: "secret",
+		Bucket:          "bucket",
+		TempDir:         t.TempDir(),
+		ScanInterval:    config.Duration(time.Second),
+	}
+	if err := cfg.ValidateAndSetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	t.Cleanup(func() { close(quit) })
+	w, err := NewOssWriter(cfg, nil, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func wait(t *testing.T, w *OssWriter) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := w.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBusy(t *testing.T) {
+	var failing int32 = 1
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code></Error>`))
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("x-oss-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(b, crc64.MakeTable(crc64.ECMA)), 10))
+	}))
+	defer srv.Close()
+	w := newTestOssWriter(t, srv.URL)
+
+	if _, err := w.WriteRecords("logstore/2021/data.json", []byte("{}\n"), FileStat{Records: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Busy("logstore/2021") {
+		t.Error("partition of open file is not busy")
+	}
+	if w.Busy("logstore/2022") {
+		t.Error("partition without files is busy")
+	}
+	if err := w.Flush(""); err != nil {
+		t.Fatal(err)
+	}
+	// closed but not sent yet
+	if !w.Busy("logstore/2021") {
+		t.Error("partition of file being uploaded is not busy")
+	}
+	close(release)
+	wait(t, w)
+	if !w.Busy("logstore/2021") {
+		t.Error("partition of failed upload is not busy")
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	if err := w.SyncOrphanedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, w)
+	if w.Busy("logstore/2021") {
+		t.Error("partition is busy after orphan sync")
+	}
+}
+
+func TestCursorNaming(t *testing.T) {
+	batch := func(first, next int64) FileStat {
+		return FileStat{Records: 1, FirstCursor: internal.EncodeCursor(first), NextCursor: internal.EncodeCursor(next)}
+	}
+	data := []byte("{}\n")
+	sum := sha256.Sum256(append(append([]byte(nil), data...), data...))
+	tests := []struct {
+		name        string
+		stats       []FileStat
+		expectedKey string
+	}{
+		{name: "range of batches", stats: []FileStat{batch(100, 104), batch(104, 110)}, expectedKey: "/bucket/ls/0-100-110"},
+		{name: "sub batches out of order", stats: []FileStat{batch(104, 110), batch(100, 104)}, expectedKey: "/bucket/ls/0-100-110"},
+		{name: "unknown cursor", stats: []FileStat{batch(100, 104), {Records: 1}}, expectedKey: "/bucket/ls/0-unknown-" + hex.EncodeToString(sum[:16])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, objects := newFakeOSS(t)
+			w := newTestOssWriter(t, srv.URL)
+			for _, stat := range tt.stats {
+				if _, err := w.WriteRecords("ls/0-{cursor_begin}-{cursor_end}", data, stat); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			wait(t, w)
+			if _, ok := objects[tt.expectedKey]; !ok || len(objects) != 1 {
+				keys := make([]string, 0, len(objects))
+				for k := range objects {
+					keys = append(keys, k)
+				}
+				t.Errorf("uploaded %v, expected %s", keys, tt.expectedKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package writer
+
+import (
+	"context"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/fengxsong/sls2oss/internal/tracing"
+)
+
+// newFakeOSS accept uploads of objects and answer crc64 of them
+func newFakeOSS(t *testing.T) (*httptest.Server, map[string][]byte) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		objects[r.URL.Path] = b
+		mu.Unlock()
+		w.Header().Set("x-oss-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(b, crc64.MakeTable(crc64.ECMA)), 10))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, objects
+}
+
+// spanExporter keep spans after shutdown, which exports spans queued in
+// batcher, while ForceFlush does not
+type spanExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (e spanExporter) Shutdown(context.Context) error { return nil }
+
+func TestUploadSpans(t *testing.T) {
+	exporter := spanExporter{tracetest.NewInMemoryExporter()}
+	tp := tracing.NewProvider(exporter, "test", 1)
+	otel.SetTracerProvider(tp)
+
+	srv, objects := newFakeOSS(t)
+	w := newTestOssWriter(t, srv.URL)
+	if _, err := w.WriteRecords("logstore/data.json", []byte("{}\n"), FileStat{Records: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, w)
+	if _, ok := objects["/bucket/logstore/data.json"]; !ok {
+		t.Fatalf("object is not uploaded, got %d objects", len(objects))
+	}
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	file, ok := spans["writer.file"]
+	if !ok {
+		t.Fatal("span writer.file is not exported")
+	}
+	upload, ok := spans["oss.upload"]
+	if !ok {
+		t.Fatal("span oss.upload is not exported")
+	}
+	if upload.Parent.SpanID() != file.SpanContext.SpanID() {
+		t.Error("oss.upload is not a child of writer.file")
+	}
+	if upload.Status.Code != 0 {
+		t.Errorf("unexpected status of oss.upload %v", upload.Status)
+	}
+	for _, kv := range file.Attributes {
+		if kv.Key == "file.records" && kv.Value.AsInt64() != 1 {
+			t.Errorf("file.records is %d, expected 1", kv.Value.AsInt64())
+		}
+	}
+}
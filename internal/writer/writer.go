@@ -1,17 +1,24 @@
 package writer
 
 import (
+	"context"
 	"errors"
 	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/tracing"
 )
 
 const (
@@ -27,17 +34,99 @@ type RotateWriter struct {
 	maxAge              time.Duration
 	closeInactive       time.Duration
 	scanInterval        time.Duration
-	asyncRotateCallback func(string)
+	asyncRotateCallback func(context.Context, string, FileStat)
+	closeCallback       func(string)
+	renameFunc          func(string, FileStat) string
+	filenameFunc        func(seq int) string
+	wg                  *sync.WaitGroup
 	// runtime infos
 	quit      <-chan struct{}
 	size      int64    // current size
 	fn        string   // store current filename with time
+	seq       int      // number of files opened
+	stat      FileStat // records written to current file
 	file      *os.File // file holder
 	createdAt time.Time
+	span      trace.Span // lifecycle of current file, from open to close
 	logger    log.Logger
 	mu        sync.Mutex
 }
 
+// FileStat summarize records written to a file
+type FileStat struct {
+	Records int
+	MinTime time.Time
+	MaxTime time.Time
+	// sorted logstores and shards records come from, unknown for files left by previous runs
+	Logstores []string
+	Shards    []int
+	// cursor range [FirstCursor, NextCursor) of batches records come from,
+	// empty if cursor of any batch is unknown
+	FirstCursor string
+	NextCursor  string
+}
+
+// Add merge stat of other records into s
+func (s *FileStat) Add(o FileStat) {
+	switch {
+	case s.Records == 0:
+		s.FirstCursor, s.NextCursor = o.FirstCursor, o.NextCursor
+	case s.FirstCursor == "" || o.FirstCursor == "":
+		s.FirstCursor, s.NextCursor = "", ""
+	default:
+		// sub batches of workers may be written out of order
+		if cursorBefore(o.FirstCursor, s.FirstCursor) {
+			s.FirstCursor = o.FirstCursor
+		}
+		if cursorBefore(s.NextCursor, o.NextCursor) {
+			s.NextCursor = o.NextCursor
+		}
+	}
+	s.Records += o.Records
+	if !o.MinTime.IsZero() && (s.MinTime.IsZero() || o.MinTime.Before(s.MinTime)) {
+		s.MinTime = o.MinTime
+	}
+	if o.MaxTime.After(s.MaxTime) {
+		s.MaxTime = o.MaxTime
+	}
+	s.Logstores = unionStrings(s.Logstores, o.Logstores)
+	s.Shards = unionInts(s.Shards, o.Shards)
+}
+
+// cursorBefore report whether sequence number of cursor a is less than b's
+func cursorBefore(a, b string) bool {
+	x, _ := internal.DecodeCursor(a)
+	y, _ := internal.DecodeCursor(b)
+	return x < y
+}
+
+// unionStrings return sorted union of a and b, a is copied instead of being
+// modified in place, as stats are passed by value
+func unionStrings(a, b []string) []string {
+	for _, v := range b {
+		i := sort.SearchStrings(a, v)
+		if i < len(a) && a[i] == v {
+			continue
+		}
+		a = append(a[:len(a):len(a)], v)
+		sort.Strings(a)
+	}
+	return a
+}
+
+// unionInts is unionStrings of ints
+func unionInts(a, b []int) []int {
+	for _, v := range b {
+		i := sort.SearchInts(a, v)
+		if i < len(a) && a[i] == v {
+			continue
+		}
+		a = append(a[:len(a):len(a)], v)
+		sort.Ints(a)
+	}
+	return a
+}
+
 type Option func(*RotateWriter)
 
 func WithMaxSize(size int) Option {
@@ -70,12 +159,44 @@ func WithLogger(logger log.Logger) Option {
 	}
 }
 
-func WithAsyncRotateCallback(cb func(string)) Option {
+// WithAsyncRotateCallback set func called with closed file and its stat, ctx carries span of the file
+func WithAsyncRotateCallback(cb func(context.Context, string, FileStat)) Option {
 	return func(w *RotateWriter) {
 		w.asyncRotateCallback = cb
 	}
 }
 
+// WithCloseCallback set func called with closed file before async rotate
+// callback is started, so callers never miss a file not uploaded yet
+func WithCloseCallback(cb func(string)) Option {
+	return func(w *RotateWriter) {
+		w.closeCallback = cb
+	}
+}
+
+// WithRenameFunc set func returning new name of closed file with its stat,
+// the file is renamed before callbacks are called
+func WithRenameFunc(fn func(string, FileStat) string) Option {
+	return func(w *RotateWriter) {
+		w.renameFunc = fn
+	}
+}
+
+// WithWaitGroup add callbacks to wg before they're started, so waiting on wg
+// never misses a file just closed
+func WithWaitGroup(wg *sync.WaitGroup) Option {
+	return func(w *RotateWriter) {
+		w.wg = wg
+	}
+}
+
+// WithFilenameFunc set func to generate filenames, seq is the number of files opened before
+func WithFilenameFunc(fn func(seq int) string) Option {
+	return func(w *RotateWriter) {
+		w.filenameFunc = fn
+	}
+}
+
 type nopLogger struct{}
 
 func (l *nopLogger) Log(_ ...interface{}) error { return nil }
@@ -101,6 +222,11 @@ func New(pattern string, quit <-chan struct{}, opts ...Option) (*RotateWriter, e
 }
 
 func (w *RotateWriter) Write(p []byte) (n int, err error) {
+	return w.WriteRecords(p, FileStat{})
+}
+
+// WriteRecords write encoded records summarized by stat
+func (w *RotateWriter) WriteRecords(p []byte, stat FileStat) (n int, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	writeLen := int64(len(p))
@@ -120,6 +246,7 @@ func (w *RotateWriter) Write(p []byte) (n int, err error) {
 	}
 	n, err = w.file.Write(p)
 	w.size += int64(n)
+	w.stat.Add(stat)
 	return n, nil
 }
 
@@ -133,7 +260,9 @@ func (w *RotateWriter) openFile(writeLen int64) error {
 		return err
 	}
 	if info.Size()+int64(writeLen) > int64(w.max()) {
-		return w.rotate()
+		// leave the existing file as it is
+		w.fn = ""
+		return w.openNew()
 	}
 	file, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
@@ -159,6 +288,8 @@ func (w *RotateWriter) loop() {
 				}
 			}
 		case <-w.quit:
+			// close current file, writes after quit open new files which are
+			// left for orphan sync
 			w.mu.Lock()
 			if err := w.close(); err != nil {
 				level.Error(w.logger).Log("msg", "failed to close", "err", err)
@@ -170,6 +301,30 @@ func (w *RotateWriter) loop() {
 	}
 }
 
+// Stat return current file with its size and age, empty path means no file opened
+func (w *RotateWriter) Stat() (path string, size int64, age time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return "", 0, 0
+	}
+	return w.fn, w.size, time.Since(w.createdAt)
+}
+
+// FileStat return stat of records written to current file
+func (w *RotateWriter) FileStat() FileStat {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stat
+}
+
+// Flush close current file, so it's uploaded by rotate callback
+func (w *RotateWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
 func (w *RotateWriter) rotate() error {
 	if err := w.close(); err != nil {
 		return err
@@ -187,18 +342,47 @@ func (w *RotateWriter) close() error {
 	}
 	level.Debug(w.logger).Log("msg", "trying to close file", "path", w.filename())
 	err := w.file.Close()
+	ctx := context.Background()
+	if w.span != nil {
+		w.span.SetAttributes(attribute.Int64("file.size", w.size), attribute.Int("file.records", w.stat.Records))
+		w.span.End()
+		ctx = trace.ContextWithSpan(ctx, w.span)
+		w.span = nil
+	}
+	fn := w.filename()
+	if w.renameFunc != nil && err == nil {
+		if to := w.renameFunc(fn, w.stat); to != fn {
+			if rerr := os.Rename(fn, to); rerr != nil {
+				level.Error(w.logger).Log("msg", "failed to rename closed file", "path", fn, "err", rerr)
+			} else {
+				fn = to
+			}
+		}
+	}
+	if w.closeCallback != nil {
+		w.closeCallback(fn)
+	}
 	if w.asyncRotateCallback != nil {
-		go w.asyncRotateCallback(w.filename())
+		if w.wg != nil {
+			w.wg.Add(1)
+		}
+		go func(fn string, stat FileStat) {
+			if w.wg != nil {
+				defer w.wg.Done()
+			}
+			w.asyncRotateCallback(ctx, fn, stat)
+		}(fn, w.stat)
 	}
 	w.file = nil
 	w.size = 0
+	w.stat = FileStat{}
+	// reset filename, next file will get a new one
+	w.fn = ""
 	return err
 }
 
 func (w *RotateWriter) openNew() error {
 	level.Debug(w.logger).Log("msg", "create new file")
-	// reset filename
-	w.fn = ""
 	if err := os.MkdirAll(path.Dir(w.filename()), 0755); err != nil {
 		return err
 	}
@@ -208,12 +392,19 @@ func (w *RotateWriter) openNew() error {
 	}
 	w.file = f
 	w.createdAt = time.Now()
+	_, w.span = tracing.Tracer().Start(context.Background(), "writer.file",
+		trace.WithAttributes(attribute.String("file.path", w.filename())))
 	return nil
 }
 
 func (w *RotateWriter) filename() string {
 	if w.fn == "" {
-		w.fn = filepath.Join(w.pattern, RandStringRunes(5)+"-"+strconv.Itoa(int(time.Now().Unix())))
+		if w.filenameFunc != nil {
+			w.fn = w.filenameFunc(w.seq)
+		} else {
+			w.fn = filepath.Join(w.pattern, RandStringRunes(5)+"-"+strconv.Itoa(int(time.Now().Unix())))
+		}
+		w.seq++
 	}
 	return w.fn
 }
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	sls "github.com/aliyun/aliyun-log-go-sdk"
 	consumerLibrary "github.com/aliyun/aliyun-log-go-sdk/consumer"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -13,20 +18,38 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/admin"
+	"github.com/fengxsong/sls2oss/internal/compact"
 	"github.com/fengxsong/sls2oss/internal/config"
 	"github.com/fengxsong/sls2oss/internal/consumer"
+	"github.com/fengxsong/sls2oss/internal/credentials"
+	"github.com/fengxsong/sls2oss/internal/deadletter"
+	"github.com/fengxsong/sls2oss/internal/filter"
 	"github.com/fengxsong/sls2oss/internal/handler"
+	"github.com/fengxsong/sls2oss/internal/health"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/manifest"
 	"github.com/fengxsong/sls2oss/internal/metrics"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/retention"
+	"github.com/fengxsong/sls2oss/internal/tracing"
 	"github.com/fengxsong/sls2oss/internal/version"
+	"github.com/fengxsong/sls2oss/internal/watermark"
 	"github.com/fengxsong/sls2oss/internal/writer"
 )
 
 var (
 	configFileF string
 	dateFmtF    string
+	timezoneF   string
 	logLevelF   string
 )
 
+// sub commands, run as `sls2oss <command> [flags]`
+var commands = map[string]func(args []string) error{}
+
+// toLogHubConfig return consumer config of logstore, static keys are replaced
+// by those of credentials provider when consumers run
 func toLogHubConfig(c *config.SlsConfig, logstore string) *consumerLibrary.LogHubConfig {
 	return &consumerLibrary.LogHubConfig{
 		Endpoint:              c.Endpoint,
@@ -44,11 +67,105 @@ func toLogHubConfig(c *config.SlsConfig, logstore string) *consumerLibrary.LogHu
 	}
 }
 
+func addCommonFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&configFileF, "config", "c", "config.yaml", "JSON/YAML file of config")
+	fs.StringVar(&dateFmtF, "date-format", partition.DefaultFormat, "date format for dirs")
+	fs.StringVar(&timezoneF, "timezone", "", "timezone of date dirs, eg. UTC or Asia/Shanghai, default is local")
+	fs.StringVar(&logLevelF, "log-level", "info", "logging level")
+}
+
+// setup read config and apply flags on it
+func setup(fs *pflag.FlagSet) (*config.Config, log.Logger, error) {
+	cfg, err := config.ReadFromFile(configFileF)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read config error: %v", err)
+	}
+	if cfg.Logging.Level == "" || fs.Lookup("log-level").Changed {
+		cfg.Logging.Level = logLevelF
+	}
+	if cfg.Partition.Format == "" || fs.Lookup("date-format").Changed {
+		cfg.Partition.Format = dateFmtF
+	}
+	if cfg.Partition.Timezone == "" || fs.Lookup("timezone").Changed {
+		cfg.Partition.Timezone = timezoneF
+	}
+	if cfg.Filter != nil && cfg.Filter.Convert != nil {
+		// converted timestamps without zone are in partition timezone
+		for _, f := range cfg.Filter.Convert.Fields {
+			if f.Timezone == "" {
+				f.Timezone = cfg.Partition.Timezone
+			}
+		}
+	}
+	return cfg, initLogger(cfg.Logging), nil
+}
+
+// newPipeline create oss writer and handler which encode records into it
+func newPipeline(cfg *config.Config, logger log.Logger, workerNum int, quit <-chan struct{}) (*writer.OssWriter, *handler.MessageHandler, error) {
+	layout, err := partition.New(cfg.Partition)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid partition config: %v", err)
+	}
+	tpl, err := keytpl.Parse(cfg.Output.Oss.KeyTemplate, cfg.Output.Oss.MaxCardinality)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key template: %v", err)
+	}
+	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create oss writer: %v", err)
+	}
+	filters, err := filter.New(cfg.Filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create filters: %v", err)
+	}
+	h := handler.New(logger, layout, tpl, workerNum, cfg.WorkerKey, ossWriter)
+	h.AddFilters(filters...)
+	if cfg.DeadLetter != nil {
+		switch {
+		case cfg.DeadLetter.Dir != "":
+			sink, err := deadletter.NewLocalSink(cfg.DeadLetter.Dir)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create dead letter sink: %v", err)
+			}
+			h.SetDeadLetter(sink)
+		case cfg.DeadLetter.OssPrefix != "":
+			h.SetDeadLetter(deadletter.NewOssSink(cfg.DeadLetter.OssPrefix, ossWriter.WriteTo))
+		}
+	}
+	return ossWriter, h, nil
+}
+
+// newSLSClient create sls client signed with credentials of config, which are
+// refreshed until quit
+func newSLSClient(c *config.SlsConfig, logger log.Logger, quit <-chan struct{}) (sls.ClientInterface, error) {
+	provider, err := credentials.New(c.Credentials, logger)
+	if err != nil {
+		return nil, err
+	}
+	go provider.Run(quit)
+	return sls.CreateTokenAutoUpdateClient(c.Endpoint, provider.UpdateToken, quit)
+}
+
+func newManifestRecorder(cfg *config.Config, layout *partition.Layout, w *writer.OssWriter, logger log.Logger) (*manifest.Recorder, error) {
+	r, err := manifest.New(cfg.Manifest, layout, w.Bucket(), filepath.Join(cfg.Output.Oss.TempDir, manifest.JournalDir), logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest journals: %v", err)
+	}
+	return r, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fatal(os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	var printVersion bool
-	pflag.StringVarP(&configFileF, "config", "c", "config.yaml", "JSON/YAML file of config")
-	pflag.StringVar(&dateFmtF, "date-format", "yyyy/MM/dd/HH", "date format for dirs")
-	pflag.StringVar(&logLevelF, "log-level", "info", "logging level")
+	addCommonFlags(pflag.CommandLine)
 	pflag.BoolVarP(&printVersion, "version", "v", false, "print build version info")
 	pflag.Parse()
 
@@ -57,39 +174,164 @@ func main() {
 		return
 	}
 
-	cfg, err := config.ReadFromFile(configFileF)
+	cfg, logger, err := setup(pflag.CommandLine)
 	if err != nil {
-		fatal("read config error", err)
+		fatal(err)
 	}
 
-	if cfg.Logging.Level == "" || pflag.Lookup("log-level").Changed {
-		cfg.Logging.Level = logLevelF
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		fatal("failed to setup tracing", err)
 	}
-	logger := initLogger(cfg.Logging)
 
 	quit := internal.SetupSignalHandler()
-	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	ossWriter, h, err := newPipeline(cfg, logger, cfg.Worker, quit)
 	if err != nil {
-		fatal("failed to create oss writer", err)
+		fatal(err)
+	}
+	// shards not updated within 10 lag intervals are considered released
+	watermarks := watermark.New(10 * time.Duration(cfg.Input.Sls.LagInterval))
+	// already validated by newPipeline
+	layout, _ := partition.New(cfg.Partition)
+	if cfg.Watermark.Enabled {
+		h.SetWatermark(cfg.Watermark, watermarks.Watermark)
+		ossWriter.SetWatermark(cfg.Watermark, watermarks.Watermark, layout)
+	}
+	if cfg.Manifest.Enabled {
+		recorder, err := newManifestRecorder(cfg, layout, ossWriter, logger)
+		if err != nil {
+			fatal(err)
+		}
+		ossWriter.SetManifest(recorder)
+		// partitions are complete only if watermark covers the whole consumer group
+		go recorder.Run(quit, func() (time.Time, bool) { return watermarks.Complete(cfg.Input.Sls.Logstores) }, ossWriter.Busy)
+	}
+	if cfg.Compaction.Enabled {
+		go compact.New(cfg.Compaction, cfg.Manifest, cfg.Output.Oss, ossWriter.Bucket(), ossWriter.Cipher(), logger).Run(quit)
+	}
+	if cfg.Retention.Enabled {
+		sweeper, err := retention.New(cfg.Retention, layout, ossWriter.Bucket(), cfg.Watermark.LatePrefix, logger)
+		if err != nil {
+			fatal("failed to open audit log", err)
+		}
+		go sweeper.Run(quit)
+	}
+	slsCredentials, err := credentials.New(cfg.Input.Sls.Credentials, logger)
+	if err != nil {
+		fatal("failed to get sls credentials", err)
+	}
+	go slsCredentials.Run(quit)
+	checker := health.New(cfg.Health, cfg.Input.Sls.Logstores, ossWriter, cfg.Output.Oss.TempDir)
+	checker.Register(http.DefaultServeMux)
+	consumers := make(map[string]consumer.Consumer, len(cfg.Input.Sls.Logstores))
+	for _, ls := range cfg.Input.Sls.Logstores {
+		ls := ls
+		lsLogger := log.With(logger, "logstore", ls)
+		consumers[ls] = consumer.New(toLogHubConfig(cfg.Input.Sls, ls), lsLogger, cfg.Input.Sls.IncludeMeta, h.Consume,
+			consumer.WithLagInterval(time.Duration(cfg.Input.Sls.LagInterval)),
+			consumer.WithWatermark(watermarks),
+			consumer.WithCredentials(slsCredentials),
+			consumer.WithProgress(func() { checker.Heartbeat(ls) }))
+	}
+	if cfg.Admin.Enabled {
+		if cfg.Metric.Port <= 0 {
+			level.Warn(logger).Log("msg", "admin api is enabled but metric port is not set")
+		}
+		admin.New(cfg, ossWriter, consumers, logger).Register(http.DefaultServeMux)
 	}
+	// stop is closed on signals, or once consumers exited on their own, eg.
+	// all of them failed to start
+	consumersDone := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-quit:
+		case <-consumersDone:
+		}
+		close(stop)
+	}()
+	g := &errgroup.Group{}
+	// serve probes while syncing orphaned files
+	g.Go(func() error { return metrics.Serve(cfg.Metric.Port, cfg.Metric.Path, logger, stop) })
 	if cfg.Output.Oss.SyncOrphanedFiles {
 		if err = ossWriter.StartWait(); err != nil {
 			fatal("failed to do some prestart jobs", err)
 		}
 	}
-	h := handler.New(logger, dateFmtF, cfg.Worker, ossWriter, quit)
-	g := &errgroup.Group{}
-	// wait for oss write to complete.
-	g.Go(func() error { return ossWriter.Wait() })
-	g.Go(func() error { return metrics.Serve(cfg.Metric.Port, cfg.Metric.Path, logger, quit) })
-	for _, ls := range cfg.Input.Sls.Logstores {
-		lsLogger := log.With(logger, "logstore", ls)
-		consumer := consumer.New(toLogHubConfig(cfg.Input.Sls, ls), lsLogger, cfg.Input.Sls.IncludeMeta, h.Consume)
-		g.Go(func() error { return consumer.Run(quit) })
+	checker.SetOrphanSynced()
+	var consumersErr error
+	go func() {
+		cg := &errgroup.Group{}
+		for _, c := range consumers {
+			consumer := c
+			cg.Go(func() error { return consumer.Run(quit) })
+		}
+		consumersErr = cg.Wait()
+		close(consumersDone)
+	}()
+	<-stop
+
+	level.Info(logger).Log("msg", "shutting down", "timeout", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	// stop fetching first, batches being processed are handed over to handler,
+	// which must not be closed before that
+	var (
+		left     []string
+		drainErr error
+	)
+	select {
+	case <-consumersDone:
+		left, drainErr = drain(ctx, h, ossWriter, logger)
+	case <-ctx.Done():
+		left, drainErr = ossWriter.Pending(), ctx.Err()
+	}
+	for _, fn := range left {
+		level.Warn(logger).Log("msg", "file left for orphan sync", "file", fn)
+	}
+	if drainErr != nil {
+		level.Error(logger).Log("msg", "shutdown is not finished in time", "left", len(left), "err", drainErr)
 	}
 	if err := g.Wait(); err != nil {
-		fatal("error occur while waiting goroutines to exit", err)
+		level.Error(logger).Log("msg", "serve metrics", "err", err)
+	}
+	tracingCtx, tracingCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer tracingCancel()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		level.Error(logger).Log("msg", "failed to flush spans", "err", err)
+	}
+	select {
+	case <-consumersDone:
+		// consumers failed without signals, or on stopping
+		if consumersErr != nil {
+			fatal("error occur while waiting consumers to exit", consumersErr)
+		}
+	default:
+		// consumers did not stop in time, which is reported as drain error
+	}
+	if drainErr != nil {
+		os.Exit(1)
+	}
+}
+
+// drain stop pipeline in order once sources stop feeding it: handler workers
+// consume queued batches, then files are closed and uploaded. Files not
+// uploaded before ctx is done are returned.
+func drain(ctx context.Context, h *handler.MessageHandler, w *writer.OssWriter, logger log.Logger) ([]string, error) {
+	drained := make(chan struct{})
+	go func() {
+		h.Close()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return w.Pending(), ctx.Err()
+	}
+	if err := w.Close(); err != nil {
+		level.Error(logger).Log("msg", "close files", "err", err)
 	}
+	return w.Wait(ctx)
 }
 
 func fatal(args ...interface{}) {
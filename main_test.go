@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/go-kit/kit/log"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/handler"
+	"github.com/fengxsong/sls2oss/internal/keytpl"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name          string
+		blockUpload   bool
+		blockHandler  bool
+		expectedLeft  bool
+		expectedError error
+	}{
+		{name: "uploaded"},
+		{name: "upload not finished", blockUpload: true, expectedLeft: true, expectedError: context.DeadlineExceeded},
+		{name: "handler not finished", blockHandler: true, expectedError: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				release   = make(chan struct{})
+				filtering sync.WaitGroup
+				uploaded  int32
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.blockUpload {
+					<-release
+				}
+				b, _ := ioutil.ReadAll(r.Body)
+				atomic.AddInt32(&uploaded, 1)
+				w.Header().Set("x-oss-hash-crc64ecma", strconv.FormatUint(crc64.Checksum(b, crc64.MakeTable(crc64.ECMA)), 10))
+			}))
+			defer func() {
+				// unblock uploads and filters left by drain before cleaning up
+				close(release)
+				filtering.Wait()
+				srv.Close()
+			}()
+
+			cfg := &config.OssConfig{
+				Endpoint:        srv.URL,
+				AccessKeyID:     "id",
+				AccessKeySecret: "secret",
+				Bucket:          "bucket",
+				TempDir:         t.TempDir(),
+				ScanInterval:    config.Duration(time.Second),
+			}
+			if err := cfg.ValidateAndSetDefaults(); err != nil {
+				t.Fatal(err)
+			}
+			quit := make(chan struct{})
+			defer close(quit)
+			w, err := writer.NewOssWriter(cfg, nil, quit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layout, err := partition.New(&config.Partition{Timezone: "UTC"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tpl, err := keytpl.Parse("{logstore}/{seq}.json", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := handler.New(log.NewNopLogger(), layout, tpl, 2, handler.WorkerKeyShard, w)
+			if tt.blockHandler {
+				// records are dropped once released, so workers left by drain
+				// write nothing after the test
+				filtering.Add(2)
+				h.AddFilters(func(m map[string]interface{}) map[string]interface{} {
+					defer filtering.Done()
+					<-release
+					return nil
+				})
+			}
+
+			key, value := "k", "v"
+			for shard := 0; shard < 2; shard++ {
+				b := internal.NewBatch(&internal.Source{Logstore: "ls", Shard: shard})
+				b.Records = append(b.Records, internal.Record{
+					Topic:    "t",
+					Time:     time.Now(),
+					Contents: []*sls.LogContent{{Key: &key, Value: &value}},
+				})
+				if err = h.Consume(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			left, err := drain(ctx, h, w, log.NewNopLogger())
+			if err != tt.expectedError {
+				t.Fatalf("drain error %v, expected %v", err, tt.expectedError)
+			}
+			if (len(left) > 0) != tt.expectedLeft {
+				t.Errorf("files left %v", left)
+			}
+			if tt.expectedError == nil && atomic.LoadInt32(&uploaded) == 0 {
+				t.Error("nothing is uploaded")
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/spf13/pflag"
+
+	"github.com/fengxsong/sls2oss/internal"
+	"github.com/fengxsong/sls2oss/internal/restore"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+func init() {
+	commands["restore"] = restoreObjects
+}
+
+// restoreObjects put archived records under prefix back into a logstore
+func restoreObjects(args []string) error {
+	fs := pflag.NewFlagSet("restore", pflag.ExitOnError)
+	addCommonFlags(fs)
+	prefix := fs.String("prefix", "", "restore objects under this prefix, eg. topic/2024/01/02")
+	logstore := fs.String("to-logstore", "", "logstore to put records into")
+	project := fs.String("project", "", "project of logstore, default is input.sls.project")
+	source := fs.String("source", "sls2oss-restore", "source of log groups")
+	rate := fs.Int("rate", 5000, "max logs per second, 0 means unlimited")
+	batchSize := fs.Int("batch-size", 4096, "max logs of a log group")
+	stateFile := fs.String("state", "", "file to save progress in, so restoring resumes from it, default is under temp dir")
+	fs.Parse(args)
+
+	if *prefix == "" || *logstore == "" {
+		return errors.New("--prefix and --to-logstore are required")
+	}
+	cfg, logger, err := setup(fs)
+	if err != nil {
+		return err
+	}
+	if *project == "" {
+		*project = cfg.Input.Sls.Project
+	}
+	if *stateFile == "" {
+		*stateFile = filepath.Join(cfg.Output.Oss.TempDir, ".restore", url.PathEscape(*project+"-"+*logstore+"-"+*prefix)+".json")
+	}
+	quit := internal.SetupSignalHandler()
+	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create oss writer: %v", err)
+	}
+	client, err := newSLSClient(cfg.Input.Sls, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create sls client: %v", err)
+	}
+	r := restore.New(ossWriter.Bucket(), client, restore.Options{
+		Project:   *project,
+		Logstore:  *logstore,
+		Source:    *source,
+		Rate:      *rate,
+		BatchSize: *batchSize,
+		StateFile: *stateFile,
+		Cipher:    ossWriter.Cipher(),
+	}, logger)
+	stats, err := r.Run(*prefix, quit)
+	level.Info(logger).Log("msg", "restore done", "objects", stats.Objects, "records", stats.Records, "skipped", stats.Skipped, "state", *stateFile)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/spf13/pflag"
+
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/retention"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+func init() {
+	commands["sweep"] = sweepExpired
+}
+
+// sweepExpired delete partitions older than retention rules once
+func sweepExpired(args []string) error {
+	fs := pflag.NewFlagSet("sweep", pflag.ExitOnError)
+	addCommonFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only audit partitions to be deleted, default is retention.dry_run")
+	fs.Parse(args)
+
+	cfg, logger, err := setup(fs)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Retention.Rules) == 0 {
+		return errors.New("no retention rules")
+	}
+	layout, err := partition.New(cfg.Partition)
+	if err != nil {
+		return fmt.Errorf("invalid partition config: %v", err)
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create oss writer: %v", err)
+	}
+	s, err := retention.New(cfg.Retention, layout, ossWriter.Bucket(), cfg.Watermark.LatePrefix, logger)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	dry := cfg.Retention.DryRun
+	if fs.Changed("dry-run") {
+		// --dry-run=false deletes even if retention.dry_run is set
+		dry = *dryRun
+	}
+	stats, err := s.Sweep(dry)
+	level.Info(logger).Log("msg", "sweep done", "partitions", stats.Partitions, "objects", stats.Objects, "dry_run", dry)
+	return err
+}
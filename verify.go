@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/spf13/pflag"
+
+	"github.com/fengxsong/sls2oss/internal/config"
+	"github.com/fengxsong/sls2oss/internal/manifest"
+	"github.com/fengxsong/sls2oss/internal/partition"
+	"github.com/fengxsong/sls2oss/internal/verify"
+	"github.com/fengxsong/sls2oss/internal/writer"
+)
+
+func init() {
+	commands["verify"] = verifyArchives
+}
+
+// verifyArchives compare log counts of sls with archived counts per partition
+func verifyArchives(args []string) error {
+	fs := pflag.NewFlagSet("verify", pflag.ExitOnError)
+	addCommonFlags(fs)
+	logstore := fs.String("logstore", "", "logstore to verify")
+	from := fs.String("from", "24h", "start of time range, RFC3339, `2006-01-02 15:04:05` in partition timezone, or duration before now")
+	to := fs.String("to", "", "end of time range, same format as --from, default is start of the current partition")
+	query := fs.String("query", "", "only count sls logs matching this query, eg. to exclude logs dropped by filters")
+	source := fs.String("source", verify.SourceManifest, "source of archived counts, manifest or objects")
+	parallel := fs.Int("parallel", 8, "objects counted at the same time")
+	asJSON := fs.Bool("json", false, "print windows as json lines")
+	backfill := fs.String("backfill", "", "archive windows again from sls, only missing is supported, which backfills windows without archived records")
+	slack := fs.Duration("backfill-slack", 10*time.Minute, "widen cursor range of backfilled windows, logs received late are pulled as well")
+	fs.Parse(args)
+
+	if *logstore == "" {
+		return errors.New("--logstore is required")
+	}
+	if *source != verify.SourceManifest && *source != verify.SourceObjects {
+		return fmt.Errorf("unknown source %q", *source)
+	}
+	if *backfill != "" && *backfill != verify.StatusMissing {
+		// records of partially archived windows can't be told apart from the
+		// ones archived already, backfilling them would duplicate records
+		return fmt.Errorf("unknown backfill mode %q, only %s is supported", *backfill, verify.StatusMissing)
+	}
+	cfg, logger, err := setup(fs)
+	if err != nil {
+		return err
+	}
+	layout, err := partition.New(cfg.Partition)
+	if err != nil {
+		return fmt.Errorf("invalid partition config: %v", err)
+	}
+	now := time.Now()
+	start, err := parseTimeFlag(*from, layout.Location(), now)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %v", err)
+	}
+	// the current partition is still being written
+	end, _ := layout.Period(now)
+	if *to != "" {
+		if end, err = parseTimeFlag(*to, layout.Location(), now); err != nil {
+			return fmt.Errorf("invalid --to: %v", err)
+		}
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	ossWriter, err := writer.NewOssWriter(cfg.Output.Oss, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create oss writer: %v", err)
+	}
+	opts := verify.Options{
+		Project:     cfg.Input.Sls.Project,
+		Logstore:    *logstore,
+		KeyTemplate: cfg.Output.Oss.KeyTemplate,
+		Query:       *query,
+		Source:      *source,
+		Manifest:    cfg.Manifest.Name,
+		Parallel:    *parallel,
+		Cipher:      ossWriter.Cipher(),
+	}
+	if cfg.Watermark.Enabled {
+		opts.LatePrefix = cfg.Watermark.LatePrefix
+	}
+	client, err := newSLSClient(cfg.Input.Sls, logger, quit)
+	if err != nil {
+		return fmt.Errorf("failed to create sls client: %v", err)
+	}
+	v := verify.New(client, ossWriter.Bucket(), layout, opts, logger)
+	windows, err := v.Verify(start, end)
+	printWindows(windows, *asJSON)
+	if err != nil {
+		return err
+	}
+
+	var bad []*verify.Window
+	for _, w := range windows {
+		if w.Status() != verify.StatusOK {
+			bad = append(bad, w)
+		}
+	}
+	if *backfill != "" {
+		if err = backfillWindows(cfg, logger, v, bad, *slack); err != nil {
+			return err
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d of %d windows mismatched", len(bad), len(windows))
+	}
+	return nil
+}
+
+func printWindows(windows []*verify.Window, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, w := range windows {
+			enc.Encode(struct {
+				*verify.Window
+				Status string `json:"status"`
+			}{w, w.Status()})
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tEND\tSLS\tARCHIVED\tDIFF\tSTATUS\tSOURCE")
+	for _, w := range windows {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%+d\t%s\t%s\n", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339),
+			w.SLS, w.Archived, w.Archived-w.SLS, w.Status(), w.Source)
+	}
+	tw.Flush()
+}
+
+// backfillWindows archive missing windows again through the pipeline. Files
+// are kept under a hidden temp dir, so orphan sync of a running instance
+// sharing the temp dir leaves them alone.
+func backfillWindows(cfg *config.Config, logger log.Logger, v *verify.Verifier, windows []*verify.Window, slack time.Duration) error {
+	cfg.Output.Oss.TempDir = filepath.Join(cfg.Output.Oss.TempDir, ".backfill")
+	quit := make(chan struct{})
+	// one worker, so every batch is written before returning
+	ossWriter, h, err := newPipeline(cfg, logger, 1, quit)
+	if err != nil {
+		return err
+	}
+	layout, _ := partition.New(cfg.Partition)
+	var recorder *manifest.Recorder
+	if cfg.Manifest.Enabled {
+		r, err := newManifestRecorder(cfg, layout, ossWriter, logger)
+		if err != nil {
+			return err
+		}
+		ossWriter.SetManifest(r)
+		recorder = r
+	}
+	for _, w := range windows {
+		if w.Status() != verify.StatusMissing {
+			continue
+		}
+		if _, err = v.Backfill(w, slack, cfg.Input.Sls.IncludeMeta, h.Consume); err != nil {
+			break
+		}
+	}
+	if _, werr := drain(context.Background(), h, ossWriter, logger); werr != nil && err == nil {
+		err = werr
+	}
+	close(quit)
+	if err != nil || recorder == nil {
+		return err
+	}
+	// backfilled partitions are already closed, merge them into manifests now
+	now := time.Now()
+	for _, p := range recorder.Ready(now.Add(time.Duration(cfg.Manifest.Grace))) {
+		if err := recorder.Finish(p, now); err != nil {
+			level.Error(logger).Log("msg", "finish partition", "partition", p, "err", err)
+		}
+	}
+	return nil
+}